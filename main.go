@@ -14,55 +14,178 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/elotl/buildscaler/pkg/ciprovider"
 	"github.com/elotl/buildscaler/pkg/collector"
+	"github.com/elotl/buildscaler/pkg/config"
+	"github.com/elotl/buildscaler/pkg/derived"
+	"github.com/elotl/buildscaler/pkg/relabel"
 	storagemap "github.com/elotl/buildscaler/pkg/storage"
 
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/component-base/logs"
 	"k8s.io/klog/v2"
+	ctrlconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/cmd"
 )
 
-var (
-	BuildkitePlatform  = "buildkite"
-	CircleCIPlatform   = "circleci"
-	FlarebuildPlatform = "flarebuild"
-
-	CIPlatforms = []string{
-		BuildkitePlatform,
-		CircleCIPlatform,
-		FlarebuildPlatform,
-	}
-)
-
-func createMetricCollector(ciPlatform string, storage *storagemap.ExternalMetricsMap) (collector.CIMetricsCollector, error) {
-	switch ciPlatform {
-	case CircleCIPlatform:
-		// TODO
-		token, projectSlug := GetCircleCIConfigFromEnvOrDie()
-		metricsCollector, err := collector.NewCircleCICollector(token, projectSlug, time.Minute*30, storage)
+func createMetricCollector(c config.Collector) (collector.CIMetricsCollector, error) {
+	switch c.Platform {
+	case config.CircleCIPlatform:
+		token, err := c.CircleCI.Token.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get CircleCI token: %w", err)
+		}
+		metricsCollector, err := collector.NewCircleCICollector(token, c.CircleCI.ProjectSlug, c.CircleCI.Endpoint, c.CircleCI.MaxPipelineAge.Duration)
 		if err != nil {
 			klog.Errorf("cannot start CircleCI scraper: %s", err)
 			return nil, err
 		}
 		return metricsCollector, nil
-	case BuildkitePlatform:
-		token := GetBuildkiteTokenFromEnvOrDie()
-		queues := GetBuildkiteQueuesFromEnv()
-		return collector.NewBuildkiteCollector(storage, token, "v0.0.1", queues), nil
-	case FlarebuildPlatform:
-		var apiKey, endpoint = GetFlarebuildConfigFromEnvOrDie()
-		return collector.NewFlarebuild(storage, apiKey, endpoint)
+	case config.BuildkitePlatform:
+		var token string
+		var orgs []collector.BuildkiteOrg
+		var clusters []collector.BuildkiteCluster
+		if len(c.Buildkite.Orgs) == 0 && len(c.Buildkite.Clusters) == 0 {
+			var err error
+			token, err = c.Buildkite.Token.Resolve()
+			if err != nil {
+				return nil, fmt.Errorf("cannot get Buildkite Agent Token: %w", err)
+			}
+		}
+		for i, org := range c.Buildkite.Orgs {
+			orgToken, err := org.Token.Resolve()
+			if err != nil {
+				return nil, fmt.Errorf("cannot get Buildkite Agent Token of org %d: %w", i, err)
+			}
+			queues := org.Queues
+			if len(queues) == 0 {
+				queues = c.Buildkite.Queues
+			}
+			orgs = append(orgs, collector.BuildkiteOrg{Token: orgToken, Queues: queues})
+		}
+		for _, cluster := range c.Buildkite.Clusters {
+			clusterToken, err := cluster.Token.Resolve()
+			if err != nil {
+				return nil, fmt.Errorf("cannot get Buildkite Agent Token of cluster %s: %w", cluster.Name, err)
+			}
+			queues := cluster.Queues
+			if len(queues) == 0 {
+				queues = c.Buildkite.Queues
+			}
+			clusters = append(clusters, collector.BuildkiteCluster{Name: cluster.Name, Token: clusterToken, Queues: queues})
+		}
+		metricsCollector := collector.NewBuildkiteCollector(token, "v0.0.1", c.Buildkite.Queues)
+		metricsCollector.Endpoint = c.Buildkite.Endpoint
+		metricsCollector.Orgs = orgs
+		metricsCollector.Clusters = clusters
+		if c.Buildkite.API != nil {
+			apiToken, err := c.Buildkite.API.Token.Resolve()
+			if err != nil {
+				return nil, fmt.Errorf("cannot get Buildkite API token: %w", err)
+			}
+			metricsCollector.API = collector.NewBuildkiteAPI(c.Buildkite.API.Endpoint, apiToken)
+			metricsCollector.API.WaitTimes = c.Buildkite.API.WaitTimes
+			metricsCollector.API.Pipelines = c.Buildkite.API.Pipelines
+			metricsCollector.API.AgentQueryRules = c.Buildkite.API.AgentQueryRules
+			metricsCollector.API.Agents = c.Buildkite.API.Agents
+		}
+		return metricsCollector, nil
+	case config.FlarebuildPlatform:
+		apiKey, err := c.Flarebuild.APIKey.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get Flarebuild API key: %w", err)
+		}
+		klog.V(2).Infof("using %s as endpoint", c.Flarebuild.Endpoint)
+		return collector.NewFlarebuild(apiKey, c.Flarebuild.Endpoint)
+	case config.GitHubActionsPlatform:
+		token, err := c.GitHubActions.Token.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get GitHub token: %w", err)
+		}
+		return collector.NewGitHubActionsCollector(token, c.GitHubActions.Endpoint, c.GitHubActions.Org, c.GitHubActions.Repos), nil
+	case config.GitLabPlatform:
+		token, err := c.GitLab.Token.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get GitLab token: %w", err)
+		}
+		return collector.NewGitLabCollector(token, c.GitLab.Endpoint, c.GitLab.Projects, c.GitLab.Groups), nil
+	case config.JenkinsPlatform:
+		token, err := c.Jenkins.Token.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get Jenkins API token: %w", err)
+		}
+		return collector.NewJenkinsCollector(c.Jenkins.Endpoint, c.Jenkins.User, token), nil
+	case config.AzureDevOpsPlatform:
+		token, err := c.AzureDevOps.Token.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get Azure DevOps personal access token: %w", err)
+		}
+		return collector.NewAzureDevOpsCollector(c.AzureDevOps.Endpoint, token, c.AzureDevOps.Pools), nil
+	case config.InClusterPlatform:
+		restConfig, err := ctrlconfig.GetConfig()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get cluster config: %w", err)
+		}
+		return collector.NewInClusterCollector(restConfig, c.InCluster.Namespace, c.InCluster.Tekton, c.InCluster.Argo, c.InCluster.GroupByLabels)
+	case config.HTTPJSONPlatform:
+		header, err := c.HTTPJSON.Header()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get HTTP headers: %w", err)
+		}
+		return collector.NewHTTPJSONCollector(c.HTTPJSON.URL, header, c.HTTPJSON.Pagination, c.HTTPJSON.Metrics)
+	case config.PrometheusPlatform:
+		header, err := c.Prometheus.Header()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get HTTP headers: %w", err)
+		}
+		return collector.NewPrometheusCollector(c.Prometheus.URL, c.Prometheus.Query, c.Prometheus.MetricName, c.Prometheus.Match, header)
+	case config.REAPIPlatform:
+		var token string
+		if c.REAPI.Token != nil {
+			var err error
+			if token, err = c.REAPI.Token.Resolve(); err != nil {
+				return nil, fmt.Errorf("cannot get REAPI scheduler token: %w", err)
+			}
+		}
+		metricsCollector := collector.NewREAPICollector(c.REAPI.Endpoint, token)
+		metricsCollector.OSFamilyProperty = c.REAPI.OSFamilyProperty
+		metricsCollector.ContainerImageProperty = c.REAPI.ContainerImageProperty
+		return metricsCollector, nil
+	case config.DronePlatform:
+		token, err := c.Drone.Token.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get Drone token: %w", err)
+		}
+		return collector.NewDroneCollector(collector.DroneServer, c.Drone.Endpoint, token, c.Drone.Labels), nil
+	case config.WoodpeckerPlatform:
+		token, err := c.Woodpecker.Token.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get Woodpecker token: %w", err)
+		}
+		return collector.NewDroneCollector(collector.WoodpeckerServer, c.Woodpecker.Endpoint, token, c.Woodpecker.Labels), nil
+	case config.TeamCityPlatform:
+		token, err := c.TeamCity.Token.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get TeamCity access token: %w", err)
+		}
+		return collector.NewTeamCityCollector(c.TeamCity.Endpoint, token), nil
 	default:
-		return nil, fmt.Errorf("unknown ci platform: %s", ciPlatform)
+		return nil, fmt.Errorf("unknown ci platform: %s", c.Platform)
 	}
 }
 
@@ -72,29 +195,108 @@ func main() {
 	}
 	logs.InitLogs()
 	defer logs.FlushLogs()
-	var scrapePeriod time.Duration
-	var CIPlatform string
-	adapter.Flags().DurationVar(&scrapePeriod, "scrape-period", time.Second*5, "scrape period")
+	var scrapePeriod, maxScrapeBackoff, staleAfter, evictAfter, configReloadPeriod time.Duration
+	var stalePolicy, staleFallbackValue, storageFile, configFile string
+	var ciPlatforms []string
+	adapter.Flags().StringVar(&configFile, "config", "", "path to the configuration file. If set, --ci-platform, --scrape-period and --derived-metric are ignored")
+	adapter.Flags().DurationVar(&configReloadPeriod, "config-reload-period", time.Second*10, "how often the configuration file is checked for changes")
+	adapter.Flags().DurationVar(&scrapePeriod, "scrape-period", config.DefaultScrapePeriod, "default scrape period of every CI platform")
+	adapter.Flags().DurationVar(&maxScrapeBackoff, "max-scrape-backoff", time.Minute*5, "longest delay between retries of a collector whose scrapes keep failing")
+	adapter.Flags().DurationVar(&staleAfter, "stale-after", 0, "consider a metric series stale when it was not updated for this long (0 disables)")
+	adapter.Flags().DurationVar(&evictAfter, "evict-after", 0, "delete a metric series when it was not updated for this long (0 disables)")
 	adapter.Flags().StringVar(
-		&CIPlatform,
+		&stalePolicy,
+		"stale-policy",
+		string(ciprovider.StalePolicyServe),
+		fmt.Sprintf("what to return for stale metric series. One of these: %s", ciprovider.StalePolicies),
+	)
+	adapter.Flags().StringVar(&staleFallbackValue, "stale-fallback-value", "0", "value returned for stale metric series with --stale-policy=fallback")
+	var historySize int
+	var aggregations []string
+	adapter.Flags().IntVar(&historySize, "history-size", 360, "number of samples kept per metric series for windowed aggregations (0 disables)")
+	adapter.Flags().StringSliceVar(
+		&aggregations,
+		"aggregations",
+		[]string{"avg_5m", "max_10m", "p95_15m"},
+		"aggregations listed as <metric>_<aggregation> for every metric, e.g. avg_5m, min_1m, max_10m, p95_15m",
+	)
+	var derivedMetrics []string
+	adapter.Flags().StringArrayVar(
+		&derivedMetrics,
+		"derived-metric",
+		nil,
+		"metric computed after every scrape, as <name>=<expression>, e.g. desired_agents=buildkite_running_jobs_count+buildkite_scheduled_jobs_count+2 (repeatable)",
+	)
+	adapter.Flags().StringVar(&storageFile, "storage-file", "", "persist scraped metrics to this JSON file and load them on startup (in-memory only if empty)")
+	adapter.Flags().StringSliceVar(
+		&ciPlatforms,
 		"ci-platform",
-		BuildkitePlatform,
-		fmt.Sprintf("CI platform to scrap the metrics from. One of these: %s", CIPlatforms),
+		[]string{config.BuildkitePlatform},
+		fmt.Sprintf("CI platforms to scrap the metrics from, as <platform>[:<scrape period>] (repeatable). Platform is one of these: %s", config.Platforms),
 	)
 	adapter.Flags().AddGoFlagSet(flag.CommandLine) // make sure you get the klog flags
 	err := adapter.Flags().Parse(os.Args)
 	if err != nil {
 		klog.Fatal(err)
 	}
-	storage := storagemap.NewExternalMetricsMap()
-	metricsCollector, err := createMetricCollector(CIPlatform, storage)
+	metricsMap := storagemap.NewExternalMetricsMap()
+	metricsMap.StaleAfter = staleAfter
+	metricsMap.EvictAfter = evictAfter
+	metricsMap.HistorySize = historySize
+	var storage storagemap.MetricsStore = metricsMap
+	if storageFile != "" {
+		storage, err = storagemap.NewFileStore(metricsMap, storageFile)
+		if err != nil {
+			klog.Fatalf("cannot load metrics from %s: %s", storageFile, err)
+		}
+	}
+	var cfg *config.Config
+	var cfgContent []byte
+	if configFile != "" {
+		cfgContent, err = ioutil.ReadFile(configFile)
+		if err != nil {
+			klog.Fatalf("cannot read config: %s", err)
+		}
+		cfg, err = config.Parse(cfgContent)
+	} else {
+		cfg, err = configFromFlags(ciPlatforms, scrapePeriod, derivedMetrics)
+	}
 	if err != nil {
-		klog.Fatal(err)
+		klog.Fatalf("invalid config: %s", err)
 	}
 
-	klog.V(2).Infof("using %s scraper & metrics provider", CIPlatform)
 	externalMetricsProvider := ciprovider.NewExternalMetricsProviderFromStorage(storage)
+	externalMetricsProvider.StalePolicy, err = parseStalePolicy(stalePolicy)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	externalMetricsProvider.FallbackValue, err = resource.ParseQuantity(staleFallbackValue)
+	if err != nil {
+		klog.Fatalf("invalid --stale-fallback-value: %s", err)
+	}
+	if historySize > 0 {
+		for _, a := range aggregations {
+			aggregation, err := ciprovider.ParseAggregation(a)
+			if err != nil {
+				klog.Fatal(err)
+			}
+			externalMetricsProvider.Aggregations = append(externalMetricsProvider.Aggregations, aggregation)
+		}
+	}
 	adapter.WithExternalMetrics(externalMetricsProvider)
+	// The custom metrics API is only served for Buildkite agent metrics: a
+	// config reload enabling them needs a restart to serve it.
+	if cfg.CustomMetrics() {
+		mapper, err := adapter.RESTMapper()
+		if err != nil {
+			klog.Fatalf("unable to create REST mapper for custom metrics: %s", err)
+		}
+		dynamicClient, err := adapter.DynamicClient()
+		if err != nil {
+			klog.Fatalf("unable to create dynamic client for custom metrics: %s", err)
+		}
+		adapter.WithCustomMetrics(ciprovider.NewCustomMetricsProviderFromStorage(storage, mapper, dynamicClient))
+	}
 
 	ctx, cancel := context.WithCancel(signals.SetupSignalHandler())
 	defer cancel()
@@ -108,28 +310,376 @@ func main() {
 		close(serverDone)
 	}()
 
+	group, err := newCollectorGroup(cfg, storage, maxScrapeBackoff)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	group.start(ctx, externalMetricsProvider)
+
 	ticker := time.NewTicker(scrapePeriod)
+	defer ticker.Stop()
+	reloadTicker := time.NewTicker(configReloadPeriod)
+	defer reloadTicker.Stop()
 	for {
-		err := metricsCollector.Collect(cancel)
-		if err != nil {
-			klog.Errorf("error scraping metrics: %s", err)
-		}
 		select {
 		case <-ctx.Done():
 			klog.Info("Finished.")
+			group.stop()
 			<-serverDone // Wait for metrics adapter to finish
 			return
 		case <-ticker.C:
+			if evicted := storage.EvictStale(time.Now()); evicted > 0 {
+				klog.V(2).Infof("evicted %d stale metric series", evicted)
+			}
+		case <-reloadTicker.C:
+			if configFile == "" {
+				continue
+			}
+			content, err := ioutil.ReadFile(configFile)
+			if err != nil {
+				klog.Errorf("cannot read config, keeping the current one: %s", err)
+				continue
+			}
+			if bytes.Equal(content, cfgContent) {
+				continue
+			}
+			newGroup, err := reloadCollectorGroup(content, storage, maxScrapeBackoff)
+			if err != nil {
+				// Leave cfgContent alone, so the reload is retried on the
+				// next tick, e.g. when a secret is not mounted yet.
+				klog.Errorf("invalid config, keeping the current one: %s", err)
+				continue
+			}
+			cfgContent = content
+			klog.Info("config changed, restarting collectors")
+			group.stop()
+			deleteRemovedCollectors(group, newGroup, storage)
+			group = newGroup
+			group.start(ctx, externalMetricsProvider)
+		}
+	}
+}
+
+func reloadCollectorGroup(content []byte, storage storagemap.MetricsStore, maxBackoff time.Duration) (*collectorGroup, error) {
+	cfg, err := config.Parse(content)
+	if err != nil {
+		return nil, err
+	}
+	return newCollectorGroup(cfg, storage, maxBackoff)
+}
+
+// deleteRemovedCollectors deletes the series of the collectors of old that
+// are missing from new, which would otherwise be served forever.
+func deleteRemovedCollectors(old, new *collectorGroup, storage storagemap.MetricsStore) {
+	names := map[string]bool{}
+	for _, c := range new.collectors {
+		names[c.name] = true
+	}
+	for _, c := range old.collectors {
+		if !names[c.name] {
+			deleted := storage.DeleteSource(c.name)
+			klog.V(2).Infof("collector %s was removed, deleted its %d metric series", c.name, deleted)
+		}
+	}
+}
+
+// collectorGroup holds the collectors and derived metrics created from one
+// config. When the config file changes the whole group is replaced, while
+// the storage and the metrics API server keep running.
+type collectorGroup struct {
+	collectors []scheduledCollector
+	evaluator  *derived.Evaluator
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+func newCollectorGroup(cfg *config.Config, storage storagemap.MetricsStore, maxBackoff time.Duration) (*collectorGroup, error) {
+	metrics, err := cfg.Metrics()
+	if err != nil {
+		return nil, err
+	}
+	group := &collectorGroup{evaluator: derived.NewEvaluator(storage, metrics)}
+	for _, c := range cfg.Collectors {
+		var store storagemap.MetricsStore = storage
+		if rules := append(append([]relabel.Rule{}, c.Relabel...), cfg.Relabel...); len(rules) > 0 {
+			store = relabel.NewStore(storage, rules)
+		}
+		metricsCollector, err := createMetricCollector(c)
+		if err != nil {
+			return nil, fmt.Errorf("collector %s: %w", c.Name, err)
+		}
+		group.collectors = append(group.collectors, scheduledCollector{
+			name:       c.Name,
+			period:     c.ScrapePeriod.Duration,
+			maxBackoff: maxBackoff,
+			collector:  metricsCollector,
+			store:      store,
+		})
+	}
+	return group, nil
+}
+
+func (g *collectorGroup) start(ctx context.Context, externalMetricsProvider *ciprovider.ExternalMetricsProviderFromStorage) {
+	var groupCtx context.Context
+	groupCtx, g.cancel = context.WithCancel(ctx)
+	for _, c := range g.collectors {
+		g.wg.Add(1)
+		go func(c scheduledCollector) {
+			defer g.wg.Done()
+			c.run(groupCtx, func() {
+				g.evaluator.Evaluate()
+				generation, scrapedAt := externalMetricsProvider.LastScrape()
+				klog.V(4).Infof("scrape generation %d committed at %s", generation, scrapedAt)
+			})
+		}(c)
+	}
+}
+
+// stop cancels all collectors of g, waits for running scrapes to finish and
+// closes the collectors holding resources.
+func (g *collectorGroup) stop() {
+	g.cancel()
+	g.wg.Wait()
+	for _, c := range g.collectors {
+		if closer, ok := c.collector.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				klog.Errorf("cannot close collector %s: %s", c.name, err)
+			}
 		}
 	}
 }
 
-func GetBuildkiteTokenFromEnvOrDie() string {
-	token := os.Getenv("BUILDKITE_AGENT_TOKEN")
-	if token == "" {
-		klog.Fatal("cannot get Buildkite Agent Token from BUILDKITE_AGENT_TOKEN env var")
+// scheduledCollector scrapes a single CI platform on its own period, so
+// several platforms can feed the same storage. A failed scrape never stops
+// the process: it is retried with exponential backoff while the values of the
+// last successful scrape keep being served.
+type scheduledCollector struct {
+	name       string
+	period     time.Duration
+	maxBackoff time.Duration
+	collector  collector.CIMetricsCollector
+	store      storagemap.MetricsStore
+}
+
+func (sc scheduledCollector) run(ctx context.Context, onScrape func()) {
+	klog.V(2).Infof("scraping %s every %s", sc.name, sc.period)
+	consecutiveFailures := 0
+	for {
+		snapshot, err := sc.collector.Collect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			consecutiveFailures++
+		} else if consecutiveFailures > 0 {
+			klog.Infof("scraping %s metrics succeeded after %d consecutive failures", sc.name, consecutiveFailures)
+			consecutiveFailures = 0
+		}
+		delay := sc.nextDelay(snapshot, err, consecutiveFailures)
+		var partial *collector.PartialError
+		if err == nil || errors.As(err, &partial) {
+			batch := snapshot.Batch()
+			batch.Source = sc.name
+			sc.store.Commit(batch)
+			onScrape()
+		}
+		if err != nil {
+			klog.Errorf("error scraping %s metrics (%d consecutive failures), retrying in %s: %s", sc.name, consecutiveFailures, delay, err)
+		} else if delay != sc.period {
+			klog.V(4).Infof("%s asked to wait %s before the next scrape", sc.name, delay)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
 	}
-	return token
+}
+
+// nextDelay returns how long to wait after a scrape. It is never shorter than
+// the configured period, follows the poll duration advertised by the CI
+// platform after a successful scrape, and backs off after failures, waiting
+// at least as long as a Retry-After header asked for.
+func (sc scheduledCollector) nextDelay(snapshot collector.Snapshot, err error, consecutiveFailures int) time.Duration {
+	if err == nil {
+		if snapshot.PollAfter > sc.period {
+			return snapshot.PollAfter
+		}
+		return sc.period
+	}
+	delay := backoff(sc.period, sc.maxBackoff, consecutiveFailures)
+	var rateLimited *collector.RateLimitError
+	if errors.As(err, &rateLimited) && rateLimited.RetryAfter > delay {
+		delay = rateLimited.RetryAfter
+	}
+	return delay
+}
+
+// backoff returns how long to wait before retrying after the given number of
+// consecutive failures: period doubled for every failure after the first one,
+// capped at maxBackoff, plus up to 20% jitter so collectors failing together
+// do not retry together.
+func backoff(period, maxBackoff time.Duration, failures int) time.Duration {
+	if maxBackoff < period {
+		maxBackoff = period
+	}
+	delay := period
+	for i := 1; i < failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return wait.Jitter(delay, 0.2)
+}
+
+// configFromFlags builds the config from --ci-platform and the environment
+// variables of each platform, for deployments without a config file.
+func configFromFlags(ciPlatforms []string, scrapePeriod time.Duration, derivedMetrics []string) (*config.Config, error) {
+	cfg := &config.Config{
+		APIVersion:   config.APIVersion,
+		ScrapePeriod: metav1.Duration{Duration: scrapePeriod},
+	}
+	for _, p := range ciPlatforms {
+		platform, period, err := parseCIPlatform(p, scrapePeriod)
+		if err != nil {
+			return nil, err
+		}
+		c := config.Collector{
+			Platform:     platform,
+			ScrapePeriod: metav1.Duration{Duration: period},
+		}
+		switch platform {
+		case config.BuildkitePlatform:
+			c.Buildkite = &config.Buildkite{
+				Token:  config.Secret{Env: "BUILDKITE_AGENT_TOKEN"},
+				Queues: GetBuildkiteQueuesFromEnv(),
+			}
+			if os.Getenv("BUILDKITE_API_TOKEN") != "" {
+				c.Buildkite.API = &config.BuildkiteAPI{
+					Token:           config.Secret{Env: "BUILDKITE_API_TOKEN"},
+					WaitTimes:       os.Getenv("BUILDKITE_WAIT_TIMES") == "true",
+					Pipelines:       os.Getenv("BUILDKITE_PIPELINES") == "true",
+					AgentQueryRules: splitEnv("BUILDKITE_AGENT_QUERY_RULES"),
+					Agents:          os.Getenv("BUILDKITE_AGENTS") == "true",
+				}
+			}
+		case config.CircleCIPlatform:
+			c.CircleCI = &config.CircleCI{
+				Token:       config.Secret{Env: "CIRCLECI_TOKEN"},
+				ProjectSlug: os.Getenv("CIRCLECI_PROJECT_SLUG"),
+			}
+		case config.FlarebuildPlatform:
+			c.Flarebuild = &config.Flarebuild{
+				Endpoint: os.Getenv("FLAREBUILD_ENDPOINT"),
+				APIKey:   config.Secret{Env: "FLAREBUILD_API_KEY"},
+			}
+		case config.GitHubActionsPlatform:
+			c.GitHubActions = &config.GitHubActions{
+				Endpoint: os.Getenv("GITHUB_API_URL"),
+				Token:    config.Secret{Env: "GITHUB_TOKEN"},
+				Org:      os.Getenv("GITHUB_ORG"),
+				Repos:    splitEnv("GITHUB_REPOS"),
+			}
+		case config.GitLabPlatform:
+			c.GitLab = &config.GitLab{
+				Endpoint: os.Getenv("GITLAB_URL"),
+				Token:    config.Secret{Env: "GITLAB_TOKEN"},
+				Projects: splitEnv("GITLAB_PROJECTS"),
+				Groups:   splitEnv("GITLAB_GROUPS"),
+			}
+		case config.JenkinsPlatform:
+			c.Jenkins = &config.Jenkins{
+				Endpoint: os.Getenv("JENKINS_URL"),
+				User:     os.Getenv("JENKINS_USER"),
+				Token:    config.Secret{Env: "JENKINS_API_TOKEN"},
+			}
+		case config.AzureDevOpsPlatform:
+			c.AzureDevOps = &config.AzureDevOps{
+				Endpoint: os.Getenv("AZURE_DEVOPS_ORG_URL"),
+				Token:    config.Secret{Env: "AZURE_DEVOPS_PAT"},
+				Pools:    splitEnv("AZURE_DEVOPS_POOLS"),
+			}
+		case config.InClusterPlatform:
+			c.InCluster = &config.InCluster{
+				Namespace:     os.Getenv("IN_CLUSTER_NAMESPACE"),
+				Tekton:        os.Getenv("IN_CLUSTER_TEKTON") == "true",
+				Argo:          os.Getenv("IN_CLUSTER_ARGO") == "true",
+				GroupByLabels: splitEnv("IN_CLUSTER_GROUP_BY_LABELS"),
+			}
+		case config.PrometheusPlatform:
+			c.Prometheus = &config.Prometheus{
+				URL:        os.Getenv("PROMETHEUS_URL"),
+				Query:      os.Getenv("PROMETHEUS_QUERY"),
+				MetricName: os.Getenv("PROMETHEUS_METRIC_NAME"),
+				Match:      splitEnv("PROMETHEUS_MATCH"),
+			}
+		case config.REAPIPlatform:
+			c.REAPI = &config.REAPI{Endpoint: os.Getenv("REAPI_ENDPOINT")}
+			if os.Getenv("REAPI_TOKEN") != "" {
+				c.REAPI.Token = &config.Secret{Env: "REAPI_TOKEN"}
+			}
+		case config.DronePlatform:
+			c.Drone = &config.Drone{
+				Endpoint: os.Getenv("DRONE_SERVER"),
+				Token:    config.Secret{Env: "DRONE_TOKEN"},
+				Labels:   splitEnv("DRONE_LABELS"),
+			}
+		case config.WoodpeckerPlatform:
+			c.Woodpecker = &config.Drone{
+				Endpoint: os.Getenv("WOODPECKER_SERVER"),
+				Token:    config.Secret{Env: "WOODPECKER_TOKEN"},
+				Labels:   splitEnv("WOODPECKER_LABELS"),
+			}
+		case config.TeamCityPlatform:
+			c.TeamCity = &config.TeamCity{
+				Endpoint: os.Getenv("TEAMCITY_URL"),
+				Token:    config.Secret{Env: "TEAMCITY_TOKEN"},
+			}
+		}
+		cfg.Collectors = append(cfg.Collectors, c)
+	}
+	for _, d := range derivedMetrics {
+		m, err := derived.ParseMetric(d)
+		if err != nil {
+			return nil, err
+		}
+		cfg.DerivedMetrics = append(cfg.DerivedMetrics, config.DerivedMetric{Name: m.Name, Expression: m.Expression})
+	}
+	cfg.Default()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseCIPlatform parses a --ci-platform value of the form
+// <platform>[:<scrape period>].
+func parseCIPlatform(value string, defaultPeriod time.Duration) (string, time.Duration, error) {
+	parts := strings.SplitN(value, ":", 2)
+	platform, period := parts[0], defaultPeriod
+	if len(parts) == 2 {
+		var err error
+		period, err = time.ParseDuration(parts[1])
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid scrape period for ci platform %s: %w", platform, err)
+		}
+		if period <= 0 {
+			return "", 0, fmt.Errorf("invalid scrape period for ci platform %s: must be positive", platform)
+		}
+	}
+	return platform, period, nil
+}
+
+func parseStalePolicy(policy string) (ciprovider.StalePolicy, error) {
+	for _, p := range ciprovider.StalePolicies {
+		if string(p) == policy {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown stale policy: %s", policy)
 }
 
 func GetBuildkiteQueuesFromEnv() []string {
@@ -141,27 +691,12 @@ func GetBuildkiteQueuesFromEnv() []string {
 	return queues
 }
 
-func GetCircleCIConfigFromEnvOrDie() (string, string) {
-	token := os.Getenv("CIRCLECI_TOKEN")
-	if token == "" {
-		klog.Fatal("The environment variable CIRCLECI_TOKEN is required")
-	}
-	projectSlug := os.Getenv("CIRCLECI_PROJECT_SLUG")
-	if projectSlug == "" {
-		klog.Fatal("The environment variable CIRCLECI_PROJECT_SLUG is required")
-	}
-	return token, projectSlug
-}
-
-func GetFlarebuildConfigFromEnvOrDie() (string, string) {
-	var apiKey = os.Getenv("FLAREBUILD_API_KEY")
-	if apiKey == "" {
-		klog.Fatal("environment variable FLAREBUILD_API_KEY not set")
-	}
-	var endpoint = os.Getenv("FLAREBUILD_ENDPOINT")
-	if endpoint == "" {
-		endpoint = "https://api.stg.flare.build/api/v1"
+// splitEnv returns the comma separated values of the environment variable
+// key, or nil if it is not set.
+func splitEnv(key string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
 	}
-	klog.V(2).Infof("using %s as endpoint", endpoint)
-	return apiKey, endpoint
+	return strings.Split(value, ",")
 }
@@ -0,0 +1,193 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	"github.com/elotl/buildscaler/pkg/collector"
+	storagemap "github.com/elotl/buildscaler/pkg/storage"
+)
+
+// fakeCollector returns the results in order, then cancels the context. A
+// snapshot is returned unless the result is an error other than a
+// *collector.PartialError.
+type fakeCollector struct {
+	results []error
+	calls   int
+	cancel  context.CancelFunc
+}
+
+func (f *fakeCollector) Collect(ctx context.Context) (collector.Snapshot, error) {
+	var snapshot collector.Snapshot
+	if f.calls >= len(f.results) {
+		f.cancel()
+		return snapshot, ctx.Err()
+	}
+	err := f.results[f.calls]
+	f.calls++
+	var partial *collector.PartialError
+	if err != nil && !errors.As(err, &partial) {
+		return snapshot, err
+	}
+	snapshot.Add(external_metrics.ExternalMetricValue{
+		MetricName: "fake_jobs",
+		Value:      *resource.NewQuantity(int64(f.calls), resource.DecimalSI),
+	})
+	return snapshot, err
+}
+
+func TestScheduledCollectorKeepsLastGoodValueOnFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := storagemap.NewExternalMetricsMap()
+	fake := &fakeCollector{
+		results: []error{nil, errors.New("boom"), errors.New("boom")},
+		cancel:  cancel,
+	}
+	sc := scheduledCollector{
+		name:       "fake",
+		period:     time.Millisecond,
+		maxBackoff: time.Millisecond * 4,
+		collector:  fake,
+		store:      store,
+	}
+	scrapes := 0
+	sc.run(ctx, func() { scrapes++ })
+
+	assert.Equal(t, 3, fake.calls)
+	assert.Equal(t, 1, scrapes)
+	series, ok := store.Get("fake_jobs", labels.Everything())
+	assert.True(t, ok)
+	assert.Len(t, series, 1)
+	assert.Equal(t, int64(1), series[0].Value.Value.Value())
+}
+
+func TestScheduledCollectorCommitsPartialSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := storagemap.NewExternalMetricsMap()
+	fake := &fakeCollector{
+		results: []error{nil, &collector.PartialError{Err: errors.New("boom")}},
+		cancel:  cancel,
+	}
+	sc := scheduledCollector{
+		name:       "fake",
+		period:     time.Millisecond,
+		maxBackoff: time.Millisecond * 4,
+		collector:  fake,
+		store:      store,
+	}
+	scrapes := 0
+	sc.run(ctx, func() { scrapes++ })
+
+	assert.Equal(t, 2, scrapes)
+	series, ok := store.Get("fake_jobs", labels.Everything())
+	assert.True(t, ok)
+	if assert.Len(t, series, 1) {
+		assert.Equal(t, int64(2), series[0].Value.Value.Value())
+	}
+}
+
+func TestDeleteRemovedCollectors(t *testing.T) {
+	os.Setenv("TEST_BUILDKITE_TOKEN", "abc123")
+	defer os.Unsetenv("TEST_BUILDKITE_TOKEN")
+	store := storagemap.NewExternalMetricsMap()
+	group, err := reloadCollectorGroup([]byte(`
+apiVersion: buildscaler/v1
+collectors:
+  - name: linux
+    platform: buildkite
+    buildkite: {token: {env: TEST_BUILDKITE_TOKEN}}
+  - name: macos
+    platform: buildkite
+    buildkite: {token: {env: TEST_BUILDKITE_TOKEN}}
+`), store, time.Minute)
+	assert.NoError(t, err)
+	for _, name := range []string{"linux", "macos"} {
+		batch := storagemap.NewBatch()
+		batch.Source = name
+		batch.Add("buildkite_waiting_jobs_count", external_metrics.ExternalMetricValue{
+			MetricName:   "buildkite_waiting_jobs_count",
+			MetricLabels: map[string]string{"collector": name},
+			Value:        resource.MustParse("3"),
+		})
+		store.Commit(batch)
+	}
+
+	newGroup, err := reloadCollectorGroup([]byte(`
+apiVersion: buildscaler/v1
+collectors:
+  - name: linux
+    platform: buildkite
+    buildkite: {token: {env: TEST_BUILDKITE_TOKEN}}
+`), store, time.Minute)
+	assert.NoError(t, err)
+	deleteRemovedCollectors(group, newGroup, store)
+
+	series, ok := store.Get("buildkite_waiting_jobs_count", labels.Everything())
+	assert.True(t, ok)
+	if assert.Len(t, series, 1) {
+		assert.Equal(t, "linux", series[0].Value.MetricLabels["collector"])
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		failures int
+		min, max time.Duration
+	}{
+		{1, time.Second, time.Second * 6 / 5},
+		{2, time.Second * 2, time.Second * 12 / 5},
+		{4, time.Second * 8, time.Second * 48 / 5},
+		{10, time.Second * 30, time.Second * 36},
+	} {
+		delay := backoff(time.Second, time.Second*30, tc.failures)
+		assert.GreaterOrEqual(t, delay, tc.min, "failures: %d", tc.failures)
+		assert.LessOrEqual(t, delay, tc.max, "failures: %d", tc.failures)
+	}
+	// The period is never shortened by a smaller maximum backoff.
+	assert.GreaterOrEqual(t, backoff(time.Minute, time.Second, 3), time.Minute)
+}
+
+func TestScheduledCollectorNextDelay(t *testing.T) {
+	sc := scheduledCollector{period: time.Second * 10, maxBackoff: time.Minute}
+	for _, tc := range []struct {
+		name     string
+		snapshot collector.Snapshot
+		err      error
+		failures int
+		min, max time.Duration
+	}{
+		{"configured period", collector.Snapshot{}, nil, 0, time.Second * 10, time.Second * 10},
+		{"shorter poll duration", collector.Snapshot{PollAfter: time.Second}, nil, 0, time.Second * 10, time.Second * 10},
+		{"longer poll duration", collector.Snapshot{PollAfter: time.Second * 30}, nil, 0, time.Second * 30, time.Second * 30},
+		{"backoff", collector.Snapshot{}, errors.New("boom"), 2, time.Second * 20, time.Second * 24},
+		{"retry after", collector.Snapshot{}, &collector.RateLimitError{StatusCode: 429, RetryAfter: time.Minute * 2}, 1, time.Minute * 2, time.Minute * 2},
+		{"short retry after", collector.Snapshot{}, &collector.RateLimitError{StatusCode: 429, RetryAfter: time.Second}, 1, time.Second * 10, time.Second * 12},
+	} {
+		delay := sc.nextDelay(tc.snapshot, tc.err, tc.failures)
+		assert.GreaterOrEqual(t, delay, tc.min, tc.name)
+		assert.LessOrEqual(t, delay, tc.max, tc.name)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ciprovider
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var (
+	aggregationRegexp     = regexp.MustCompile(`^(avg|min|max|p[1-9][0-9]?)_([0-9]+[smh])$`)
+	aggregatedMetricRegex = regexp.MustCompile(`^(.+)_((?:avg|min|max|p[1-9][0-9]?)_[0-9]+[smh])$`)
+)
+
+// Aggregation is a function applied to the samples of a series over a time
+// window, e.g. avg_5m or p95_15m. It is served as <metric name>_<aggregation>.
+type Aggregation struct {
+	Function string
+	Window   time.Duration
+	suffix   string
+}
+
+func ParseAggregation(s string) (Aggregation, error) {
+	match := aggregationRegexp.FindStringSubmatch(s)
+	if match == nil {
+		return Aggregation{}, fmt.Errorf("invalid aggregation %q, expected <avg|min|max|pNN>_<window> e.g. avg_5m", s)
+	}
+	window, err := time.ParseDuration(match[2])
+	if err != nil {
+		return Aggregation{}, err
+	}
+	if window <= 0 {
+		return Aggregation{}, fmt.Errorf("invalid aggregation %q: window must be positive", s)
+	}
+	return Aggregation{Function: match[1], Window: window, suffix: s}, nil
+}
+
+func (a Aggregation) String() string {
+	return a.suffix
+}
+
+// MetricName returns the name the aggregation of metric is served under.
+func (a Aggregation) MetricName(metric string) string {
+	return metric + "_" + a.suffix
+}
+
+// Apply aggregates samples, which must not be empty.
+func (a Aggregation) Apply(samples []storage.Sample) float64 {
+	values := make([]float64, 0, len(samples))
+	for _, sample := range samples {
+		values = append(values, sample.Value)
+	}
+	switch a.Function {
+	case "avg":
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	case "min":
+		sort.Float64s(values)
+		return values[0]
+	case "max":
+		sort.Float64s(values)
+		return values[len(values)-1]
+	default:
+		// pNN, nearest-rank percentile
+		p, _ := strconv.Atoi(a.Function[1:])
+		sort.Float64s(values)
+		rank := int(math.Ceil(float64(p) / 100 * float64(len(values))))
+		if rank < 1 {
+			rank = 1
+		}
+		return values[rank-1]
+	}
+}
+
+// parseAggregatedMetricName splits e.g. buildkite_waiting_jobs_count_avg_5m
+// into buildkite_waiting_jobs_count and the avg_5m aggregation.
+func parseAggregatedMetricName(name string) (string, Aggregation, bool) {
+	match := aggregatedMetricRegex.FindStringSubmatch(name)
+	if match == nil {
+		return "", Aggregation{}, false
+	}
+	aggregation, err := ParseAggregation(match[2])
+	if err != nil {
+		return "", Aggregation{}, false
+	}
+	return match[1], aggregation, true
+}
+
+func aggregatedQuantity(v float64) resource.Quantity {
+	return *resource.NewMilliQuantity(int64(math.Round(v*1000)), resource.DecimalSI)
+}
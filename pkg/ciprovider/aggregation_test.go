@@ -0,0 +1,65 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ciprovider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAggregation(t *testing.T) {
+	aggregation, err := ParseAggregation("p95_15m")
+	assert.NoError(t, err)
+	assert.Equal(t, "p95", aggregation.Function)
+	assert.Equal(t, 15*time.Minute, aggregation.Window)
+	assert.Equal(t, "metric_p95_15m", aggregation.MetricName("metric"))
+
+	for _, invalid := range []string{"", "avg", "sum_5m", "p100_5m", "avg_0m", "avg_5d"} {
+		_, err := ParseAggregation(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestAggregation_Apply(t *testing.T) {
+	var samples []storage.Sample
+	for _, v := range []float64{4, 1, 10, 3, 2, 6, 5, 9, 7, 8} {
+		samples = append(samples, storage.Sample{Value: v})
+	}
+	cases := map[string]float64{
+		"avg_5m": 5.5,
+		"min_5m": 1,
+		"max_5m": 10,
+		"p50_5m": 5,
+		"p95_5m": 10,
+		"p90_5m": 9,
+	}
+	for a, expected := range cases {
+		aggregation, err := ParseAggregation(a)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, aggregation.Apply(samples), a)
+	}
+}
+
+func TestParseAggregatedMetricName(t *testing.T) {
+	metric, aggregation, ok := parseAggregatedMetricName("buildkite_waiting_jobs_count_avg_5m")
+	assert.True(t, ok)
+	assert.Equal(t, "buildkite_waiting_jobs_count", metric)
+	assert.Equal(t, "avg_5m", aggregation.String())
+
+	_, _, ok = parseAggregatedMetricName("buildkite_waiting_jobs_count")
+	assert.False(t, ok)
+}
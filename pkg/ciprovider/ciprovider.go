@@ -16,71 +16,157 @@ package ciprovider
 import (
 	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/elotl/buildscaler/pkg/storage"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/klog/v2"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 )
 
-type ExternalMetricsProviderFromStorage struct {
-	storage *storage.ExternalMetricsMap
-}
+// StalePolicy decides what GetExternalMetric returns for a series that the
+// storage considers stale.
+type StalePolicy string
 
-func NewExternalMetricsProviderFromStorage(storage *storage.ExternalMetricsMap) *ExternalMetricsProviderFromStorage {
-	return &ExternalMetricsProviderFromStorage{storage: storage}
-}
+const (
+	// StalePolicyServe returns the last stored value as if it was fresh.
+	StalePolicyServe StalePolicy = "serve"
+	// StalePolicyError fails the whole request.
+	StalePolicyError StalePolicy = "error"
+	// StalePolicyFallback replaces the stored value with FallbackValue.
+	StalePolicyFallback StalePolicy = "fallback"
+)
 
-type ExternalMetricsLabelsMatcher struct {
-	metric external_metrics.ExternalMetricValue
+var StalePolicies = []StalePolicy{
+	StalePolicyServe,
+	StalePolicyError,
+	StalePolicyFallback,
 }
 
-func (em *ExternalMetricsLabelsMatcher) Has(label string) (exists bool) {
-	for k := range em.metric.MetricLabels {
-		if k == label {
-			return true
-		}
-	}
-	return false
+type ExternalMetricsProviderFromStorage struct {
+	storage storage.MetricsStore
+	// StalePolicy is applied to series that were not updated for longer than
+	// the storage's StaleAfter. Defaults to StalePolicyServe.
+	StalePolicy StalePolicy
+	// FallbackValue is served instead of stale series with
+	// StalePolicyFallback.
+	FallbackValue resource.Quantity
+	// Aggregations are listed for every stored metric. Any well-formed
+	// aggregated metric name is served, whether it is listed or not.
+	Aggregations []Aggregation
 }
 
-func (em *ExternalMetricsLabelsMatcher) Get(label string) (value string) {
-	for k, v := range em.metric.MetricLabels {
-		if k == label {
-			return v
-		}
-	}
-	return ""
+func NewExternalMetricsProviderFromStorage(storage storage.MetricsStore) *ExternalMetricsProviderFromStorage {
+	return &ExternalMetricsProviderFromStorage{storage: storage, StalePolicy: StalePolicyServe}
 }
 
 func (ep *ExternalMetricsProviderFromStorage) GetExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
 	klog.V(6).Info("GetExternalMetric called with:")
 	klog.V(6).Infof("ctx: %v namespace: %s metricSelector: %s info: %v", ctx, namespace, metricSelector, info.Metric)
-	ep.storage.RWMutex.RLock()
-	val, ok := ep.storage.Data[info.Metric]
-	ep.storage.RWMutex.RUnlock()
+	series, ok := ep.storage.Get(info.Metric, metricSelector)
+	if generation, scrapedAt := ep.LastScrape(); generation > 0 {
+		klog.V(6).Infof("serving %s from scrape generation %d taken at %s", info.Metric, generation, scrapedAt)
+	}
 	if !ok {
+		if metric, aggregation, isAggregated := parseAggregatedMetricName(info.Metric); isAggregated {
+			return ep.getAggregatedMetric(info.Metric, metric, aggregation, metricSelector)
+		}
 		return nil, errors.New("metric " + info.Metric + " not found")
 	}
-	externalMetric := val
-	if metricSelector.Empty() {
-		return &external_metrics.ExternalMetricValueList{
-			Items: []external_metrics.ExternalMetricValue{externalMetric},
-		}, nil
+	now := time.Now()
+	values := make([]external_metrics.ExternalMetricValue, 0, len(series))
+	for _, s := range series {
+		value, _, err := ep.applyStalePolicy(info.Metric, s.Value, s.LastUpdated, now)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
 	}
-	matcher := &ExternalMetricsLabelsMatcher{metric: externalMetric}
-	if !metricSelector.Matches(matcher) {
+	if len(values) == 0 {
 		return &external_metrics.ExternalMetricValueList{
 			Items: []external_metrics.ExternalMetricValue{},
 		}, errors.New("metric " + info.Metric + " with labels " + metricSelector.String() + " not found")
 	}
 	return &external_metrics.ExternalMetricValueList{
-		Items: []external_metrics.ExternalMetricValue{externalMetric},
+		Items: values,
 	}, nil
+}
 
+func (ep *ExternalMetricsProviderFromStorage) getAggregatedMetric(name, metric string, aggregation Aggregation, metricSelector labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	now := time.Now()
+	histories, ok := ep.storage.History(metric, metricSelector, now.Add(-aggregation.Window))
+	if !ok {
+		return nil, errors.New("metric " + name + " not found")
+	}
+	values := make([]external_metrics.ExternalMetricValue, 0, len(histories))
+	for _, h := range histories {
+		value, replaced, err := ep.applyStalePolicy(metric, h.Value, h.LastUpdated, now)
+		if err != nil {
+			return nil, err
+		}
+		value.MetricName = name
+		if !replaced {
+			// A series without samples in the window has no recent data
+			// to aggregate, e.g. because history is disabled.
+			if len(h.Samples) == 0 {
+				continue
+			}
+			value.Value = aggregatedQuantity(aggregation.Apply(h.Samples))
+		}
+		values = append(values, value)
+	}
+	if len(values) == 0 {
+		return &external_metrics.ExternalMetricValueList{
+			Items: []external_metrics.ExternalMetricValue{},
+		}, errors.New("metric " + name + " with labels " + metricSelector.String() + " not found")
+	}
+	return &external_metrics.ExternalMetricValueList{
+		Items: values,
+	}, nil
+}
+
+// applyStalePolicy returns value as served under StalePolicy for a series of
+// metric last updated at lastUpdated, and whether it was replaced by the
+// FallbackValue. It fails with StalePolicyError if the series is stale.
+func (ep *ExternalMetricsProviderFromStorage) applyStalePolicy(metric string, value external_metrics.ExternalMetricValue, lastUpdated, now time.Time) (external_metrics.ExternalMetricValue, bool, error) {
+	if !ep.storage.IsStale(storage.Series{LastUpdated: lastUpdated}, now) {
+		return value, false, nil
+	}
+	switch ep.StalePolicy {
+	case StalePolicyError:
+		return value, false, fmt.Errorf("metric %s{%s} is stale, last updated at %s",
+			metric, storage.SeriesKey(value.MetricLabels), lastUpdated.Format(time.RFC3339))
+	case StalePolicyFallback:
+		klog.V(5).Infof("metric %s{%s} is stale, serving fallback value %s",
+			metric, storage.SeriesKey(value.MetricLabels), ep.FallbackValue.String())
+		value.Value = ep.FallbackValue.DeepCopy()
+		value.Timestamp = metav1.NewTime(now)
+		return value, true, nil
+	}
+	return value, false, nil
+}
+
+// LastScrape returns the generation and time of the most recent scrape
+// committed to the storage.
+func (ep *ExternalMetricsProviderFromStorage) LastScrape() (uint64, time.Time) {
+	return ep.storage.LastCommit()
 }
 
 func (ep *ExternalMetricsProviderFromStorage) ListAllExternalMetrics() []provider.ExternalMetricInfo {
-	return ep.storage.ListExternalMetricInfo()
+	metrics := ep.storage.ListExternalMetricInfo()
+	if len(ep.Aggregations) == 0 {
+		return metrics
+	}
+	all := make([]provider.ExternalMetricInfo, 0, len(metrics)*(len(ep.Aggregations)+1))
+	for _, info := range metrics {
+		all = append(all, info)
+		for _, aggregation := range ep.Aggregations {
+			all = append(all, provider.ExternalMetricInfo{Metric: aggregation.MetricName(info.Metric)})
+		}
+	}
+	return all
 }
@@ -16,8 +16,8 @@ package ciprovider
 import (
 	"context"
 	"errors"
-	"sync"
 	"testing"
+	"time"
 
 	"github.com/elotl/buildscaler/pkg/storage"
 	"github.com/stretchr/testify/assert"
@@ -30,7 +30,7 @@ import (
 func TestExternalMetricsProviderFromStorage_GetExternalMetric(t *testing.T) {
 	cases := []struct {
 		name           string
-		data           map[string]external_metrics.ExternalMetricValue
+		data           []external_metrics.ExternalMetricValue
 		metricSelector labels.Selector
 		info           provider.ExternalMetricInfo
 		expectedList   *external_metrics.ExternalMetricValueList
@@ -38,12 +38,12 @@ func TestExternalMetricsProviderFromStorage_GetExternalMetric(t *testing.T) {
 	}{
 		{
 			name: "by_name",
-			data: map[string]external_metrics.ExternalMetricValue{
-				"metric1": {
+			data: []external_metrics.ExternalMetricValue{
+				{
 					MetricName: "metric1",
 					Value:      resource.MustParse("42"),
 				},
-				"not-my-metric": {
+				{
 					MetricName: "not-my-metric",
 					Value:      resource.MustParse("1"),
 				},
@@ -62,15 +62,15 @@ func TestExternalMetricsProviderFromStorage_GetExternalMetric(t *testing.T) {
 		},
 		{
 			name: "by_name_and_label",
-			data: map[string]external_metrics.ExternalMetricValue{
-				"metric1": {
+			data: []external_metrics.ExternalMetricValue{
+				{
 					MetricName: "metric1",
 					Value:      resource.MustParse("42"),
 					MetricLabels: map[string]string{
 						"label-key": "label-val",
 					},
 				},
-				"not-my-metric": {
+				{
 					MetricName: "not-my-metric",
 					Value:      resource.MustParse("1"),
 				},
@@ -90,15 +90,15 @@ func TestExternalMetricsProviderFromStorage_GetExternalMetric(t *testing.T) {
 		},
 		{
 			name: "by_name_and_label_does_not_match",
-			data: map[string]external_metrics.ExternalMetricValue{
-				"metric1": {
+			data: []external_metrics.ExternalMetricValue{
+				{
 					MetricName: "metric1",
 					Value:      resource.MustParse("42"),
 					MetricLabels: map[string]string{
 						"label-key": "label-val",
 					},
 				},
-				"not-my-metric": {
+				{
 					MetricName: "not-my-metric",
 					Value:      resource.MustParse("1"),
 				},
@@ -110,10 +110,47 @@ func TestExternalMetricsProviderFromStorage_GetExternalMetric(t *testing.T) {
 			},
 			expectedErr: errors.New("metric metric1 with labels label-key=NOT-label-val not found"),
 		},
+		{
+			name: "by_label_multiple_series",
+			data: []external_metrics.ExternalMetricValue{
+				{
+					MetricName:   "metric1",
+					Value:        resource.MustParse("1"),
+					MetricLabels: map[string]string{"queue": "default"},
+				},
+				{
+					MetricName:   "metric1",
+					Value:        resource.MustParse("2"),
+					MetricLabels: map[string]string{"queue": "deploy"},
+				},
+				{
+					MetricName:   "metric1",
+					Value:        resource.MustParse("3"),
+					MetricLabels: map[string]string{"queue": "deploy", "os": "linux"},
+				},
+			},
+			metricSelector: labels.SelectorFromValidatedSet(map[string]string{"queue": "deploy"}),
+			info:           provider.ExternalMetricInfo{Metric: "metric1"},
+			expectedList: &external_metrics.ExternalMetricValueList{
+				Items: []external_metrics.ExternalMetricValue{
+					{
+						MetricName:   "metric1",
+						Value:        resource.MustParse("3"),
+						MetricLabels: map[string]string{"queue": "deploy", "os": "linux"},
+					},
+					{
+						MetricName:   "metric1",
+						Value:        resource.MustParse("2"),
+						MetricLabels: map[string]string{"queue": "deploy"},
+					},
+				},
+			},
+			expectedErr: nil,
+		},
 		{
 			name: "not_found",
-			data: map[string]external_metrics.ExternalMetricValue{
-				"not-my-metric": {
+			data: []external_metrics.ExternalMetricValue{
+				{
 					MetricName: "not-my-metric",
 					Value:      resource.MustParse("1"),
 				},
@@ -126,9 +163,9 @@ func TestExternalMetricsProviderFromStorage_GetExternalMetric(t *testing.T) {
 	}
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			st := &storage.ExternalMetricsMap{
-				RWMutex: &sync.RWMutex{},
-				Data:    tc.data,
+			st := storage.NewExternalMetricsMap()
+			for _, value := range tc.data {
+				st.OverrideOrStore(value.MetricName, value)
 			}
 			metricProvider := NewExternalMetricsProviderFromStorage(st)
 			got, err := metricProvider.GetExternalMetric(context.TODO(), "", tc.metricSelector, tc.info)
@@ -137,3 +174,136 @@ func TestExternalMetricsProviderFromStorage_GetExternalMetric(t *testing.T) {
 		})
 	}
 }
+
+func TestExternalMetricsProviderFromStorage_GetExternalMetric_Stale(t *testing.T) {
+	fresh := external_metrics.ExternalMetricValue{
+		MetricName:   "metric1",
+		Value:        resource.MustParse("42"),
+		MetricLabels: map[string]string{"queue": "default"},
+	}
+	stale := external_metrics.ExternalMetricValue{
+		MetricName:   "metric1",
+		Value:        resource.MustParse("7"),
+		MetricLabels: map[string]string{"queue": "removed"},
+	}
+	lastUpdated := time.Now().Add(-time.Hour)
+	newStorage := func() *storage.ExternalMetricsMap {
+		st := storage.NewExternalMetricsMap()
+		st.StaleAfter = time.Minute
+		st.Data["metric1"] = map[string]storage.Series{
+			"queue=default": {Value: fresh, LastUpdated: time.Now()},
+			"queue=removed": {Value: stale, LastUpdated: lastUpdated},
+		}
+		return st
+	}
+	info := provider.ExternalMetricInfo{Metric: "metric1"}
+
+	t.Run("serve", func(t *testing.T) {
+		metricProvider := NewExternalMetricsProviderFromStorage(newStorage())
+		got, err := metricProvider.GetExternalMetric(context.TODO(), "", labels.NewSelector(), info)
+		assert.NoError(t, err)
+		assert.Equal(t, []external_metrics.ExternalMetricValue{fresh, stale}, got.Items)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		metricProvider := NewExternalMetricsProviderFromStorage(newStorage())
+		metricProvider.StalePolicy = StalePolicyError
+		got, err := metricProvider.GetExternalMetric(context.TODO(), "", labels.NewSelector(), info)
+		assert.Nil(t, got)
+		assert.EqualError(t, err, "metric metric1{queue=removed} is stale, last updated at "+lastUpdated.Format(time.RFC3339))
+
+		got, err = metricProvider.GetExternalMetric(context.TODO(), "", labels.SelectorFromSet(map[string]string{"queue": "default"}), info)
+		assert.NoError(t, err)
+		assert.Equal(t, []external_metrics.ExternalMetricValue{fresh}, got.Items)
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		metricProvider := NewExternalMetricsProviderFromStorage(newStorage())
+		metricProvider.StalePolicy = StalePolicyFallback
+		metricProvider.FallbackValue = resource.MustParse("0")
+		got, err := metricProvider.GetExternalMetric(context.TODO(), "", labels.NewSelector(), info)
+		assert.NoError(t, err)
+		assert.Len(t, got.Items, 2)
+		assert.Equal(t, fresh, got.Items[0])
+		assert.Equal(t, stale.MetricLabels, got.Items[1].MetricLabels)
+		assert.Equal(t, resource.MustParse("0"), got.Items[1].Value)
+	})
+}
+
+func TestExternalMetricsProviderFromStorage_GetExternalMetric_Aggregated(t *testing.T) {
+	st := storage.NewExternalMetricsMap()
+	st.HistorySize = 10
+	for _, v := range []string{"2", "10", "3"} {
+		batch := storage.NewBatch()
+		batch.Add("metric1", external_metrics.ExternalMetricValue{
+			MetricName:   "metric1",
+			Value:        resource.MustParse(v),
+			MetricLabels: map[string]string{"queue": "default"},
+		})
+		st.Commit(batch)
+	}
+	metricProvider := NewExternalMetricsProviderFromStorage(st)
+
+	got, err := metricProvider.GetExternalMetric(context.TODO(), "", labels.NewSelector(), provider.ExternalMetricInfo{Metric: "metric1_max_5m"})
+	assert.NoError(t, err)
+	assert.Len(t, got.Items, 1)
+	assert.Equal(t, "metric1_max_5m", got.Items[0].MetricName)
+	assert.Equal(t, map[string]string{"queue": "default"}, got.Items[0].MetricLabels)
+	assert.Equal(t, int64(10), got.Items[0].Value.Value())
+
+	got, err = metricProvider.GetExternalMetric(context.TODO(), "", labels.NewSelector(), provider.ExternalMetricInfo{Metric: "metric1_avg_5m"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5000), got.Items[0].Value.MilliValue())
+
+	_, err = metricProvider.GetExternalMetric(context.TODO(), "", labels.NewSelector(), provider.ExternalMetricInfo{Metric: "metric2_avg_5m"})
+	assert.EqualError(t, err, "metric metric2_avg_5m not found")
+}
+
+func TestExternalMetricsProviderFromStorage_GetExternalMetric_AggregatedStale(t *testing.T) {
+	st := storage.NewExternalMetricsMap()
+	st.HistorySize = 10
+	batch := storage.NewBatch()
+	batch.Add("metric1", external_metrics.ExternalMetricValue{
+		MetricName:   "metric1",
+		Value:        resource.MustParse("4"),
+		MetricLabels: map[string]string{"queue": "default"},
+	})
+	st.Commit(batch)
+	// The sample is still within the window, but the series is stale.
+	st.StaleAfter = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	info := provider.ExternalMetricInfo{Metric: "metric1_max_5m"}
+
+	metricProvider := NewExternalMetricsProviderFromStorage(st)
+	got, err := metricProvider.GetExternalMetric(context.TODO(), "", labels.NewSelector(), info)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), got.Items[0].Value.Value())
+
+	metricProvider.StalePolicy = StalePolicyError
+	_, err = metricProvider.GetExternalMetric(context.TODO(), "", labels.NewSelector(), info)
+	assert.Error(t, err)
+
+	metricProvider.StalePolicy = StalePolicyFallback
+	metricProvider.FallbackValue = resource.MustParse("0")
+	got, err = metricProvider.GetExternalMetric(context.TODO(), "", labels.NewSelector(), info)
+	assert.NoError(t, err)
+	if assert.Len(t, got.Items, 1) {
+		assert.Equal(t, "metric1_max_5m", got.Items[0].MetricName)
+		assert.Equal(t, int64(0), got.Items[0].Value.Value())
+	}
+}
+
+func TestExternalMetricsProviderFromStorage_ListAllExternalMetrics(t *testing.T) {
+	st := storage.NewExternalMetricsMap()
+	st.OverrideOrStore("metric1", external_metrics.ExternalMetricValue{MetricName: "metric1"})
+	metricProvider := NewExternalMetricsProviderFromStorage(st)
+	assert.Equal(t, []provider.ExternalMetricInfo{{Metric: "metric1"}}, metricProvider.ListAllExternalMetrics())
+
+	aggregation, err := ParseAggregation("avg_5m")
+	assert.NoError(t, err)
+	metricProvider.Aggregations = []Aggregation{aggregation}
+	assert.Equal(t, []provider.ExternalMetricInfo{
+		{Metric: "metric1"},
+		{Metric: "metric1_avg_5m"},
+	}, metricProvider.ListAllExternalMetrics())
+}
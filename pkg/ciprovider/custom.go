@@ -0,0 +1,136 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ciprovider
+
+import (
+	"context"
+	"time"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider/helpers"
+)
+
+// PodLabel is the label holding the pod name of series that describe a pod,
+// e.g. the busy state of the CI agent running in it.
+const PodLabel = "pod"
+
+var podsResource = schema.GroupResource{Resource: "pods"}
+
+// CustomMetricsProviderFromStorage serves the stored series having a PodLabel
+// as custom metrics of their pod. The series are not namespaced: a pod of any
+// namespace gets the value of the series labeled with its name.
+type CustomMetricsProviderFromStorage struct {
+	storage storage.MetricsStore
+	mapper  apimeta.RESTMapper
+	client  dynamic.Interface
+}
+
+func NewCustomMetricsProviderFromStorage(storage storage.MetricsStore, mapper apimeta.RESTMapper, client dynamic.Interface) *CustomMetricsProviderFromStorage {
+	return &CustomMetricsProviderFromStorage{storage: storage, mapper: mapper, client: client}
+}
+
+func (cp *CustomMetricsProviderFromStorage) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	klog.V(6).Infof("GetMetricByName called with name: %s info: %s metricSelector: %s", name, info, metricSelector)
+	if info.GroupResource != podsResource {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	values, err := cp.values(name.Namespace, []string{name.Name}, info, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+	}
+	return &values[0], nil
+}
+
+func (cp *CustomMetricsProviderFromStorage) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	klog.V(6).Infof("GetMetricBySelector called with namespace: %s selector: %s info: %s metricSelector: %s", namespace, selector, info, metricSelector)
+	if info.GroupResource != podsResource {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	names, err := helpers.ListObjectNames(cp.mapper, cp.client, namespace, selector, info)
+	if err != nil {
+		return nil, err
+	}
+	values, err := cp.values(namespace, names, info, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	return &custom_metrics.MetricValueList{Items: values}, nil
+}
+
+// values returns the fresh values of the pods in names, if any. A pod matching
+// several series gets the first one. Pods are matched in Go rather than with a
+// selector, since pod names may be longer than label values are allowed to be.
+func (cp *CustomMetricsProviderFromStorage) values(namespace string, names []string, info provider.CustomMetricInfo, metricSelector labels.Selector) ([]custom_metrics.MetricValue, error) {
+	if len(names) == 0 {
+		return []custom_metrics.MetricValue{}, nil
+	}
+	series, ok := cp.storage.Get(info.Metric, metricSelector)
+	if !ok {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	now := time.Now()
+	values := make([]custom_metrics.MetricValue, 0, len(names))
+	seen := map[string]bool{}
+	for _, s := range series {
+		pod, ok := s.Value.MetricLabels[PodLabel]
+		if !ok || !wanted[pod] || seen[pod] || cp.storage.IsStale(s, now) {
+			continue
+		}
+		seen[pod] = true
+		ref, err := helpers.ReferenceFor(cp.mapper, types.NamespacedName{Namespace: namespace, Name: pod}, info)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, custom_metrics.MetricValue{
+			DescribedObject: ref,
+			Metric:          custom_metrics.MetricIdentifier{Name: info.Metric},
+			Timestamp:       s.Value.Timestamp,
+			Value:           s.Value.Value,
+		})
+	}
+	return values, nil
+}
+
+// ListAllMetrics lists the stored metrics having series with a PodLabel.
+func (cp *CustomMetricsProviderFromStorage) ListAllMetrics() []provider.CustomMetricInfo {
+	hasPod, _ := labels.NewRequirement(PodLabel, selection.Exists, nil)
+	selector := labels.NewSelector().Add(*hasPod)
+	var metrics []provider.CustomMetricInfo
+	for _, info := range cp.storage.ListExternalMetricInfo() {
+		if series, _ := cp.storage.Get(info.Metric, selector); len(series) > 0 {
+			metrics = append(metrics, provider.CustomMetricInfo{
+				GroupResource: podsResource,
+				Namespaced:    true,
+				Metric:        info.Metric,
+			})
+		}
+	}
+	return metrics
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ciprovider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func newTestCustomMetricsProvider() *CustomMetricsProviderFromStorage {
+	st := storage.NewExternalMetricsMap()
+	batch := storage.NewBatch()
+	for pod, busy := range map[string]string{"agent-a": "1", "agent-b": "0", "agent-gone": "1", longPodName: "1"} {
+		batch.Add("buildkite_agent_busy", external_metrics.ExternalMetricValue{
+			MetricName:   "buildkite_agent_busy",
+			MetricLabels: map[string]string{"org": "acme", PodLabel: pod},
+			Value:        resource.MustParse(busy),
+		})
+	}
+	batch.Add("buildkite_total_busy_agent_count", external_metrics.ExternalMetricValue{
+		MetricName: "buildkite_total_busy_agent_count",
+		Value:      resource.MustParse("2"),
+	})
+	st.Commit(batch)
+
+	mapper := apimeta.NewDefaultRESTMapper([]schema.GroupVersion{corev1.SchemeGroupVersion})
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("Pod"), apimeta.RESTScopeNamespace)
+	pod := func(namespace, name string, podLabels map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: podLabels}}
+	}
+	client := dynamicfake.NewSimpleDynamicClient(scheme.Scheme,
+		pod("ci", "agent-a", map[string]string{"app": "agent"}),
+		pod("ci", "agent-b", map[string]string{"app": "agent"}),
+		pod("ci", "agent-new", map[string]string{"app": "agent"}),
+		pod("ci", longPodName, map[string]string{"app": "agent"}),
+		pod("ci", "web", map[string]string{"app": "web"}),
+	)
+	return NewCustomMetricsProviderFromStorage(st, mapper, client)
+}
+
+// longPodName is longer than label values may be.
+const longPodName = "buildkite-agent-stack-linux-large-7f9c4d8b6-queue-default-abcde12345"
+
+var agentBusyInfo = provider.CustomMetricInfo{
+	GroupResource: schema.GroupResource{Resource: "pods"},
+	Namespaced:    true,
+	Metric:        "buildkite_agent_busy",
+}
+
+func TestCustomMetricsProviderFromStorage_GetMetricBySelector(t *testing.T) {
+	cp := newTestCustomMetricsProvider()
+	list, err := cp.GetMetricBySelector(context.Background(), "ci", labels.SelectorFromSet(map[string]string{"app": "agent"}), agentBusyInfo, labels.Everything())
+	assert.NoError(t, err)
+	values := map[string]int64{}
+	for _, item := range list.Items {
+		assert.Equal(t, "Pod", item.DescribedObject.Kind)
+		assert.Equal(t, "ci", item.DescribedObject.Namespace)
+		assert.Equal(t, "buildkite_agent_busy", item.Metric.Name)
+		values[item.DescribedObject.Name] = item.Value.Value()
+	}
+	assert.Equal(t, map[string]int64{"agent-a": 1, "agent-b": 0, longPodName: 1}, values)
+
+	list, err = cp.GetMetricBySelector(context.Background(), "ci", labels.SelectorFromSet(map[string]string{"app": "web"}), agentBusyInfo, labels.Everything())
+	assert.NoError(t, err)
+	assert.Empty(t, list.Items)
+}
+
+func TestCustomMetricsProviderFromStorage_GetMetricByName(t *testing.T) {
+	cp := newTestCustomMetricsProvider()
+	value, err := cp.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ci", Name: "agent-a"}, agentBusyInfo, labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), value.Value.Value())
+	assert.Equal(t, "agent-a", value.DescribedObject.Name)
+
+	_, err = cp.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ci", Name: "web"}, agentBusyInfo, labels.Everything())
+	assert.Error(t, err)
+
+	nodes := agentBusyInfo
+	nodes.GroupResource = schema.GroupResource{Resource: "nodes"}
+	_, err = cp.GetMetricByName(context.Background(), types.NamespacedName{Name: "agent-a"}, nodes, labels.Everything())
+	assert.Error(t, err)
+}
+
+func TestCustomMetricsProviderFromStorage_ListAllMetrics(t *testing.T) {
+	cp := newTestCustomMetricsProvider()
+	assert.Equal(t, []provider.CustomMetricInfo{agentBusyInfo}, cp.ListAllMetrics())
+}
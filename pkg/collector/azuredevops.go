@@ -0,0 +1,223 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	AzureDevOpsPoolLabel = "pool"
+
+	azureDevOpsAPIVersion        = "6.0"
+	azureDevOpsAgentStatusOnline = "online"
+)
+
+type azureDevOpsPool struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	IsHosted bool   `json:"isHosted"`
+}
+
+type azureDevOpsPools struct {
+	Value []azureDevOpsPool `json:"value"`
+}
+
+type azureDevOpsJobRequest struct {
+	RequestID  int64      `json:"requestId"`
+	AssignTime *time.Time `json:"assignTime"`
+	FinishTime *time.Time `json:"finishTime"`
+	Result     string     `json:"result"`
+}
+
+type azureDevOpsJobRequests struct {
+	Value []azureDevOpsJobRequest `json:"value"`
+}
+
+type azureDevOpsAgent struct {
+	ID              int64  `json:"id"`
+	Name            string `json:"name"`
+	Status          string `json:"status"`
+	Enabled         bool   `json:"enabled"`
+	AssignedRequest *struct {
+		RequestID int64 `json:"requestId"`
+	} `json:"assignedRequest"`
+}
+
+type azureDevOpsAgents struct {
+	Value []azureDevOpsAgent `json:"value"`
+}
+
+// azureDevOpsCounts holds the metrics reported for a single agent pool.
+type azureDevOpsCounts struct {
+	QueuedJobs   int64
+	AssignedJobs int64
+	OnlineAgents int64
+	BusyAgents   int64
+}
+
+// AzureDevOpsCollector reports the job requests and agents of Azure DevOps
+// Services or Server agent pools, in total and per pool.
+type AzureDevOpsCollector struct {
+	// Endpoint is the organization URL, e.g. https://dev.azure.com/acme, or
+	// the collection URL of Azure DevOps Server.
+	Endpoint string
+	Token    string
+	// Pools are the names of the pools to report. All self-hosted pools are
+	// reported if it is empty.
+	Pools []string
+
+	client *http.Client
+}
+
+func NewAzureDevOpsCollector(endpoint, token string, pools []string) *AzureDevOpsCollector {
+	return &AzureDevOpsCollector{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Token:    token,
+		Pools:    pools,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *AzureDevOpsCollector) Collect(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
+	pools, err := c.listPools(ctx)
+	if err != nil {
+		return snapshot, err
+	}
+	var total azureDevOpsCounts
+	for _, pool := range pools {
+		count, err := c.collectPool(ctx, pool)
+		if err != nil {
+			return snapshot, fmt.Errorf("pool %s: %w", pool.Name, err)
+		}
+		total.QueuedJobs += count.QueuedJobs
+		total.AssignedJobs += count.AssignedJobs
+		total.OnlineAgents += count.OnlineAgents
+		total.BusyAgents += count.BusyAgents
+		count.addTo(&snapshot, "azure_devops_", map[string]string{AzureDevOpsPoolLabel: pool.Name})
+	}
+	total.addTo(&snapshot, "azure_devops_total_", nil)
+	return snapshot, nil
+}
+
+func (a *azureDevOpsCounts) addTo(snapshot *Snapshot, prefix string, labels map[string]string) {
+	for name, value := range map[string]int64{
+		"queued_jobs_count":   a.QueuedJobs,
+		"assigned_jobs_count": a.AssignedJobs,
+		"online_agent_count":  a.OnlineAgents,
+		"busy_agent_count":    a.BusyAgents,
+		"idle_agent_count":    a.OnlineAgents - a.BusyAgents,
+	} {
+		snapshot.Add(external_metrics.ExternalMetricValue{
+			MetricName:   prefix + name,
+			MetricLabels: labels,
+			Value:        *resource.NewQuantity(value, resource.DecimalSI),
+		})
+	}
+}
+
+// listPools returns the pools named in Pools, or every self-hosted pool.
+func (c *AzureDevOpsCollector) listPools(ctx context.Context) ([]azureDevOpsPool, error) {
+	var all azureDevOpsPools
+	if err := c.get(ctx, "/_apis/distributedtask/pools", nil, &all); err != nil {
+		return nil, err
+	}
+	if len(c.Pools) == 0 {
+		var pools []azureDevOpsPool
+		for _, pool := range all.Value {
+			if !pool.IsHosted {
+				pools = append(pools, pool)
+			}
+		}
+		return pools, nil
+	}
+	byName := map[string]azureDevOpsPool{}
+	for _, pool := range all.Value {
+		byName[pool.Name] = pool
+	}
+	pools := make([]azureDevOpsPool, 0, len(c.Pools))
+	for _, name := range c.Pools {
+		pool, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("agent pool %q not found", name)
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+func (c *AzureDevOpsCollector) collectPool(ctx context.Context, pool azureDevOpsPool) (*azureDevOpsCounts, error) {
+	count := &azureDevOpsCounts{}
+	var requests azureDevOpsJobRequests
+	if err := c.get(ctx, fmt.Sprintf("/_apis/distributedtask/pools/%d/jobrequests", pool.ID), nil, &requests); err != nil {
+		return nil, err
+	}
+	for _, request := range requests.Value {
+		switch {
+		case request.FinishTime != nil || request.Result != "":
+		case request.AssignTime != nil:
+			count.AssignedJobs++
+		default:
+			count.QueuedJobs++
+		}
+	}
+
+	var agents azureDevOpsAgents
+	query := url.Values{"includeAssignedRequest": {"true"}}
+	if err := c.get(ctx, fmt.Sprintf("/_apis/distributedtask/pools/%d/agents", pool.ID), query, &agents); err != nil {
+		return nil, err
+	}
+	for _, agent := range agents.Value {
+		if agent.Status != azureDevOpsAgentStatusOnline || !agent.Enabled {
+			continue
+		}
+		count.OnlineAgents++
+		if agent.AssignedRequest != nil {
+			count.BusyAgents++
+		}
+	}
+	klog.V(5).Infof("Azure DevOps pool %s: %+v", pool.Name, *count)
+	return count, nil
+}
+
+func (c *AzureDevOpsCollector) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	endpoint, err := url.Parse(c.Endpoint + path)
+	if err != nil {
+		return err
+	}
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("api-version", azureDevOpsAPIVersion)
+	endpoint.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+	// Personal access tokens are sent as the password of basic auth.
+	req.SetBasicAuth("", c.Token)
+	req.Header.Set("User-Agent", "buildscaler")
+	_, err = getJSON(c.client, req, v)
+	return err
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+)
+
+func newAzureDevOpsServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pat, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "fake-pat", pat)
+		assert.NotEmpty(t, r.URL.Query().Get("api-version"))
+		switch r.URL.Path {
+		case "/acme/_apis/distributedtask/pools":
+			_, _ = io.WriteString(w, `{"count": 3, "value": [
+{"id": 1, "name": "Azure Pipelines", "isHosted": true},
+{"id": 2, "name": "linux", "isHosted": false},
+{"id": 3, "name": "windows", "isHosted": false}
+]}`)
+		case "/acme/_apis/distributedtask/pools/2/jobrequests":
+			_, _ = io.WriteString(w, `{"count": 4, "value": [
+{"requestId": 1, "queueTime": "2022-03-01T10:00:00Z"},
+{"requestId": 2, "queueTime": "2022-03-01T10:00:00Z"},
+{"requestId": 3, "queueTime": "2022-03-01T10:00:00Z", "assignTime": "2022-03-01T10:01:00Z"},
+{"requestId": 4, "queueTime": "2022-03-01T09:00:00Z", "assignTime": "2022-03-01T09:01:00Z", "finishTime": "2022-03-01T09:10:00Z", "result": "succeeded"}
+]}`)
+		case "/acme/_apis/distributedtask/pools/2/agents":
+			assert.Equal(t, "true", r.URL.Query().Get("includeAssignedRequest"))
+			_, _ = io.WriteString(w, `{"count": 4, "value": [
+{"id": 1, "name": "agent-1", "status": "online", "enabled": true, "assignedRequest": {"requestId": 3}},
+{"id": 2, "name": "agent-2", "status": "online", "enabled": true},
+{"id": 3, "name": "agent-3", "status": "offline", "enabled": true},
+{"id": 4, "name": "agent-4", "status": "online", "enabled": false}
+]}`)
+		case "/acme/_apis/distributedtask/pools/3/jobrequests", "/acme/_apis/distributedtask/pools/3/agents":
+			_, _ = io.WriteString(w, `{"count": 0, "value": []}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestAzureDevOpsCollector(t *testing.T) {
+	s := newAzureDevOpsServer(t)
+	defer s.Close()
+	c := NewAzureDevOpsCollector(s.URL+"/acme", "fake-pat", nil)
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+
+	for _, tc := range []struct {
+		name     string
+		pool     string
+		expected int64
+	}{
+		{"azure_devops_queued_jobs_count", "linux", 2},
+		{"azure_devops_assigned_jobs_count", "linux", 1},
+		{"azure_devops_online_agent_count", "linux", 2},
+		{"azure_devops_busy_agent_count", "linux", 1},
+		{"azure_devops_idle_agent_count", "linux", 1},
+		{"azure_devops_queued_jobs_count", "windows", 0},
+	} {
+		series, ok := st.Get(tc.name, labels.SelectorFromSet(map[string]string{AzureDevOpsPoolLabel: tc.pool}))
+		assert.True(t, ok, tc.name)
+		if assert.Len(t, series, 1, "%s{%s}", tc.name, tc.pool) {
+			assert.Equal(t, tc.expected, series[0].Value.Value.Value(), "%s{%s}", tc.name, tc.pool)
+		}
+	}
+	for name, expected := range map[string]int64{
+		"azure_devops_total_queued_jobs_count":   2,
+		"azure_devops_total_assigned_jobs_count": 1,
+		"azure_devops_total_online_agent_count":  2,
+		"azure_devops_total_busy_agent_count":    1,
+	} {
+		series, ok := st.Get(name, labels.Everything())
+		assert.True(t, ok, name)
+		if assert.Len(t, series, 1, name) {
+			assert.Equal(t, expected, series[0].Value.Value.Value(), name)
+		}
+	}
+	series, _ := st.Get("azure_devops_queued_jobs_count", labels.Everything())
+	assert.Len(t, series, 2, "hosted pools are skipped")
+}
+
+func TestAzureDevOpsCollectorPools(t *testing.T) {
+	s := newAzureDevOpsServer(t)
+	defer s.Close()
+	c := NewAzureDevOpsCollector(s.URL+"/acme/", "fake-pat", []string{"windows"})
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	for _, m := range snapshot.Metrics {
+		if m.MetricLabels != nil {
+			assert.Equal(t, "windows", m.MetricLabels[AzureDevOpsPoolLabel])
+		}
+	}
+
+	c = NewAzureDevOpsCollector(s.URL+"/acme", "fake-pat", []string{"macos"})
+	_, err = c.Collect(context.Background())
+	assert.EqualError(t, err, `agent pool "macos" not found`)
+}
@@ -24,13 +24,17 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/elotl/buildscaler/pkg/storage"
 	"k8s.io/apimachinery/pkg/api/resource"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/klog/v2"
 	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	"github.com/elotl/buildscaler/pkg/storage"
 )
 
 const (
@@ -44,6 +48,12 @@ const (
 	BusyAgentPercentage = "BusyAgentPercentage"
 
 	PollDurationHeader = `Buildkite-Agent-Metrics-Poll-Duration`
+
+	BuildkiteAgentAPIEndpoint = "https://agent.buildkite.com/v3"
+
+	BuildkiteQueueLabel   = "queue"
+	BuildkiteClusterLabel = "cluster"
+	BuildkiteOrgLabel     = "org"
 )
 
 var (
@@ -55,52 +65,242 @@ type BuildkiteCollector struct {
 	Token     string
 	UserAgent string
 	Queues    []string
+	// Orgs and Clusters are scraped concurrently instead of Token when set.
+	// Series of clusters are also labeled with the cluster name.
+	Orgs     []BuildkiteOrg
+	Clusters []BuildkiteCluster
+	// API optionally reports the metrics of the scraped organizations which
+	// require the Buildkite GraphQL API.
+	API       *BuildkiteAPI
 	Quiet     bool
 	Debug     bool
 	DebugHttp bool
-	storage   *storage.ExternalMetricsMap
+
+	// sourceLabels holds the labels of each source at its last successful
+	// scrape, to retain its series while it fails.
+	sourceLabels map[int]map[string]string
+}
+
+// BuildkiteOrg is the agent token of an organization, all its queues are
+// reported if Queues is empty.
+type BuildkiteOrg struct {
+	Token  string
+	Queues []string
+}
+
+// BuildkiteCluster is a cluster of the Buildkite clusters model, whose agent
+// token only sees the queues of the cluster. Name defaults to the name in the
+// metrics response, and all queues are reported if Queues is empty.
+type BuildkiteCluster struct {
+	Name   string
+	Token  string
+	Queues []string
 }
 
-func NewBuildkiteCollector(storage *storage.ExternalMetricsMap, token, version string, queues []string) *BuildkiteCollector {
+func NewBuildkiteCollector(token, version string, queues []string) *BuildkiteCollector {
 	return &BuildkiteCollector{
-		Endpoint:  "https://agent.buildkite.com/v3", // should we pass it from flags?
+		Endpoint:  BuildkiteAgentAPIEndpoint,
 		Token:     token,
 		UserAgent: "elotl-buildscaler/" + version + " buildkite-metrics-collector",
 		Queues:    queues,
 		Quiet:     false,
 		Debug:     false,
 		DebugHttp: false,
-		storage:   storage,
 	}
 }
 
-func (c *BuildkiteCollector) Collect(cancel context.CancelFunc) error {
-	r, err := c.collect()
-	if err != nil {
-		cancel()
-		return err
+// buildkiteSource is an agent token scraped by the collector.
+type buildkiteSource struct {
+	token   string
+	queues  []string
+	cluster *BuildkiteCluster
+}
+
+func (c *BuildkiteCollector) sources() []buildkiteSource {
+	if len(c.Orgs) == 0 && len(c.Clusters) == 0 {
+		return []buildkiteSource{{token: c.Token, queues: c.Queues}}
+	}
+	var sources []buildkiteSource
+	for _, org := range c.Orgs {
+		sources = append(sources, buildkiteSource{token: org.Token, queues: org.Queues})
+	}
+	for i := range c.Clusters {
+		cluster := &c.Clusters[i]
+		sources = append(sources, buildkiteSource{token: cluster.Token, queues: cluster.Queues, cluster: cluster})
+	}
+	return sources
+}
+
+// Collect reports the series of every org and cluster labeled with the org,
+// their totals, and the buildkite_all_orgs_total_* totals across all of them
+// when there are several.
+// The totals of a single Token are reported without labels.
+// If only some of them fail, the others are returned with a *PartialError,
+// retaining the series of the failed ones and the totals across all. A
+// *PartialError is also returned when the API results are truncated.
+func (c *BuildkiteCollector) Collect(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
+	sources := c.sources()
+	results := make([]*Result, len(sources))
+	errs := make([]error, len(sources))
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func(i int, source buildkiteSource) {
+			defer wg.Done()
+			results[i], errs[i] = c.collectQueues(ctx, source.token, source.queues)
+		}(i, source)
+	}
+	wg.Wait()
+
+	if len(sources) == 1 && errs[0] != nil {
+		return snapshot, errs[0]
+	}
+	if c.sourceLabels == nil {
+		c.sourceLabels = map[int]map[string]string{}
+	}
+	allOrgs := map[string]int{}
+	seen := map[string]bool{}
+	var orgs []string
+	orgQueues := map[string][]buildkiteQueue{}
+	var failed []error
+	for i, source := range sources {
+		if errs[i] != nil {
+			if source.cluster != nil {
+				failed = append(failed, fmt.Errorf("cluster %s: %w", source.cluster.Name, errs[i]))
+			} else {
+				failed = append(failed, fmt.Errorf("org token %d: %w", i, errs[i]))
+			}
+			retained := c.sourceLabels[i]
+			if retained == nil && source.cluster != nil && source.cluster.Name != "" {
+				retained = map[string]string{BuildkiteClusterLabel: source.cluster.Name}
+			}
+			if retained != nil {
+				selector := labels.SelectorFromSet(retained)
+				if source.cluster == nil {
+					// The series of an org token are the org's ones
+					// without a cluster, the cluster tokens of the
+					// org still report theirs.
+					noCluster, _ := labels.NewRequirement(BuildkiteClusterLabel, selection.DoesNotExist, nil)
+					selector = selector.Add(*noCluster)
+				}
+				snapshot.Retained = append(snapshot.Retained, storage.Selection{Selector: selector})
+			}
+			continue
+		}
+		r := results[i]
+		sourceLabels := map[string]string{BuildkiteOrgLabel: r.Org}
+		key := r.Org
+		if source.cluster != nil {
+			name := source.cluster.Name
+			if name == "" {
+				name = r.Cluster
+			}
+			if name == "" {
+				return snapshot, fmt.Errorf("no cluster name was found in the metrics response of organization %q, it must be configured", r.Org)
+			}
+			sourceLabels[BuildkiteClusterLabel] = name
+			key += "/" + name
+		}
+		if seen[key] {
+			return snapshot, fmt.Errorf("organization %q is scraped by more than one token", key)
+		}
+		seen[key] = true
+		c.sourceLabels[i] = sourceLabels
+		if r.PollDuration > snapshot.PollAfter {
+			snapshot.PollAfter = r.PollDuration
+		}
+		totalLabels := sourceLabels
+		if len(c.Orgs) == 0 && len(c.Clusters) == 0 {
+			// A single token reports its totals without labels.
+			totalLabels = nil
+		}
+		r.addTo(&snapshot, totalLabels, sourceLabels)
+		if _, ok := orgQueues[r.Org]; !ok {
+			orgs = append(orgs, r.Org)
+			orgQueues[r.Org] = nil
+		}
+		for queue := range r.Queues {
+			orgQueues[r.Org] = append(orgQueues[r.Org], buildkiteQueue{cluster: sourceLabels[BuildkiteClusterLabel], name: queue})
+		}
+		for name, value := range r.Totals {
+			allOrgs[name] += value
+		}
 	}
+
+	if len(failed) == len(sources) {
+		return Snapshot{}, utilerrors.NewAggregate(failed)
+	}
+
+	// apiErr reports the API results truncated to buildkiteMaxPages pages.
+	var apiErr *PartialError
+	if c.API != nil {
+		if err := c.API.addTo(ctx, &snapshot, orgs, orgQueues); err != nil && !errors.As(err, &apiErr) {
+			return snapshot, err
+		}
+	}
+
+	if len(failed) > 0 {
+		// Totals across a part of the organizations would drop, keep the
+		// last complete ones instead.
+		for name := range allOrgs {
+			snapshot.Retained = append(snapshot.Retained, storage.Selection{
+				MetricName: fmt.Sprintf("buildkite_all_orgs_total_%s", camelToUnderscore(name)),
+				Selector:   labels.Everything(),
+			})
+		}
+		if apiErr != nil {
+			failed = append(failed, apiErr.Err)
+		}
+		return snapshot, &PartialError{Err: utilerrors.NewAggregate(failed)}
+	}
+	// The totals of a single source are the buildkite_total_* ones.
+	if len(sources) > 1 {
+		if _, ok := allOrgs[BusyAgentPercentage]; ok {
+			allOrgs[BusyAgentPercentage] = 0
+			if allOrgs[TotalAgentCount] > 0 {
+				allOrgs[BusyAgentPercentage] = 100 * allOrgs[BusyAgentCount] / allOrgs[TotalAgentCount]
+			}
+		}
+		for name, value := range allOrgs {
+			snapshot.Add(external_metrics.ExternalMetricValue{
+				MetricName: fmt.Sprintf("buildkite_all_orgs_total_%s", camelToUnderscore(name)),
+				Value:      resource.MustParse(strconv.Itoa(value)),
+			})
+		}
+	}
+	if apiErr != nil {
+		return snapshot, apiErr
+	}
+	return snapshot, nil
+}
+
+// addTo adds the totals of r to snapshot with totalLabels, and the counts of
+// every queue with labels and the queue label.
+func (r *Result) addTo(snapshot *Snapshot, totalLabels, labels map[string]string) {
 	for name, value := range r.Totals {
 		key := fmt.Sprintf("buildkite_total_%s", camelToUnderscore(name))
-		c.storage.OverrideOrStore(key, external_metrics.ExternalMetricValue{
-			MetricName: key,
-			Timestamp:  v1.NewTime(time.Now()),
-			Value:      resource.MustParse(strconv.Itoa(value)),
+		snapshot.Add(external_metrics.ExternalMetricValue{
+			MetricName:   key,
+			MetricLabels: totalLabels,
+			Value:        resource.MustParse(strconv.Itoa(value)),
 		})
 	}
 
 	for queue, counts := range r.Queues {
+		queueLabels := map[string]string{BuildkiteQueueLabel: queue}
+		for k, v := range labels {
+			queueLabels[k] = v
+		}
 		for name, value := range counts {
 			key := fmt.Sprintf("buildkite_%s", camelToUnderscore(name))
-			c.storage.OverrideOrStore(key, external_metrics.ExternalMetricValue{
+			snapshot.Add(external_metrics.ExternalMetricValue{
 				MetricName:   key,
-				MetricLabels: map[string]string{"queue": queue},
-				Timestamp:    v1.NewTime(time.Now()),
+				MetricLabels: queueLabels,
 				Value:        resource.MustParse(strconv.Itoa(value)),
 			})
 		}
 	}
-	return nil
 }
 
 // Copyright (c) 2016 Buildkite Pty Ltd
@@ -109,6 +309,7 @@ type Result struct {
 	Totals       map[string]int
 	Queues       map[string]map[string]int
 	Org          string
+	Cluster      string
 	PollDuration time.Duration
 }
 
@@ -116,6 +317,10 @@ type organizationResponse struct {
 	Slug string `json:"slug"`
 }
 
+type clusterResponse struct {
+	Name string `json:"name"`
+}
+
 type metricsAgentsResponse struct {
 	Idle  int `json:"idle"`
 	Busy  int `json:"busy"`
@@ -133,6 +338,7 @@ type queueMetricsResponse struct {
 	Agents       metricsAgentsResponse `json:"agents"`
 	Jobs         metricsJobsResponse   `json:"jobs"`
 	Organization organizationResponse  `json:"organization"`
+	Cluster      clusterResponse       `json:"cluster"`
 }
 
 type allMetricsAgentsResponse struct {
@@ -149,11 +355,13 @@ type allMetricsResponse struct {
 	Agents       allMetricsAgentsResponse `json:"agents"`
 	Jobs         allMetricsJobsResponse   `json:"jobs"`
 	Organization organizationResponse     `json:"organization"`
+	Cluster      clusterResponse          `json:"cluster"`
 }
 
 func metricsToResult(allMetrics *allMetricsResponse, result *Result) {
 	klog.Infof("Found organization %q", allMetrics.Organization.Slug)
 	result.Org = allMetrics.Organization.Slug
+	result.Cluster = allMetrics.Cluster.Name
 
 	result.Totals[ScheduledJobsCount] = allMetrics.Jobs.Scheduled
 	result.Totals[RunningJobsCount] = allMetrics.Jobs.Running
@@ -185,16 +393,20 @@ func metricsToResult(allMetrics *allMetricsResponse, result *Result) {
 	}
 }
 
+func (c *BuildkiteCollector) collect(ctx context.Context) (*Result, error) {
+	return c.collectQueues(ctx, c.Token, c.Queues)
+}
+
 // XXX: this function is too big and complex. We should simplify it and remove
 // the nolint flag below.
 // nolint:cyclop
-func (c *BuildkiteCollector) collect() (*Result, error) {
+func (c *BuildkiteCollector) collectQueues(ctx context.Context, token string, queues []string) (*Result, error) {
 	result := &Result{
 		Totals: map[string]int{},
 		Queues: map[string]map[string]int{},
 	}
 
-	if len(c.Queues) == 0 {
+	if len(queues) == 0 {
 		klog.V(5).Infof("Collecting agent metrics for all queues")
 
 		endpoint, err := url.Parse(c.Endpoint)
@@ -204,13 +416,13 @@ func (c *BuildkiteCollector) collect() (*Result, error) {
 
 		endpoint.Path += "/metrics"
 
-		req, err := http.NewRequest("GET", endpoint.String(), nil)
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
 		if err != nil {
 			return nil, err
 		}
 
 		req.Header.Set("User-Agent", c.UserAgent)
-		req.Header.Set("Authorization", fmt.Sprintf("Token %s", c.Token))
+		req.Header.Set("Authorization", fmt.Sprintf("Token %s", token))
 
 		if c.DebugHttp {
 			if dump, err := httputil.DumpRequest(req, true); err == nil {
@@ -235,6 +447,9 @@ func (c *BuildkiteCollector) collect() (*Result, error) {
 		}
 
 		// Handle any errors
+		if err := rateLimitError(res); err != nil {
+			return nil, err
+		}
 		if res.StatusCode != http.StatusOK {
 			// If it's json response, show the error message
 			if strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
@@ -255,14 +470,7 @@ func (c *BuildkiteCollector) collect() (*Result, error) {
 		var allMetrics allMetricsResponse
 
 		// Check if we get a poll duration header from server
-		if pollSeconds := res.Header.Get(PollDurationHeader); pollSeconds != "" {
-			pollSecondsInt, err := strconv.ParseInt(pollSeconds, 10, 64)
-			if err != nil {
-				klog.Infof("Failed to parse %s header: %v", PollDurationHeader, err)
-			} else {
-				result.PollDuration = time.Duration(pollSecondsInt) * time.Second
-			}
-		}
+		result.PollDuration = pollDuration(res)
 
 		err = json.NewDecoder(res.Body).Decode(&allMetrics)
 		if err != nil {
@@ -276,7 +484,7 @@ func (c *BuildkiteCollector) collect() (*Result, error) {
 		metricsToResult(&allMetrics, result)
 
 	} else {
-		for _, queue := range c.Queues {
+		for _, queue := range queues {
 			klog.V(5).Infof("Collecting agent metrics for queue '%s'", queue)
 
 			endpoint, err := url.Parse(c.Endpoint)
@@ -287,13 +495,13 @@ func (c *BuildkiteCollector) collect() (*Result, error) {
 			endpoint.Path += "/metrics/queue"
 			endpoint.RawQuery = url.Values{"name": {queue}}.Encode()
 
-			req, err := http.NewRequest("GET", endpoint.String(), nil)
+			req, err := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
 			if err != nil {
 				return nil, err
 			}
 
 			req.Header.Set("User-Agent", c.UserAgent)
-			req.Header.Set("Authorization", fmt.Sprintf("Token %s", c.Token))
+			req.Header.Set("Authorization", fmt.Sprintf("Token %s", token))
 
 			if c.DebugHttp {
 				if dump, err := httputil.DumpRequest(req, true); err == nil {
@@ -314,6 +522,12 @@ func (c *BuildkiteCollector) collect() (*Result, error) {
 
 			var queueMetrics queueMetricsResponse
 			defer res.Body.Close()
+			if err := rateLimitError(res); err != nil {
+				return nil, err
+			}
+			if d := pollDuration(res); d > result.PollDuration {
+				result.PollDuration = d
+			}
 			err = json.NewDecoder(res.Body).Decode(&queueMetrics)
 			if err != nil {
 				return nil, err
@@ -325,6 +539,7 @@ func (c *BuildkiteCollector) collect() (*Result, error) {
 
 			klog.V(5).Infof("Found organization %q", queueMetrics.Organization.Slug)
 			result.Org = queueMetrics.Organization.Slug
+			result.Cluster = queueMetrics.Cluster.Name
 
 			result.Queues[queue] = map[string]int{
 				ScheduledJobsCount:  queueMetrics.Jobs.Scheduled,
@@ -346,6 +561,21 @@ func (c *BuildkiteCollector) collect() (*Result, error) {
 	return result, nil
 }
 
+// pollDuration returns the poll duration advertised in the
+// Buildkite-Agent-Metrics-Poll-Duration header of res, zero if there is none.
+func pollDuration(res *http.Response) time.Duration {
+	pollSeconds := res.Header.Get(PollDurationHeader)
+	if pollSeconds == "" {
+		return 0
+	}
+	pollSecondsInt, err := strconv.ParseInt(pollSeconds, 10, 64)
+	if err != nil {
+		klog.Infof("Failed to parse %s header: %v", PollDurationHeader, err)
+		return 0
+	}
+	return time.Duration(pollSecondsInt) * time.Second
+}
+
 func busyAgentPercentage(agents metricsAgentsResponse) int {
 	if agents.Total > 0 {
 		return int(100 * agents.Busy / agents.Total)
@@ -0,0 +1,505 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	BuildkiteGraphQLEndpoint = "https://graphql.buildkite.com/v1"
+
+	BuildkiteQuantileLabel = "quantile"
+	BuildkitePipelineLabel = "pipeline"
+	// BuildkitePodLabel holds the hostname of an agent, which is the name of
+	// its pod when it runs in Kubernetes. Series with a pod label are also
+	// served as custom metrics of the pod.
+	BuildkitePodLabel = "pod"
+
+	buildkiteDefaultQueue = "default"
+	buildkiteJobScheduled = "SCHEDULED"
+	buildkiteJobAssigned  = "ASSIGNED"
+	buildkiteJobAccepted  = "ACCEPTED"
+	buildkiteJobRunning   = "RUNNING"
+	// buildkiteMaxPages bounds the GraphQL requests per organization, query
+	// and scrape, the API being rate limited per token. Jobs beyond it are
+	// not seen, which is reported with a *PartialError.
+	buildkiteMaxPages = 10
+	// buildkiteAgentConnected is the connection state of running agents.
+	buildkiteAgentConnected = "connected"
+	// buildkiteZeroRetention is how long the pipeline and agent tags series
+	// without jobs keep reporting 0, so a HorizontalPodAutoscaler selecting
+	// them can scale down before they disappear.
+	buildkiteZeroRetention = time.Hour
+
+	buildkiteJobsQuery = `query($org: ID!, $states: [JobStates!], $after: String) {
+  organization(slug: $org) {
+    jobs(first: 100, after: $after, state: $states, type: [COMMAND]) {
+      pageInfo { hasNextPage endCursor }
+      edges {
+        node {
+          ... on JobTypeCommand {
+            state
+            scheduledAt
+            runnableAt
+            agentQueryRules
+            pipeline { slug }
+            clusterQueue { cluster { name } }
+          }
+        }
+      }
+    }
+  }
+}`
+
+	buildkiteAgentsQuery = `query($org: ID!, $after: String) {
+  organization(slug: $org) {
+    agents(first: 100, after: $after) {
+      pageInfo { hasNextPage endCursor }
+      edges {
+        node {
+          hostname
+          connectionState
+          isRunningJob
+        }
+      }
+    }
+  }
+}`
+)
+
+// buildkiteWaitQuantiles are the quantiles of the wait time summary.
+var buildkiteWaitQuantiles = []float64{0.5, 0.9, 0.99}
+
+// BuildkiteAPI reads the jobs of the organizations scraped by a
+// BuildkiteCollector from the Buildkite GraphQL API, for the metrics the
+// agent metrics endpoint does not provide. Token is an API access token with
+// GraphQL access to the organizations.
+type BuildkiteAPI struct {
+	Endpoint string
+	Token    string
+	// WaitTimes enables the wait time metrics of the scheduled jobs.
+	WaitTimes bool
+	// Pipelines enables the scheduled and running job counts per pipeline.
+	Pipelines bool
+	// AgentQueryRules are the agent tags, e.g. os or arch, of the scheduled
+	// and running job counts per agent query rules. They are disabled if
+	// empty.
+	AgentQueryRules []string
+	// Agents enables buildkite_agent_busy, 0 or 1 for every connected agent,
+	// labeled with its hostname as pod.
+	Agents bool
+
+	client *http.Client
+	// lastCounted holds when each label set of the job counters, keyed by
+	// metric prefix and SeriesKey, last had jobs.
+	lastCounted map[string]map[string]countedLabels
+}
+
+type countedLabels struct {
+	labels map[string]string
+	at     time.Time
+}
+
+func NewBuildkiteAPI(endpoint, token string) *BuildkiteAPI {
+	return &BuildkiteAPI{
+		Endpoint: endpoint,
+		Token:    token,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type buildkiteJob struct {
+	State           string     `json:"state"`
+	ScheduledAt     *time.Time `json:"scheduledAt"`
+	RunnableAt      *time.Time `json:"runnableAt"`
+	AgentQueryRules []string   `json:"agentQueryRules"`
+	Pipeline        struct {
+		Slug string `json:"slug"`
+	} `json:"pipeline"`
+	ClusterQueue *struct {
+		Cluster struct {
+			Name string `json:"name"`
+		} `json:"cluster"`
+	} `json:"clusterQueue"`
+}
+
+// buildkiteQueue identifies a queue of an organization. Queues of different
+// clusters may share a name, cluster is empty outside of clusters.
+type buildkiteQueue struct {
+	cluster string
+	name    string
+}
+
+// labels returns labels with the queue label, and the cluster label if q is
+// in a cluster.
+func (q buildkiteQueue) labels(labels map[string]string) map[string]string {
+	queueLabels := withLabel(labels, BuildkiteQueueLabel, q.name)
+	if q.cluster != "" {
+		queueLabels[BuildkiteClusterLabel] = q.cluster
+	}
+	return queueLabels
+}
+
+// buildkiteGraphQLResponse is the response of a query listing a connection,
+// e.g. jobs, of an organization.
+type buildkiteGraphQLResponse struct {
+	Data struct {
+		Organization map[string]struct {
+			PageInfo struct {
+				HasNextPage bool   `json:"hasNextPage"`
+				EndCursor   string `json:"endCursor"`
+			} `json:"pageInfo"`
+			Edges []struct {
+				Node json.RawMessage `json:"node"`
+			} `json:"edges"`
+		} `json:"organization"`
+	} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+type buildkiteAgent struct {
+	Hostname        string `json:"hostname"`
+	ConnectionState string `json:"connectionState"`
+	IsRunningJob    bool   `json:"isRunningJob"`
+}
+
+// queue returns the cluster queue of j, and the queue of its agent query
+// rules, agents without a queue tag belonging to the default queue.
+func (j buildkiteJob) queue() buildkiteQueue {
+	q := buildkiteQueue{name: buildkiteDefaultQueue}
+	if j.ClusterQueue != nil {
+		q.cluster = j.ClusterQueue.Cluster.Name
+	}
+	for _, rule := range j.AgentQueryRules {
+		if strings.HasPrefix(rule, BuildkiteQueueLabel+"=") {
+			q.name = strings.TrimPrefix(rule, BuildkiteQueueLabel+"=")
+			break
+		}
+	}
+	return q
+}
+
+// waitingSince returns when j became ready to run, which is later than when
+// it was scheduled if it waited for a concurrency group.
+func (j buildkiteJob) waitingSince() *time.Time {
+	if j.RunnableAt != nil {
+		return j.RunnableAt
+	}
+	return j.ScheduledAt
+}
+
+// addTo adds the enabled metrics of orgs to snapshot. Wait time series are
+// reported for the queues found in the jobs, and for the queues of orgQueues.
+// If an organization has more jobs or agents than buildkiteMaxPages pages,
+// the metrics of the first ones are added and a *PartialError is returned.
+func (a *BuildkiteAPI) addTo(ctx context.Context, snapshot *Snapshot, orgs []string, orgQueues map[string][]buildkiteQueue) error {
+	var truncated []error
+	// check returns err unless it only reports truncated results.
+	check := func(err error) error {
+		var partial *PartialError
+		if errors.As(err, &partial) {
+			truncated = append(truncated, partial.Err)
+			return nil
+		}
+		return err
+	}
+	if a.Agents {
+		for _, org := range orgs {
+			if err := check(a.addAgents(ctx, snapshot, org)); err != nil {
+				return err
+			}
+		}
+	}
+	breakdown := a.Pipelines || len(a.AgentQueryRules) > 0
+	if !a.WaitTimes && !breakdown {
+		return truncatedError(truncated)
+	}
+	states := []string{buildkiteJobScheduled}
+	if breakdown {
+		states = append(states, buildkiteJobAssigned, buildkiteJobAccepted, buildkiteJobRunning)
+	}
+	pipelines := newSeriesCounter("buildkite_pipeline_", "scheduled_jobs_count", "running_jobs_count")
+	tags := newSeriesCounter("buildkite_agent_tags_", "scheduled_jobs_count", "running_jobs_count")
+	now := time.Now()
+	for _, org := range orgs {
+		jobs, err := a.jobs(ctx, org, states)
+		if err := check(err); err != nil {
+			return err
+		}
+		labels := map[string]string{BuildkiteOrgLabel: org}
+		var scheduled []buildkiteJob
+		for _, job := range jobs {
+			name := "running_jobs_count"
+			if job.State == buildkiteJobScheduled {
+				name = "scheduled_jobs_count"
+				scheduled = append(scheduled, job)
+			}
+			queueLabels := job.queue().labels(labels)
+			if a.Pipelines {
+				pipelines.inc(name, withLabel(queueLabels, BuildkitePipelineLabel, job.Pipeline.Slug))
+			}
+			if len(a.AgentQueryRules) > 0 {
+				tags.inc(name, job.tagLabels(queueLabels, a.AgentQueryRules))
+			}
+		}
+		if a.WaitTimes {
+			addWaitTimes(snapshot, labels, scheduled, orgQueues[org], now)
+		}
+	}
+	if a.Pipelines {
+		a.addCounter(snapshot, pipelines, orgs, now)
+	}
+	if len(a.AgentQueryRules) > 0 {
+		a.addCounter(snapshot, tags, orgs, now)
+	}
+	return truncatedError(truncated)
+}
+
+// truncatedError returns a *PartialError for the truncated results, if any.
+func truncatedError(truncated []error) error {
+	if len(truncated) == 0 {
+		return nil
+	}
+	return &PartialError{Err: utilerrors.NewAggregate(truncated)}
+}
+
+// addCounter adds the series of counter, and 0 for the label sets of orgs
+// that had jobs during the last buildkiteZeroRetention.
+func (a *BuildkiteAPI) addCounter(snapshot *Snapshot, counter *seriesCounter, orgs []string, now time.Time) {
+	if a.lastCounted == nil {
+		a.lastCounted = map[string]map[string]countedLabels{}
+	}
+	counted := a.lastCounted[counter.prefix]
+	if counted == nil {
+		counted = map[string]countedLabels{}
+		a.lastCounted[counter.prefix] = counted
+	}
+	for key, labels := range counter.labels {
+		counted[key] = countedLabels{labels: labels, at: now}
+	}
+	scraped := make(map[string]bool, len(orgs))
+	for _, org := range orgs {
+		scraped[org] = true
+	}
+	for key, c := range counted {
+		if now.Sub(c.at) > buildkiteZeroRetention {
+			delete(counted, key)
+		} else if scraped[c.labels[BuildkiteOrgLabel]] {
+			// The label sets of organizations that failed to scrape
+			// are retained with their last values instead.
+			counter.keep(c.labels)
+		}
+	}
+	counter.addTo(snapshot)
+}
+
+// addAgents adds whether every connected agent of org is running a job.
+// Agents without a hostname cannot be matched with a pod, and are skipped.
+func (a *BuildkiteAPI) addAgents(ctx context.Context, snapshot *Snapshot, org string) error {
+	agents, err := a.agents(ctx, org)
+	var partial *PartialError
+	if err != nil && !errors.As(err, &partial) {
+		return err
+	}
+	for _, agent := range agents {
+		if agent.Hostname == "" || agent.ConnectionState != buildkiteAgentConnected {
+			continue
+		}
+		var busy int64
+		if agent.IsRunningJob {
+			busy = 1
+		}
+		snapshot.Add(external_metrics.ExternalMetricValue{
+			MetricName:   "buildkite_agent_busy",
+			MetricLabels: map[string]string{BuildkiteOrgLabel: org, BuildkitePodLabel: agent.Hostname},
+			Value:        *resource.NewQuantity(busy, resource.DecimalSI),
+		})
+	}
+	return err
+}
+
+// tagLabels returns labels with the value of every agent tag in keys, "" if
+// the agent query rules of j do not constrain it.
+func (j buildkiteJob) tagLabels(labels map[string]string, keys []string) map[string]string {
+	tagLabels := make(map[string]string, len(labels)+len(keys))
+	for k, v := range labels {
+		tagLabels[k] = v
+	}
+	for _, key := range keys {
+		tagLabels[key] = ""
+	}
+	for _, rule := range j.AgentQueryRules {
+		key, value := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			key, value = rule[:i], rule[i+1:]
+		}
+		if _, ok := tagLabels[key]; ok && key != BuildkiteQueueLabel && key != BuildkiteOrgLabel && key != BuildkiteClusterLabel {
+			tagLabels[key] = value
+		}
+	}
+	return tagLabels
+}
+
+// addWaitTimes adds the age of the oldest waiting job of every queue, and the
+// quantiles of the ages of its waiting jobs. A queue of queues outside of
+// clusters is skipped if a cluster has a queue of the same name: when org and
+// cluster tokens are mixed, it is the cluster queue seen by the org token.
+func addWaitTimes(snapshot *Snapshot, labels map[string]string, jobs []buildkiteJob, queues []buildkiteQueue, now time.Time) {
+	clustered := map[string]bool{}
+	for _, queue := range queues {
+		if queue.cluster != "" {
+			clustered[queue.name] = true
+		}
+	}
+	ages := map[buildkiteQueue][]float64{}
+	for _, queue := range queues {
+		if queue.cluster == "" && clustered[queue.name] {
+			continue
+		}
+		ages[queue] = nil
+	}
+	for _, job := range jobs {
+		since := job.waitingSince()
+		if since == nil {
+			continue
+		}
+		age := math.Max(0, now.Sub(*since).Seconds())
+		ages[job.queue()] = append(ages[job.queue()], math.Round(age))
+	}
+	for queue, queueAges := range ages {
+		sort.Float64s(queueAges)
+		queueLabels := queue.labels(labels)
+		var oldest float64
+		if len(queueAges) > 0 {
+			oldest = queueAges[len(queueAges)-1]
+		}
+		snapshot.Add(external_metrics.ExternalMetricValue{
+			MetricName:   "buildkite_oldest_waiting_job_age_seconds",
+			MetricLabels: queueLabels,
+			Value:        floatQuantity(oldest),
+		})
+		for _, q := range buildkiteWaitQuantiles {
+			snapshot.Add(external_metrics.ExternalMetricValue{
+				MetricName:   "buildkite_waiting_job_age_seconds",
+				MetricLabels: withLabel(queueLabels, BuildkiteQuantileLabel, formatFloat(q)),
+				Value:        floatQuantity(quantile(queueAges, q)),
+			})
+		}
+	}
+}
+
+// quantile returns the nearest-rank quantile q of the sorted values, or 0
+// without any.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(q * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// jobs returns the command jobs of org in states, up to buildkiteMaxPages
+// pages, with a *PartialError if there are more.
+func (a *BuildkiteAPI) jobs(ctx context.Context, org string, states []string) ([]buildkiteJob, error) {
+	var jobs []buildkiteJob
+	err := a.paginate(ctx, org, buildkiteJobsQuery, "jobs", map[string]interface{}{"states": states}, func(node json.RawMessage) error {
+		var job buildkiteJob
+		if err := json.Unmarshal(node, &job); err != nil {
+			return err
+		}
+		jobs = append(jobs, job)
+		return nil
+	})
+	return jobs, err
+}
+
+// agents returns the agents of org, up to buildkiteMaxPages pages, with a
+// *PartialError if there are more.
+func (a *BuildkiteAPI) agents(ctx context.Context, org string) ([]buildkiteAgent, error) {
+	var agents []buildkiteAgent
+	err := a.paginate(ctx, org, buildkiteAgentsQuery, "agents", map[string]interface{}{}, func(node json.RawMessage) error {
+		var agent buildkiteAgent
+		if err := json.Unmarshal(node, &agent); err != nil {
+			return err
+		}
+		agents = append(agents, agent)
+		return nil
+	})
+	return agents, err
+}
+
+// paginate runs query, which lists the connection of organization org, with
+// variables and calls onNode with every node of every page. It returns a
+// *PartialError if there are more than buildkiteMaxPages pages.
+func (a *BuildkiteAPI) paginate(ctx context.Context, org, query, connection string, variables map[string]interface{}, onNode func(json.RawMessage) error) error {
+	variables["org"] = org
+	nodes := 0
+	for page := 0; page < buildkiteMaxPages; page++ {
+		body, err := json.Marshal(map[string]interface{}{
+			"query":     query,
+			"variables": variables,
+		})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", a.Endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "buildscaler")
+		var res buildkiteGraphQLResponse
+		if _, err := getJSON(a.client, req, &res); err != nil {
+			return err
+		}
+		if len(res.Errors) > 0 {
+			return fmt.Errorf("Buildkite GraphQL query of organization %s failed: %s", org, res.Errors[0].Message)
+		}
+		if res.Data.Organization == nil {
+			return fmt.Errorf("Buildkite organization %s was not found", org)
+		}
+		conn := res.Data.Organization[connection]
+		for _, edge := range conn.Edges {
+			if err := onNode(edge.Node); err != nil {
+				return err
+			}
+			nodes++
+		}
+		if !conn.PageInfo.HasNextPage {
+			return nil
+		}
+		variables["after"] = conn.PageInfo.EndCursor
+	}
+	return &PartialError{Err: fmt.Errorf("Buildkite organization %s has more than %d %s, only the first ones are reported", org, nodes, connection)}
+}
@@ -0,0 +1,405 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+)
+
+// newBuildkiteAPIServer serves the agent metrics endpoint with the queues
+// default and deploy, and GraphQL queries at /graphql with pages of jobs.
+func newBuildkiteAPIServer(t *testing.T, pages ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metrics":
+			_, _ = io.WriteString(w, `{
+				"organization": {"slug": "acme"},
+				"jobs": {"queues": {"default": {"scheduled": 3}, "deploy": {}}},
+				"agents": {}
+			  }`)
+		case "/graphql":
+			assert.Equal(t, "POST", r.Method)
+			assert.Equal(t, "Bearer api-token", r.Header.Get("Authorization"))
+			var body struct {
+				Query     string                 `json:"query"`
+				Variables map[string]interface{} `json:"variables"`
+			}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "acme", body.Variables["org"])
+			page := 0
+			if body.Variables["after"] != nil {
+				page = 1
+			}
+			_, _ = fmt.Fprintf(w, `{"data": {"organization": {"jobs": %s}}}`, pages[page])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func buildkiteJobNode(state string, waiting time.Duration, rules string) string {
+	runnableAt := time.Now().Add(-waiting).UTC().Format(time.RFC3339)
+	return fmt.Sprintf(`{"node": {"state": %q, "scheduledAt": %q, "runnableAt": %q, "agentQueryRules": %s, "pipeline": {"slug": "app"}}}`,
+		state, runnableAt, runnableAt, rules)
+}
+
+func TestBuildkiteCollectorWaitTimes(t *testing.T) {
+	s := newBuildkiteAPIServer(t,
+		fmt.Sprintf(`{"pageInfo": {"hasNextPage": true, "endCursor": "abc"}, "edges": [%s, %s]}`,
+			buildkiteJobNode("SCHEDULED", 20*time.Minute, `["queue=default"]`),
+			buildkiteJobNode("SCHEDULED", 10*time.Second, `[]`)),
+		fmt.Sprintf(`{"pageInfo": {"hasNextPage": false}, "edges": [%s, %s]}`,
+			buildkiteJobNode("SCHEDULED", time.Minute, `["queue=default", "os=linux"]`),
+			buildkiteJobNode("SCHEDULED", 5*time.Minute, `["queue=macos"]`)),
+	)
+	defer s.Close()
+
+	c := &BuildkiteCollector{
+		Endpoint:  s.URL,
+		Token:     "abc123",
+		UserAgent: "some-client/1.2.3",
+		API:       NewBuildkiteAPI(s.URL+"/graphql", "api-token"),
+	}
+	c.API.WaitTimes = true
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+
+	for _, tc := range []struct {
+		name     string
+		set      map[string]string
+		expected int64
+	}{
+		{"buildkite_oldest_waiting_job_age_seconds", map[string]string{"org": "acme", "queue": "default"}, 1200},
+		{"buildkite_oldest_waiting_job_age_seconds", map[string]string{"queue": "macos"}, 300},
+		{"buildkite_oldest_waiting_job_age_seconds", map[string]string{"queue": "deploy"}, 0},
+		{"buildkite_waiting_job_age_seconds", map[string]string{"queue": "default", "quantile": "0.5"}, 60},
+		{"buildkite_waiting_job_age_seconds", map[string]string{"queue": "default", "quantile": "0.9"}, 1200},
+		{"buildkite_waiting_job_age_seconds", map[string]string{"queue": "default", "quantile": "0.99"}, 1200},
+		{"buildkite_waiting_job_age_seconds", map[string]string{"queue": "deploy", "quantile": "0.5"}, 0},
+	} {
+		series, ok := st.Get(tc.name, labels.SelectorFromSet(tc.set))
+		assert.True(t, ok, tc.name)
+		if assert.Len(t, series, 1, "%s%v", tc.name, tc.set) {
+			// Allow for the seconds elapsed since the jobs were generated.
+			assert.InDelta(t, tc.expected, series[0].Value.Value.Value(), 2, "%s%v", tc.name, tc.set)
+		}
+	}
+}
+
+func TestBuildkiteCollectorWaitTimesClusters(t *testing.T) {
+	node := func(cluster string, waiting time.Duration) string {
+		runnableAt := time.Now().Add(-waiting).UTC().Format(time.RFC3339)
+		return fmt.Sprintf(`{"node": {"state": "SCHEDULED", "runnableAt": %q, "agentQueryRules": ["queue=default"], "pipeline": {"slug": "app"}, "clusterQueue": {"cluster": {"name": %q}}}}`,
+			runnableAt, cluster)
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Token linux-token":
+			_, _ = io.WriteString(w, `{"organization": {"slug": "acme"}, "cluster": {"name": "linux"}, "jobs": {"queues": {"default": {}}}, "agents": {}}`)
+		case "Token macos-token":
+			_, _ = io.WriteString(w, `{"organization": {"slug": "acme"}, "cluster": {"name": "macos"}, "jobs": {"queues": {"default": {}, "deploy": {}}}, "agents": {}}`)
+		case "Bearer api-token":
+			_, _ = fmt.Fprintf(w, `{"data": {"organization": {"jobs": {"pageInfo": {"hasNextPage": false}, "edges": [%s, %s, %s]}}}}`,
+				node("linux", 10*time.Minute), node("macos", 2*time.Minute), node("macos", time.Minute))
+		}
+	}))
+	defer s.Close()
+
+	c := &BuildkiteCollector{
+		Endpoint:  s.URL,
+		UserAgent: "some-client/1.2.3",
+		Clusters:  []BuildkiteCluster{{Token: "linux-token"}, {Token: "macos-token"}},
+		API:       NewBuildkiteAPI(s.URL+"/graphql", "api-token"),
+	}
+	c.API.WaitTimes = true
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+
+	series, _ := st.Get("buildkite_oldest_waiting_job_age_seconds", labels.Everything())
+	assert.Len(t, series, 3)
+	for _, tc := range []struct {
+		set      map[string]string
+		expected int64
+	}{
+		{map[string]string{"org": "acme", "cluster": "linux", "queue": "default"}, 600},
+		{map[string]string{"org": "acme", "cluster": "macos", "queue": "default"}, 120},
+		{map[string]string{"org": "acme", "cluster": "macos", "queue": "deploy"}, 0},
+	} {
+		series, _ := st.Get("buildkite_oldest_waiting_job_age_seconds", labels.SelectorFromSet(tc.set))
+		if assert.Len(t, series, 1, "%v", tc.set) {
+			assert.InDelta(t, tc.expected, series[0].Value.Value.Value(), 2, "%v", tc.set)
+		}
+	}
+}
+
+func TestBuildkiteCollectorWaitTimesOrgAndClusters(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Token acme-token":
+			_, _ = io.WriteString(w, `{"organization": {"slug": "acme"}, "jobs": {"queues": {"default": {}, "legacy": {}}}, "agents": {}}`)
+		case "Token linux-token":
+			_, _ = io.WriteString(w, `{"organization": {"slug": "acme"}, "cluster": {"name": "linux"}, "jobs": {"queues": {"default": {}}}, "agents": {}}`)
+		case "Bearer api-token":
+			_, _ = io.WriteString(w, `{"data": {"organization": {"jobs": {"pageInfo": {"hasNextPage": false}, "edges": []}}}}`)
+		}
+	}))
+	defer s.Close()
+
+	c := &BuildkiteCollector{
+		Endpoint:  s.URL,
+		UserAgent: "some-client/1.2.3",
+		Orgs:      []BuildkiteOrg{{Token: "acme-token"}},
+		Clusters:  []BuildkiteCluster{{Token: "linux-token"}},
+		API:       NewBuildkiteAPI(s.URL+"/graphql", "api-token"),
+	}
+	c.API.WaitTimes = true
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+
+	// The default queue is the cluster's one, legacy is outside of clusters.
+	series, _ := st.Get("buildkite_oldest_waiting_job_age_seconds", labels.SelectorFromSet(map[string]string{"queue": "default"}))
+	if assert.Len(t, series, 1) {
+		assert.Equal(t, "linux", series[0].Value.MetricLabels["cluster"])
+	}
+	series, _ = st.Get("buildkite_oldest_waiting_job_age_seconds", labels.SelectorFromSet(map[string]string{"queue": "legacy"}))
+	assert.Len(t, series, 1)
+}
+
+func TestBuildkiteCollectorWaitTimesTruncated(t *testing.T) {
+	s := newBuildkiteAPIServer(t,
+		fmt.Sprintf(`{"pageInfo": {"hasNextPage": true, "endCursor": "abc"}, "edges": [%s]}`,
+			buildkiteJobNode("SCHEDULED", 20*time.Minute, `["queue=default"]`)),
+		fmt.Sprintf(`{"pageInfo": {"hasNextPage": true, "endCursor": "def"}, "edges": [%s]}`,
+			buildkiteJobNode("SCHEDULED", time.Minute, `["queue=default"]`)),
+	)
+	defer s.Close()
+
+	c := &BuildkiteCollector{
+		Endpoint:  s.URL,
+		Token:     "abc123",
+		UserAgent: "some-client/1.2.3",
+		API:       NewBuildkiteAPI(s.URL+"/graphql", "api-token"),
+	}
+	c.API.WaitTimes = true
+	snapshot, err := c.Collect(context.Background())
+	var partial *PartialError
+	if assert.True(t, errors.As(err, &partial), "got %v", err) {
+		assert.Contains(t, err.Error(), "has more than 10 jobs")
+	}
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+	series, _ := st.Get("buildkite_oldest_waiting_job_age_seconds", labels.SelectorFromSet(map[string]string{"queue": "default"}))
+	if assert.Len(t, series, 1) {
+		assert.InDelta(t, 1200, series[0].Value.Value.Value(), 2)
+	}
+}
+
+func TestBuildkiteCollectorJobBreakdown(t *testing.T) {
+	node := func(state, pipeline, rules string) string {
+		return fmt.Sprintf(`{"node": {"state": %q, "agentQueryRules": %s, "pipeline": {"slug": %q}}}`, state, rules, pipeline)
+	}
+	s := newBuildkiteAPIServer(t, fmt.Sprintf(`{"pageInfo": {"hasNextPage": false}, "edges": [%s, %s, %s, %s, %s]}`,
+		node("SCHEDULED", "app", `["queue=default", "os=linux", "arch=arm64"]`),
+		node("SCHEDULED", "app", `["queue=default", "os=linux", "arch=amd64"]`),
+		node("SCHEDULED", "web", `["os=linux", "arch=arm64", "docker"]`),
+		node("RUNNING", "web", `["queue=default", "os=linux", "arch=arm64"]`),
+		node("ACCEPTED", "app", `["queue=macos", "os=darwin"]`),
+	))
+	defer s.Close()
+
+	c := &BuildkiteCollector{
+		Endpoint:  s.URL,
+		Token:     "abc123",
+		UserAgent: "some-client/1.2.3",
+		API:       NewBuildkiteAPI(s.URL+"/graphql", "api-token"),
+	}
+	c.API.Pipelines = true
+	c.API.AgentQueryRules = []string{"os", "arch"}
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+
+	for _, tc := range []struct {
+		name     string
+		set      map[string]string
+		expected int64
+	}{
+		{"buildkite_pipeline_scheduled_jobs_count", map[string]string{"org": "acme", "queue": "default", "pipeline": "app"}, 2},
+		{"buildkite_pipeline_scheduled_jobs_count", map[string]string{"queue": "default", "pipeline": "web"}, 1},
+		{"buildkite_pipeline_running_jobs_count", map[string]string{"queue": "default", "pipeline": "web"}, 1},
+		{"buildkite_pipeline_running_jobs_count", map[string]string{"queue": "macos", "pipeline": "app"}, 1},
+		{"buildkite_agent_tags_scheduled_jobs_count", map[string]string{"queue": "default", "os": "linux", "arch": "arm64"}, 2},
+		{"buildkite_agent_tags_scheduled_jobs_count", map[string]string{"queue": "default", "os": "linux", "arch": "amd64"}, 1},
+		{"buildkite_agent_tags_running_jobs_count", map[string]string{"queue": "default", "os": "linux", "arch": "arm64"}, 1},
+		{"buildkite_agent_tags_running_jobs_count", map[string]string{"queue": "macos", "os": "darwin", "arch": ""}, 1},
+	} {
+		series, ok := st.Get(tc.name, labels.SelectorFromSet(tc.set))
+		assert.True(t, ok, tc.name)
+		if assert.Len(t, series, 1, "%s%v", tc.name, tc.set) {
+			assert.Equal(t, tc.expected, series[0].Value.Value.Value(), "%s%v", tc.name, tc.set)
+		}
+	}
+	for name, expected := range map[string]int64{
+		"buildkite_pipeline_total_scheduled_jobs_count": 3,
+		"buildkite_agent_tags_total_running_jobs_count": 2,
+	} {
+		series, ok := st.Get(name, labels.Everything())
+		assert.True(t, ok, name)
+		if assert.Len(t, series, 1, name) {
+			assert.Equal(t, expected, series[0].Value.Value.Value(), name)
+		}
+	}
+	_, ok := st.Get("buildkite_oldest_waiting_job_age_seconds", labels.Everything())
+	assert.False(t, ok)
+}
+
+func TestBuildkiteCollectorPipelineDisappears(t *testing.T) {
+	node := func(pipeline string) string {
+		return fmt.Sprintf(`{"node": {"state": "SCHEDULED", "agentQueryRules": ["queue=default"], "pipeline": {"slug": %q}}}`, pipeline)
+	}
+	jobs := fmt.Sprintf(`{"pageInfo": {"hasNextPage": false}, "edges": [%s, %s]}`, node("app"), node("web"))
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			_, _ = io.WriteString(w, `{"organization": {"slug": "acme"}, "jobs": {}, "agents": {}}`)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"data": {"organization": {"jobs": %s}}}`, jobs)
+	}))
+	defer s.Close()
+
+	c := &BuildkiteCollector{
+		Endpoint:  s.URL,
+		Token:     "abc123",
+		UserAgent: "some-client/1.2.3",
+		API:       NewBuildkiteAPI(s.URL+"/graphql", "api-token"),
+	}
+	c.API.Pipelines = true
+	st := storage.NewExternalMetricsMap()
+	scheduled := func() map[string]int64 {
+		snapshot, err := c.Collect(context.Background())
+		assert.NoError(t, err)
+		batch := snapshot.Batch()
+		batch.Source = "buildkite"
+		st.Commit(batch)
+		counts := map[string]int64{}
+		series, _ := st.Get("buildkite_pipeline_scheduled_jobs_count", labels.Everything())
+		for _, s := range series {
+			counts[s.Value.MetricLabels[BuildkitePipelineLabel]] = s.Value.Value.Value()
+		}
+		return counts
+	}
+	assert.Equal(t, map[string]int64{"app": 1, "web": 1}, scheduled())
+
+	// A pipeline without jobs reports 0 for a while, then disappears.
+	jobs = fmt.Sprintf(`{"pageInfo": {"hasNextPage": false}, "edges": [%s]}`, node("app"))
+	assert.Equal(t, map[string]int64{"app": 1, "web": 0}, scheduled())
+	for key, counted := range c.API.lastCounted["buildkite_pipeline_"] {
+		counted.at = counted.at.Add(-buildkiteZeroRetention - time.Minute)
+		c.API.lastCounted["buildkite_pipeline_"][key] = counted
+	}
+	assert.Equal(t, map[string]int64{"app": 1}, scheduled())
+}
+
+func TestBuildkiteCollectorAgents(t *testing.T) {
+	abcdeState := "connected"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			_, _ = io.WriteString(w, `{"organization": {"slug": "acme"}, "jobs": {}, "agents": {}}`)
+			return
+		}
+		var body struct {
+			Query string `json:"query"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Contains(t, body.Query, "agents(")
+		_, _ = fmt.Fprintf(w, `{"data": {"organization": {"agents": {"pageInfo": {"hasNextPage": false}, "edges": [
+{"node": {"hostname": "agent-7d9f-abcde", "connectionState": %q, "isRunningJob": true}},
+{"node": {"hostname": "agent-7d9f-fghij", "connectionState": "connected", "isRunningJob": false}},
+{"node": {"hostname": "agent-7d9f-klmno", "connectionState": "disconnected", "isRunningJob": false}},
+{"node": {"hostname": "", "connectionState": "connected", "isRunningJob": true}}
+]}}}}`, abcdeState)
+	}))
+	defer s.Close()
+
+	c := &BuildkiteCollector{
+		Endpoint:  s.URL,
+		Token:     "abc123",
+		UserAgent: "some-client/1.2.3",
+		API:       NewBuildkiteAPI(s.URL+"/graphql", "api-token"),
+	}
+	c.API.Agents = true
+	st := storage.NewExternalMetricsMap()
+	collect := func() {
+		snapshot, err := c.Collect(context.Background())
+		assert.NoError(t, err)
+		batch := snapshot.Batch()
+		batch.Source = "buildkite"
+		st.Commit(batch)
+	}
+	collect()
+
+	series, ok := st.Get("buildkite_agent_busy", labels.Everything())
+	assert.True(t, ok)
+	assert.Len(t, series, 2)
+	for pod, expected := range map[string]int64{"agent-7d9f-abcde": 1, "agent-7d9f-fghij": 0} {
+		series, _ := st.Get("buildkite_agent_busy", labels.SelectorFromSet(map[string]string{"org": "acme", "pod": pod}))
+		if assert.Len(t, series, 1, pod) {
+			assert.Equal(t, expected, series[0].Value.Value.Value(), pod)
+		}
+	}
+
+	// The series of an agent is gone once it disconnected.
+	abcdeState = "disconnected"
+	collect()
+	series, _ = st.Get("buildkite_agent_busy", labels.Everything())
+	if assert.Len(t, series, 1) {
+		assert.Equal(t, "agent-7d9f-fghij", series[0].Value.MetricLabels["pod"])
+	}
+}
+
+func TestBuildkiteAPIErrors(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"data": {"organization": null}, "errors": [{"message": "Field 'jobs' doesn't exist"}]}`)
+	}))
+	defer s.Close()
+	_, err := NewBuildkiteAPI(s.URL, "api-token").jobs(context.Background(), "acme", []string{buildkiteJobScheduled})
+	assert.EqualError(t, err, "Buildkite GraphQL query of organization acme failed: Field 'jobs' doesn't exist")
+}
+
+func TestQuantile(t *testing.T) {
+	assert.Equal(t, 0.0, quantile(nil, 0.5))
+	assert.Equal(t, 2.0, quantile([]float64{1, 2, 3, 4}, 0.5))
+	assert.Equal(t, 4.0, quantile([]float64{1, 2, 3, 4}, 0.9))
+	assert.Equal(t, 1.0, quantile([]float64{1, 2, 3, 4}, 0))
+}
@@ -3,11 +3,17 @@
 package collector
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 func TestCollectorWithEmptyResponseForAllQueues(t *testing.T) {
@@ -31,7 +37,7 @@ func TestCollectorWithEmptyResponseForAllQueues(t *testing.T) {
 		Token:     "abc123",
 		UserAgent: "some-client/1.2.3",
 	}
-	res, err := c.collect()
+	res, err := c.collect(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -93,7 +99,7 @@ func TestCollectorWithNoJobsForAllQueues(t *testing.T) {
 		Token:     "abc123",
 		UserAgent: "some-client/1.2.3",
 	}
-	res, err := c.collect()
+	res, err := c.collect(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -172,7 +178,7 @@ func TestCollectorWithSomeJobsAndAgentsForAllQueues(t *testing.T) {
 		Token:     "abc123",
 		UserAgent: "some-client/1.2.3",
 	}
-	res, err := c.collect()
+	res, err := c.collect(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -252,7 +258,7 @@ func TestCollectorWithSomeJobsAndAgentsForAQueue(t *testing.T) {
 		UserAgent: "some-client/1.2.3",
 		Queues:    []string{"deploy"},
 	}
-	res, err := c.collect()
+	res, err := c.collect(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -282,3 +288,368 @@ func TestCollectorWithSomeJobsAndAgentsForAQueue(t *testing.T) {
 		})
 	}
 }
+
+func TestCollectStoresOneSeriesPerQueue(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			w.WriteHeader(http.StatusOK)
+			_, _ = io.WriteString(w, `{
+				"organization": {
+				  "slug": "test"
+				},
+				"jobs": {
+				  "scheduled": 3,
+				  "running": 0,
+				  "waiting": 3,
+				  "total": 3,
+				  "queues": {
+					"default": {
+					  "scheduled": 2,
+					  "waiting": 2,
+					  "total": 2
+					},
+					"deploy": {
+					  "scheduled": 1,
+					  "waiting": 1,
+					  "total": 1
+					}
+				  }
+				},
+				"agents": {}
+			  }`)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+	st := storage.NewExternalMetricsMap()
+	c := &BuildkiteCollector{
+		Endpoint:  s.URL,
+		Token:     "abc123",
+		UserAgent: "some-client/1.2.3",
+	}
+	snapshot, err := c.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Commit(snapshot.Batch())
+	for queue, expected := range map[string]int64{"default": 2, "deploy": 1} {
+		values, ok := st.Get("buildkite_waiting_jobs_count", labels.SelectorFromSet(map[string]string{"queue": queue}))
+		if !ok || len(values) != 1 {
+			t.Fatalf("expected one series for queue %s, got %v", queue, values)
+		}
+		if got := values[0].Value.Value.Value(); got != expected {
+			t.Fatalf("buildkite_waiting_jobs_count{queue=%s} was %d; want %d", queue, got, expected)
+		}
+	}
+	// A single token reports its totals without labels.
+	values, ok := st.Get("buildkite_total_waiting_jobs_count", labels.Everything())
+	if !ok || len(values) != 1 || len(values[0].Value.MetricLabels) != 0 {
+		t.Fatalf("expected one unlabeled buildkite_total_waiting_jobs_count series, got %v", values)
+	}
+	// They are the totals across all organizations too.
+	if values, ok := st.Get("buildkite_all_orgs_total_waiting_jobs_count", labels.Everything()); ok {
+		t.Fatalf("expected no buildkite_all_orgs_total_waiting_jobs_count series, got %v", values)
+	}
+}
+
+func TestCollectReturnsPollDuration(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(PollDurationHeader, "30")
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, `{"organization": {"slug": "test"}, "jobs": {}, "agents": {}}`)
+	}))
+	defer s.Close()
+	c := &BuildkiteCollector{
+		Endpoint:  s.URL,
+		Token:     "abc123",
+		UserAgent: "some-client/1.2.3",
+	}
+	snapshot, err := c.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.PollAfter != 30*time.Second {
+		t.Fatalf("PollAfter was %s; want 30s", snapshot.PollAfter)
+	}
+}
+
+func TestCollectReturnsRateLimitError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer s.Close()
+	for _, queues := range [][]string{nil, {"default"}} {
+		c := &BuildkiteCollector{
+			Endpoint:  s.URL,
+			Token:     "abc123",
+			UserAgent: "some-client/1.2.3",
+			Queues:    queues,
+		}
+		_, err := c.Collect(context.Background())
+		var rateLimited *RateLimitError
+		if !errors.As(err, &rateLimited) {
+			t.Fatalf("expected a rate limit error for queues %v, got %v", queues, err)
+		}
+		if rateLimited.RetryAfter != time.Minute {
+			t.Fatalf("RetryAfter was %s; want 1m0s", rateLimited.RetryAfter)
+		}
+	}
+}
+
+func TestCollectLabelsClusterQueues(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		switch r.Header.Get("Authorization") {
+		case "Token linux-token":
+			_, _ = io.WriteString(w, `{
+				"organization": {"slug": "test"},
+				"cluster": {"name": "linux"},
+				"jobs": {"scheduled": 2, "queues": {"default": {"scheduled": 2}}},
+				"agents": {}
+			  }`)
+		case "Token macos-token":
+			_, _ = io.WriteString(w, `{
+				"organization": {"slug": "test"},
+				"cluster": {"name": "macos"},
+				"jobs": {"scheduled": 5, "queues": {"default": {"scheduled": 5}}},
+				"agents": {}
+			  }`)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer s.Close()
+	st := storage.NewExternalMetricsMap()
+	c := &BuildkiteCollector{
+		Endpoint:  s.URL,
+		UserAgent: "some-client/1.2.3",
+		Clusters: []BuildkiteCluster{
+			{Token: "linux-token"},
+			{Name: "mac", Token: "macos-token"},
+		},
+	}
+	snapshot, err := c.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Commit(snapshot.Batch())
+	for cluster, expected := range map[string]int64{"linux": 2, "mac": 5} {
+		set := map[string]string{"cluster": cluster, "queue": "default"}
+		values, ok := st.Get("buildkite_scheduled_jobs_count", labels.SelectorFromSet(set))
+		if !ok || len(values) != 1 {
+			t.Fatalf("expected one series for %v, got %v", set, values)
+		}
+		if got := values[0].Value.Value.Value(); got != expected {
+			t.Fatalf("buildkite_scheduled_jobs_count%v was %d; want %d", set, got, expected)
+		}
+		values, ok = st.Get("buildkite_total_scheduled_jobs_count", labels.SelectorFromSet(map[string]string{"cluster": cluster}))
+		if !ok || len(values) != 1 || values[0].Value.Value.Value() != expected {
+			t.Fatalf("expected a total of %d for cluster %s, got %v", expected, cluster, values)
+		}
+	}
+
+	c.Clusters = []BuildkiteCluster{{Token: "unknown-token"}}
+	if _, err := c.Collect(context.Background()); err == nil {
+		t.Fatal("expected an error for an unauthorized cluster token")
+	}
+}
+
+func TestCollectLabelsOrgs(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		switch r.Header.Get("Authorization") {
+		case "Token acme-token":
+			_, _ = io.WriteString(w, `{
+				"organization": {"slug": "acme"},
+				"jobs": {"scheduled": 2, "queues": {"default": {"scheduled": 2}}},
+				"agents": {"busy": 1, "total": 4}
+			  }`)
+		case "Token globex-token":
+			_, _ = io.WriteString(w, `{
+				"organization": {"slug": "globex"},
+				"jobs": {"scheduled": 5, "queues": {"default": {"scheduled": 5}}},
+				"agents": {"busy": 3, "total": 4}
+			  }`)
+		}
+	}))
+	defer s.Close()
+	st := storage.NewExternalMetricsMap()
+	c := &BuildkiteCollector{
+		Endpoint:  s.URL,
+		UserAgent: "some-client/1.2.3",
+		Orgs:      []BuildkiteOrg{{Token: "acme-token"}, {Token: "globex-token"}},
+	}
+	snapshot, err := c.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Commit(snapshot.Batch())
+	for _, tc := range []struct {
+		name     string
+		set      map[string]string
+		expected int64
+	}{
+		{"buildkite_scheduled_jobs_count", map[string]string{"org": "acme", "queue": "default"}, 2},
+		{"buildkite_scheduled_jobs_count", map[string]string{"org": "globex", "queue": "default"}, 5},
+		{"buildkite_total_scheduled_jobs_count", map[string]string{"org": "acme"}, 2},
+		{"buildkite_total_busy_agent_percentage", map[string]string{"org": "globex"}, 75},
+		{"buildkite_all_orgs_total_scheduled_jobs_count", nil, 7},
+		{"buildkite_all_orgs_total_busy_agent_percentage", nil, 50},
+	} {
+		values, ok := st.Get(tc.name, labels.SelectorFromSet(tc.set))
+		if !ok || len(values) != 1 {
+			t.Fatalf("expected one series for %s%v, got %v", tc.name, tc.set, values)
+		}
+		if got := values[0].Value.Value.Value(); got != tc.expected {
+			t.Fatalf("%s%v was %d; want %d", tc.name, tc.set, got, tc.expected)
+		}
+	}
+
+	c.Orgs = []BuildkiteOrg{{Token: "acme-token"}, {Token: "acme-token"}}
+	if _, err := c.Collect(context.Background()); err == nil {
+		t.Fatal("expected an error for an org scraped twice")
+	}
+}
+
+func TestCollectOrgsPartialFailure(t *testing.T) {
+	globexDown := false
+	acmeScheduled := 2
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Token acme-token":
+			_, _ = fmt.Fprintf(w, `{
+				"organization": {"slug": "acme"},
+				"jobs": {"scheduled": %d, "queues": {"default": {"scheduled": %d}}},
+				"agents": {}
+			  }`, acmeScheduled, acmeScheduled)
+		case "Token globex-token":
+			if globexDown {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = io.WriteString(w, `{
+				"organization": {"slug": "globex"},
+				"jobs": {"scheduled": 5, "queues": {"default": {"scheduled": 5}}},
+				"agents": {}
+			  }`)
+		}
+	}))
+	defer s.Close()
+	st := storage.NewExternalMetricsMap()
+	c := &BuildkiteCollector{
+		Endpoint:  s.URL,
+		UserAgent: "some-client/1.2.3",
+		Orgs:      []BuildkiteOrg{{Token: "acme-token"}, {Token: "globex-token"}},
+	}
+	commit := func(snapshot Snapshot) {
+		batch := snapshot.Batch()
+		batch.Source = "buildkite"
+		st.Commit(batch)
+	}
+	snapshot, err := c.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit(snapshot)
+
+	globexDown = true
+	acmeScheduled = 3
+	snapshot, err = c.Collect(context.Background())
+	var partial *PartialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("expected a partial error, got %v", err)
+	}
+	commit(snapshot)
+	for _, tc := range []struct {
+		name     string
+		set      map[string]string
+		expected int64
+	}{
+		{"buildkite_scheduled_jobs_count", map[string]string{"org": "acme", "queue": "default"}, 3},
+		{"buildkite_scheduled_jobs_count", map[string]string{"org": "globex", "queue": "default"}, 5},
+		{"buildkite_total_scheduled_jobs_count", map[string]string{"org": "globex"}, 5},
+		{"buildkite_all_orgs_total_scheduled_jobs_count", nil, 7},
+	} {
+		values, ok := st.Get(tc.name, labels.SelectorFromSet(tc.set))
+		if !ok || len(values) != 1 {
+			t.Fatalf("expected one series for %s%v, got %v", tc.name, tc.set, values)
+		}
+		if got := values[0].Value.Value.Value(); got != tc.expected {
+			t.Fatalf("%s%v was %d; want %d", tc.name, tc.set, got, tc.expected)
+		}
+	}
+
+	c.Orgs[0].Token = "unknown-token"
+	if _, err := c.Collect(context.Background()); err == nil || errors.As(err, &partial) {
+		t.Fatalf("expected a complete failure, got %v", err)
+	}
+}
+
+func TestCollectOrgFailureRetainsOnlyOrgSeries(t *testing.T) {
+	acmeDown := false
+	linuxQueue := "old"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Token acme-token":
+			if acmeDown {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = io.WriteString(w, `{
+				"organization": {"slug": "acme"},
+				"jobs": {"scheduled": 2, "queues": {"default": {"scheduled": 2}}},
+				"agents": {}
+			  }`)
+		case "Token linux-token":
+			_, _ = fmt.Fprintf(w, `{
+				"organization": {"slug": "acme"},
+				"cluster": {"name": "linux"},
+				"jobs": {"scheduled": 1, "queues": {%q: {"scheduled": 1}}},
+				"agents": {}
+			  }`, linuxQueue)
+		}
+	}))
+	defer s.Close()
+	st := storage.NewExternalMetricsMap()
+	c := &BuildkiteCollector{
+		Endpoint:  s.URL,
+		UserAgent: "some-client/1.2.3",
+		Orgs:      []BuildkiteOrg{{Token: "acme-token"}},
+		Clusters:  []BuildkiteCluster{{Token: "linux-token"}},
+	}
+	commit := func(snapshot Snapshot) {
+		batch := snapshot.Batch()
+		batch.Source = "buildkite"
+		st.Commit(batch)
+	}
+	snapshot, err := c.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit(snapshot)
+
+	acmeDown = true
+	linuxQueue = "default"
+	snapshot, err = c.Collect(context.Background())
+	var partial *PartialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("expected a partial error, got %v", err)
+	}
+	commit(snapshot)
+	for _, tc := range []struct {
+		set      map[string]string
+		expected int
+	}{
+		// The retained series of the org token, and the cluster's one.
+		{map[string]string{"org": "acme", "queue": "default"}, 2},
+		// The cluster no longer reports the old queue.
+		{map[string]string{"org": "acme", "cluster": "linux", "queue": "old"}, 0},
+	} {
+		values, _ := st.Get("buildkite_scheduled_jobs_count", labels.SelectorFromSet(tc.set))
+		if len(values) != tc.expected {
+			t.Fatalf("expected %d series for %v, got %v", tc.expected, tc.set, values)
+		}
+	}
+}
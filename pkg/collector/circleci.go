@@ -22,9 +22,7 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/elotl/buildscaler/pkg/storage"
 	"k8s.io/apimachinery/pkg/api/resource"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 )
 
@@ -87,7 +85,8 @@ type CircleCIClient struct {
 	token        string
 }
 
-func (cc *CircleCIClient) doRequest(req *http.Request, nextPageToken string) (*http.Response, error) {
+func (cc *CircleCIClient) doRequest(ctx context.Context, req *http.Request, nextPageToken string) (*http.Response, error) {
+	req = req.WithContext(ctx)
 	req.Header = make(map[string][]string)
 	req.Header.Set("Circle-Token", cc.token)
 	if nextPageToken != "" {
@@ -97,7 +96,15 @@ func (cc *CircleCIClient) doRequest(req *http.Request, nextPageToken string) (*h
 	}
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-Type", "application/json")
-	return cc.httpClient.Do(req)
+	resp, err := cc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := rateLimitError(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
 }
 
 func isPipelineTooOld(pipeline *ProjectPipeline, maxAge time.Duration) bool {
@@ -105,12 +112,12 @@ func isPipelineTooOld(pipeline *ProjectPipeline, maxAge time.Duration) bool {
 	return pipeline.UpdatedAt.Before(ageThreshold)
 }
 
-func (cc *CircleCIClient) request() (*PaginatedProjectPipeline, error) {
+func (cc *CircleCIClient) request(ctx context.Context) (*PaginatedProjectPipeline, error) {
 	req := &http.Request{
 		Method: "GET",
 		URL:    cc.pipelinesURL,
 	}
-	resp, err := cc.doRequest(req, "")
+	resp, err := cc.doRequest(ctx, req, "")
 	if err != nil {
 		return nil, err
 	}
@@ -128,10 +135,10 @@ func (cc *CircleCIClient) request() (*PaginatedProjectPipeline, error) {
 	return &paginatedResp, nil
 }
 
-func (cc *CircleCIClient) listProjectPipelines(maxAge time.Duration) ([]ProjectPipeline, error) {
+func (cc *CircleCIClient) listProjectPipelines(ctx context.Context, maxAge time.Duration) ([]ProjectPipeline, error) {
 	projectPipelines := make([]ProjectPipeline, 0)
 
-	var paginatedResp, err = cc.request()
+	var paginatedResp, err = cc.request(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -149,7 +156,7 @@ func (cc *CircleCIClient) listProjectPipelines(maxAge time.Duration) ([]ProjectP
 		return projectPipelines, nil
 	}
 	for nextToken != "" {
-		paginatedResp, err = cc.request()
+		paginatedResp, err = cc.request(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -170,12 +177,12 @@ func (cc *CircleCIClient) listProjectPipelines(maxAge time.Duration) ([]ProjectP
 	return projectPipelines, nil
 }
 
-func (cc *CircleCIClient) doListPipelineWorkflowsReq(workflowsURL *url.URL, nextToken string) (string, []PipelineWorkflow, error) {
+func (cc *CircleCIClient) doListPipelineWorkflowsReq(ctx context.Context, workflowsURL *url.URL, nextToken string) (string, []PipelineWorkflow, error) {
 	req := &http.Request{
 		Method: "GET",
 		URL:    workflowsURL,
 	}
-	resp, err := cc.doRequest(req, nextToken)
+	resp, err := cc.doRequest(ctx, req, nextToken)
 	if err != nil {
 		return "", nil, err
 	}
@@ -192,20 +199,20 @@ func (cc *CircleCIClient) doListPipelineWorkflowsReq(workflowsURL *url.URL, next
 	return paginatedResp.NextPageToken, paginatedResp.Items, nil
 }
 
-func (cc *CircleCIClient) listPipelineWorkflows(pipelineID string) ([]PipelineWorkflow, error) {
+func (cc *CircleCIClient) listPipelineWorkflows(ctx context.Context, pipelineID string) ([]PipelineWorkflow, error) {
 	var pipelinesWorkflows []PipelineWorkflow
 	workflowsURL, err := buildPipelineWorkflowsURL(cc.endpoint, pipelineID)
 	if err != nil {
 		return nil, err
 
 	}
-	nextToken, workflows, err := cc.doListPipelineWorkflowsReq(workflowsURL, "")
+	nextToken, workflows, err := cc.doListPipelineWorkflowsReq(ctx, workflowsURL, "")
 	if err != nil {
 		return nil, err
 	}
 	pipelinesWorkflows = append(pipelinesWorkflows, workflows...)
 	for nextToken != "" {
-		newNextToken, workflows, err := cc.doListPipelineWorkflowsReq(workflowsURL, nextToken)
+		newNextToken, workflows, err := cc.doListPipelineWorkflowsReq(ctx, workflowsURL, nextToken)
 		if err != nil {
 			return nil, err
 		}
@@ -215,12 +222,12 @@ func (cc *CircleCIClient) listPipelineWorkflows(pipelineID string) ([]PipelineWo
 	return pipelinesWorkflows, nil
 }
 
-func (cc *CircleCIClient) doListWorkflowJobs(jobsURL *url.URL, nextToken string) (string, []WorkflowJob, error) {
+func (cc *CircleCIClient) doListWorkflowJobs(ctx context.Context, jobsURL *url.URL, nextToken string) (string, []WorkflowJob, error) {
 	req := &http.Request{
 		Method: "GET",
 		URL:    jobsURL,
 	}
-	resp, err := cc.doRequest(req, "")
+	resp, err := cc.doRequest(ctx, req, "")
 	if err != nil {
 		return "", nil, err
 	}
@@ -237,19 +244,19 @@ func (cc *CircleCIClient) doListWorkflowJobs(jobsURL *url.URL, nextToken string)
 	return paginatedResp.NextPageToken, paginatedResp.Items, nil
 }
 
-func (cc *CircleCIClient) listWorkflowJobs(workflowID string) ([]WorkflowJob, error) {
+func (cc *CircleCIClient) listWorkflowJobs(ctx context.Context, workflowID string) ([]WorkflowJob, error) {
 	jobsURL, err := BuildWorkflowJobsURL(cc.endpoint, workflowID)
 	if err != nil {
 		return nil, err
 	}
 	var jobs []WorkflowJob
-	nextToken, workflowJobs, err := cc.doListWorkflowJobs(jobsURL, "")
+	nextToken, workflowJobs, err := cc.doListWorkflowJobs(ctx, jobsURL, "")
 	if err != nil {
 		return nil, err
 	}
 	jobs = append(jobs, workflowJobs...)
 	for nextToken != "" {
-		newNextToken, workflowJobs, err := cc.doListWorkflowJobs(jobsURL, "")
+		newNextToken, workflowJobs, err := cc.doListWorkflowJobs(ctx, jobsURL, "")
 		if err != nil {
 			return nil, err
 		}
@@ -265,7 +272,6 @@ type CircleCICollector struct {
 	maxPipelineAge time.Duration
 	client         *CircleCIClient
 	projectSlug    string
-	storage        *storage.ExternalMetricsMap
 }
 
 func buildProjectPipelinesURL(endpoint, projectSlug string) (*url.URL, error) {
@@ -280,8 +286,8 @@ func BuildWorkflowJobsURL(endpoint, workflowID string) (*url.URL, error) {
 	return url.Parse(endpoint + "/workflow/" + workflowID + "/job")
 }
 
-func NewCircleCICollector(token, projectSlug string, maxPipelineAge time.Duration, storage *storage.ExternalMetricsMap) (*CircleCICollector, error) {
-	pipelinesURL, err := buildProjectPipelinesURL(CircleCIAPIEndpoint, projectSlug)
+func NewCircleCICollector(token, projectSlug, endpoint string, maxPipelineAge time.Duration) (*CircleCICollector, error) {
+	pipelinesURL, err := buildProjectPipelinesURL(endpoint, projectSlug)
 	if err != nil {
 		return nil, err
 	}
@@ -290,36 +296,38 @@ func NewCircleCICollector(token, projectSlug string, maxPipelineAge time.Duratio
 		httpClient: http.Client{
 			Timeout: time.Second * 5,
 		},
+		endpoint:     endpoint,
 		token:        token,
 		pipelinesURL: pipelinesURL,
 	}
-	return &CircleCICollector{client: client, maxPipelineAge: maxPipelineAge, projectSlug: projectSlug, storage: storage}, nil
+	return &CircleCICollector{client: client, maxPipelineAge: maxPipelineAge, projectSlug: projectSlug}, nil
 }
 
-func (c *CircleCICollector) Collect(cancel context.CancelFunc) error {
+func (c *CircleCICollector) Collect(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
 	// 1. Get a list of all pipelines in the project
 	// 2. Filter only pipelines newer than now - maxPipelineAge
 	// 3. Get all workflows for each pipeline
 	// 4. Scrape list of workflow ids
 	// 5. Loop over workflow ids and get all jobs for each workflow
 	// 6. Calculate: Running / Pending jobs
-	// 7. Store in c.storage as External Metrics
-	pipelines, err := c.client.listProjectPipelines(c.maxPipelineAge)
+	// 7. Return them as External Metrics
+	pipelines, err := c.client.listProjectPipelines(ctx, c.maxPipelineAge)
 	if err != nil {
-		return err
+		return snapshot, err
 	}
 	var jobs []WorkflowJob
 	var result WorkflowReport
 
 	for _, pipeline := range pipelines {
-		workflows, err := c.client.listPipelineWorkflows(pipeline.PipelineID)
+		workflows, err := c.client.listPipelineWorkflows(ctx, pipeline.PipelineID)
 		if err != nil {
-			return err
+			return snapshot, err
 		}
 		for _, workflow := range workflows {
-			workflowJobs, err := c.client.listWorkflowJobs(workflow.ID)
+			workflowJobs, err := c.client.listWorkflowJobs(ctx, workflow.ID)
 			if err != nil {
-				return err
+				return snapshot, err
 			}
 			jobs = append(jobs, workflowJobs...)
 		}
@@ -334,29 +342,26 @@ func (c *CircleCICollector) Collect(cancel context.CancelFunc) error {
 			result.JobsWaiting++
 		}
 	}
-	c.storage.OverrideOrStore(ExternalMetricsJobsRunningName, external_metrics.ExternalMetricValue{
+	snapshot.Add(external_metrics.ExternalMetricValue{
 		MetricName: ExternalMetricsJobsRunningName,
 		MetricLabels: map[string]string{
 			"project_slug": c.projectSlug,
 		},
-		Timestamp: v1.NewTime(time.Now()),
-		Value:     resource.MustParse(strconv.Itoa(int(result.JobsRunning))),
+		Value: resource.MustParse(strconv.Itoa(int(result.JobsRunning))),
 	})
-	c.storage.OverrideOrStore(ExternalMetricsJobsWaitingName, external_metrics.ExternalMetricValue{
+	snapshot.Add(external_metrics.ExternalMetricValue{
 		MetricName: ExternalMetricsJobsWaitingName,
 		MetricLabels: map[string]string{
 			"project_slug": c.projectSlug,
 		},
-		Timestamp: v1.NewTime(time.Now()),
-		Value:     resource.MustParse(strconv.Itoa(int(result.JobsWaiting))),
+		Value: resource.MustParse(strconv.Itoa(int(result.JobsWaiting))),
 	})
-	c.storage.OverrideOrStore(ExternalMetricsJobsFailedName, external_metrics.ExternalMetricValue{
+	snapshot.Add(external_metrics.ExternalMetricValue{
 		MetricName: ExternalMetricsJobsFailedName,
 		MetricLabels: map[string]string{
 			"project_slug": c.projectSlug,
 		},
-		Timestamp: v1.NewTime(time.Now()),
-		Value:     resource.MustParse(strconv.Itoa(int(result.JobsFailed))),
+		Value: resource.MustParse(strconv.Itoa(int(result.JobsFailed))),
 	})
-	return nil
+	return snapshot, nil
 }
@@ -19,14 +19,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"sync"
 	"testing"
 	"time"
 
 	"github.com/elotl/buildscaler/pkg/storage"
 	"github.com/stretchr/testify/assert"
 	"k8s.io/apimachinery/pkg/api/resource"
-	"k8s.io/metrics/pkg/apis/external_metrics"
 )
 
 func TestCircleCIScraper_Scrape(t *testing.T) {
@@ -143,10 +141,7 @@ func TestCircleCIScraper_Scrape(t *testing.T) {
 			w.WriteHeader(http.StatusNotFound)
 		}
 	}))
-	st := &storage.ExternalMetricsMap{
-		RWMutex: &sync.RWMutex{},
-		Data:    make(map[string]external_metrics.ExternalMetricValue),
-	}
+	st := storage.NewExternalMetricsMap()
 	pipelinesURL, err := url.Parse(s.URL + "/project/project-slug/pipeline")
 	assert.NoError(t, err)
 	client := &CircleCIClient{
@@ -156,18 +151,16 @@ func TestCircleCIScraper_Scrape(t *testing.T) {
 		token:        "dummy",
 	}
 	sc := &CircleCICollector{
-		maxPipelineAge: time.Hour * 24000,
+		maxPipelineAge: time.Since(time.Date(2010, time.January, 1, 0, 0, 0, 0, time.UTC)),
 		client:         client,
 		projectSlug:    "project-slug",
-		storage:        st,
 	}
-	err = sc.Collect(context.CancelFunc(func() {}))
+	snapshot, err := sc.Collect(context.Background())
 	assert.NoError(t, err)
-	sc.storage.RWMutex.RLock()
-	defer sc.storage.RWMutex.RUnlock()
-	failedMetric := sc.storage.Data[ExternalMetricsJobsFailedName]
-	runningMetric := sc.storage.Data[ExternalMetricsJobsRunningName]
-	waitingMetric := sc.storage.Data[ExternalMetricsJobsWaitingName]
+	st.Commit(snapshot.Batch())
+	failedMetric := st.Data[ExternalMetricsJobsFailedName]["project_slug=project-slug"].Value
+	runningMetric := st.Data[ExternalMetricsJobsRunningName]["project_slug=project-slug"].Value
+	waitingMetric := st.Data[ExternalMetricsJobsWaitingName]["project_slug=project-slug"].Value
 	assert.Equal(t, resource.MustParse("1"), failedMetric.Value)
 	assert.Equal(t, resource.MustParse("2"), runningMetric.Value)
 	assert.Equal(t, resource.MustParse("2"), waitingMetric.Value)
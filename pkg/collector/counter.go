@@ -0,0 +1,76 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+)
+
+// seriesCounter counts occurrences per metric and label set. Every metric is
+// reported for every label set seen, so e.g. a namespace without pending pods
+// reports 0 instead of no value, and in total without labels.
+type seriesCounter struct {
+	prefix string
+	names  []string
+	labels map[string]map[string]string
+	counts map[string]map[string]int64
+}
+
+func newSeriesCounter(prefix string, names ...string) *seriesCounter {
+	return &seriesCounter{
+		prefix: prefix,
+		names:  names,
+		labels: map[string]map[string]string{},
+		counts: map[string]map[string]int64{},
+	}
+}
+
+func (s *seriesCounter) inc(name string, labels map[string]string) {
+	key := storage.SeriesKey(labels)
+	s.labels[key] = labels
+	if s.counts[name] == nil {
+		s.counts[name] = map[string]int64{}
+	}
+	s.counts[name][key]++
+}
+
+// keep reports every metric for labels, even if nothing is counted for it.
+func (s *seriesCounter) keep(labels map[string]string) {
+	key := storage.SeriesKey(labels)
+	if _, ok := s.labels[key]; !ok {
+		s.labels[key] = labels
+	}
+}
+
+func (s *seriesCounter) addTo(snapshot *Snapshot) {
+	for _, name := range s.names {
+		var total int64
+		for key, labels := range s.labels {
+			value := s.counts[name][key]
+			total += value
+			snapshot.Add(external_metrics.ExternalMetricValue{
+				MetricName:   s.prefix + name,
+				MetricLabels: labels,
+				Value:        *resource.NewQuantity(value, resource.DecimalSI),
+			})
+		}
+		snapshot.Add(external_metrics.ExternalMetricValue{
+			MetricName: s.prefix + "total_" + name,
+			Value:      *resource.NewQuantity(total, resource.DecimalSI),
+		})
+	}
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeriesCounter(t *testing.T) {
+	counter := newSeriesCounter("ci_", "pending_count", "running_count")
+	counter.inc("pending_count", map[string]string{"namespace": "a"})
+	counter.inc("pending_count", map[string]string{"namespace": "a"})
+	counter.inc("running_count", map[string]string{"namespace": "b"})
+	counter.keep(map[string]string{"namespace": "c"})
+	counter.keep(map[string]string{"namespace": "a"})
+	var snapshot Snapshot
+	counter.addTo(&snapshot)
+
+	values := map[string]int64{}
+	for _, m := range snapshot.Metrics {
+		values[m.MetricName+"/"+m.MetricLabels["namespace"]] = m.Value.Value()
+	}
+	assert.Equal(t, map[string]int64{
+		"ci_pending_count/a":      2,
+		"ci_pending_count/b":      0,
+		"ci_pending_count/c":      0,
+		"ci_total_pending_count/": 2,
+		"ci_running_count/a":      0,
+		"ci_running_count/b":      1,
+		"ci_running_count/c":      0,
+		"ci_total_running_count/": 1,
+	}, values)
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	DronePlatformLabel = "platform"
+
+	DroneServer      = "drone"
+	WoodpeckerServer = "woodpecker"
+
+	droneStatusPending = "pending"
+	droneStatusRunning = "running"
+)
+
+// droneStage is a stage of the Drone /api/queue response.
+type droneStage struct {
+	Status  string            `json:"status"`
+	OS      string            `json:"os"`
+	Arch    string            `json:"arch"`
+	Variant string            `json:"variant"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// woodpeckerTask is a task of the Woodpecker /api/queue/info response, whose
+// labels include the platform as os/arch.
+type woodpeckerTask struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// droneBuild is a build of the Drone /api/builds/incomplete response, which
+// lists repositories with their incomplete build, or of the Woodpecker
+// /api/builds response.
+type droneBuild struct {
+	Status string `json:"status"`
+	Build  *struct {
+		Status string `json:"status"`
+	} `json:"build"`
+}
+
+func (b droneBuild) status() string {
+	if b.Build != nil {
+		return b.Build.Status
+	}
+	return b.Status
+}
+
+type woodpeckerQueueInfo struct {
+	Pending       []woodpeckerTask `json:"pending"`
+	WaitingOnDeps []woodpeckerTask `json:"waiting_on_deps"`
+	Running       []woodpeckerTask `json:"running"`
+}
+
+// DroneCollector reports the pending and running stages of a Drone or
+// Woodpecker server, per platform and per the stage labels in Labels, so
+// that Kubernetes runners can be scaled like Buildkite agents. The pending and
+// running builds are reported in total. Both require an admin token.
+type DroneCollector struct {
+	Endpoint string
+	Token    string
+	// Server is DroneServer or WoodpeckerServer, it is also the prefix of
+	// the metric names.
+	Server string
+	// Labels are the stage labels every series is labeled with.
+	Labels []string
+
+	client *http.Client
+}
+
+func NewDroneCollector(server, endpoint, token string, labels []string) *DroneCollector {
+	return &DroneCollector{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Token:    token,
+		Server:   server,
+		Labels:   labels,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *DroneCollector) Collect(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
+	counter := newSeriesCounter(c.Server+"_", "pending_stages_count", "running_stages_count")
+	if c.Server == WoodpeckerServer {
+		var info woodpeckerQueueInfo
+		if err := c.get(ctx, "/api/queue/info", &info); err != nil {
+			return snapshot, err
+		}
+		// Tasks waiting for the stages they depend on are not ready to
+		// run, but will need an agent as well.
+		for _, tasks := range [][]woodpeckerTask{info.Pending, info.WaitingOnDeps} {
+			for _, task := range tasks {
+				counter.inc("pending_stages_count", c.seriesLabels(task.platform(), task.Labels))
+			}
+		}
+		for _, task := range info.Running {
+			counter.inc("running_stages_count", c.seriesLabels(task.platform(), task.Labels))
+		}
+	} else {
+		var stages []droneStage
+		if err := c.get(ctx, "/api/queue", &stages); err != nil {
+			return snapshot, err
+		}
+		for _, stage := range stages {
+			labels := c.seriesLabels(stage.platform(), stage.Labels)
+			switch stage.Status {
+			case droneStatusPending:
+				counter.inc("pending_stages_count", labels)
+			case droneStatusRunning:
+				counter.inc("running_stages_count", labels)
+			}
+		}
+	}
+	counter.addTo(&snapshot)
+
+	path := "/api/builds/incomplete"
+	if c.Server == WoodpeckerServer {
+		path = "/api/builds"
+	}
+	var builds []droneBuild
+	if err := c.get(ctx, path, &builds); err != nil {
+		return snapshot, err
+	}
+	var pending, running int64
+	for _, build := range builds {
+		switch build.status() {
+		case droneStatusPending:
+			pending++
+		case droneStatusRunning:
+			running++
+		}
+	}
+	for name, value := range map[string]int64{
+		"pending_builds_count": pending,
+		"running_builds_count": running,
+	} {
+		snapshot.Add(external_metrics.ExternalMetricValue{
+			MetricName: c.Server + "_" + name,
+			Value:      *resource.NewQuantity(value, resource.DecimalSI),
+		})
+	}
+	return snapshot, nil
+}
+
+// platform returns the os_arch platform of s. Label values cannot contain
+// the slash of the usual os/arch notation.
+func (s droneStage) platform() string {
+	if s.OS == "" && s.Arch == "" {
+		return ""
+	}
+	platform := s.OS + "_" + s.Arch
+	if s.Variant != "" {
+		platform += "_" + s.Variant
+	}
+	return platform
+}
+
+// platform returns the os_arch platform of t.
+func (t woodpeckerTask) platform() string {
+	return strings.ReplaceAll(t.Labels[DronePlatformLabel], "/", "_")
+}
+
+func (c *DroneCollector) seriesLabels(platform string, stageLabels map[string]string) map[string]string {
+	labels := map[string]string{DronePlatformLabel: platform}
+	for _, key := range c.Labels {
+		labels[key] = stageLabels[key]
+	}
+	return labels
+}
+
+func (c *DroneCollector) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.Endpoint+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("User-Agent", "buildscaler")
+	_, err = getJSON(c.client, req, v)
+	return err
+}
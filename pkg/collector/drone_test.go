@@ -0,0 +1,122 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+)
+
+func newDroneServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer fake-token", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/api/queue":
+			_, _ = io.WriteString(w, `[
+{"id": 1, "status": "pending", "os": "linux", "arch": "amd64", "labels": {"pool": "k8s"}},
+{"id": 2, "status": "pending", "os": "linux", "arch": "amd64", "labels": {"pool": "k8s"}},
+{"id": 3, "status": "running", "os": "linux", "arch": "amd64", "labels": {"pool": "k8s"}},
+{"id": 4, "status": "pending", "os": "linux", "arch": "arm", "variant": "v7"},
+{"id": 5, "status": "running", "os": "windows", "arch": "amd64", "labels": {"pool": "vm"}},
+{"id": 6, "status": "success", "os": "windows", "arch": "amd64", "labels": {"pool": "vm"}}
+]`)
+		case "/api/queue/info":
+			_, _ = io.WriteString(w, `{
+"pending": [
+  {"id": "1", "labels": {"platform": "linux/amd64", "repo": "acme/app", "pool": "k8s"}},
+  {"id": "2", "labels": {"platform": "linux/arm64", "repo": "acme/app"}}
+],
+"waiting_on_deps": [
+  {"id": "3", "labels": {"platform": "linux/amd64", "repo": "acme/app", "pool": "k8s"}}
+],
+"running": [
+  {"id": "4", "labels": {"platform": "linux/amd64", "repo": "acme/web", "pool": "k8s"}}
+],
+"stats": {"worker_count": 3, "pending_count": 2, "waiting_on_deps_count": 1, "running_count": 1},
+"paused": false
+}`)
+		case "/api/builds/incomplete":
+			_, _ = io.WriteString(w, `[
+{"id": 1, "slug": "acme/app", "build": {"id": 10, "status": "running"}},
+{"id": 2, "slug": "acme/web", "build": {"id": 11, "status": "pending"}},
+{"id": 3, "slug": "acme/api", "build": {"id": 12, "status": "pending"}}
+]`)
+		case "/api/builds":
+			_, _ = io.WriteString(w, `[
+{"full_name": "acme/app", "number": 4, "status": "pending"},
+{"full_name": "acme/web", "number": 7, "status": "running"}
+]`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestDroneCollector(t *testing.T) {
+	s := newDroneServer(t)
+	defer s.Close()
+	for _, tc := range []struct {
+		server   string
+		name     string
+		set      map[string]string
+		expected int64
+	}{
+		{DroneServer, "drone_pending_stages_count", map[string]string{"platform": "linux_amd64", "pool": "k8s"}, 2},
+		{DroneServer, "drone_running_stages_count", map[string]string{"platform": "linux_amd64", "pool": "k8s"}, 1},
+		{DroneServer, "drone_pending_stages_count", map[string]string{"platform": "linux_arm_v7", "pool": ""}, 1},
+		{DroneServer, "drone_pending_stages_count", map[string]string{"platform": "windows_amd64", "pool": "vm"}, 0},
+		{DroneServer, "drone_running_stages_count", map[string]string{"platform": "windows_amd64", "pool": "vm"}, 1},
+		{WoodpeckerServer, "woodpecker_pending_stages_count", map[string]string{"platform": "linux_amd64", "pool": "k8s"}, 2},
+		{WoodpeckerServer, "woodpecker_running_stages_count", map[string]string{"platform": "linux_amd64", "pool": "k8s"}, 1},
+		{WoodpeckerServer, "woodpecker_pending_stages_count", map[string]string{"platform": "linux_arm64", "pool": ""}, 1},
+		{DroneServer, "drone_pending_builds_count", nil, 2},
+		{DroneServer, "drone_running_builds_count", nil, 1},
+		{WoodpeckerServer, "woodpecker_pending_builds_count", nil, 1},
+	} {
+		c := NewDroneCollector(tc.server, s.URL+"/", "fake-token", []string{"pool"})
+		snapshot, err := c.Collect(context.Background())
+		assert.NoError(t, err)
+		st := storage.NewExternalMetricsMap()
+		st.Commit(snapshot.Batch())
+		series, ok := st.Get(tc.name, labels.SelectorFromSet(tc.set))
+		assert.True(t, ok, tc.name)
+		if assert.Len(t, series, 1, "%s%v", tc.name, tc.set) {
+			assert.Equal(t, tc.expected, series[0].Value.Value.Value(), "%s%v", tc.name, tc.set)
+		}
+	}
+
+	c := NewDroneCollector(DroneServer, s.URL, "fake-token", nil)
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+	for name, expected := range map[string]int64{
+		"drone_total_pending_stages_count": 3,
+		"drone_total_running_stages_count": 2,
+	} {
+		series, ok := st.Get(name, labels.Everything())
+		assert.True(t, ok, name)
+		if assert.Len(t, series, 1, name) {
+			assert.Equal(t, expected, series[0].Value.Value.Value(), name)
+		}
+	}
+}
@@ -12,8 +12,6 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
 	"k8s.io/metrics/pkg/apis/external_metrics"
-
-	"github.com/elotl/buildscaler/pkg/storage"
 )
 
 type v1QueueInfo struct {
@@ -31,10 +29,9 @@ type Flarebuild struct {
 	// https://api.stg.flare.build/api/v1
 	client  *http.Client
 	request *http.Request
-	storage *storage.ExternalMetricsMap
 }
 
-func NewFlarebuild(storage *storage.ExternalMetricsMap, apiKey, endpoint string) (*Flarebuild, error) {
+func NewFlarebuild(apiKey, endpoint string) (*Flarebuild, error) {
 	var req, err = http.NewRequest("GET", endpoint+"/remote_executions/queues", nil)
 	if err != nil {
 		return nil, err
@@ -46,21 +43,23 @@ func NewFlarebuild(storage *storage.ExternalMetricsMap, apiKey, endpoint string)
 	return &Flarebuild{
 		request: req,
 		client:  &http.Client{Timeout: 60 * time.Second},
-		storage: storage,
 	}, nil
 }
 
-func (c *Flarebuild) collect() (
+func (c *Flarebuild) collect(ctx context.Context) (
 	result []v1QueueInfo,
 	err error,
 ) {
 	var response *http.Response
-	response, err = c.client.Do(c.request.Clone(context.TODO()))
+	response, err = c.client.Do(c.request.Clone(ctx))
 	if err != nil {
-		klog.Error("unable to query flare.build: %s", err)
+		klog.Errorf("unable to query flare.build: %s", err)
 		return
 	}
 	defer response.Body.Close()
+	if err = rateLimitError(response); err != nil {
+		return
+	}
 	if response.StatusCode != http.StatusOK {
 		err = fmt.Errorf("bad http code: %d", response.StatusCode)
 		return
@@ -74,36 +73,45 @@ func (c *Flarebuild) collect() (
 }
 
 func flarebuildMetricName(os, name string) string {
-	return fmt.Sprintf(
-		"flarebuild_%s_%s", strings.ToLower(os), strings.ToLower(name),
-	)
+	return platformMetricName("flarebuild", os, name)
 }
 
 func flarebuildExternalMetricValue(
 	os, image, name string, timestamp time.Time, value int64,
+) *external_metrics.ExternalMetricValue {
+	return platformExternalMetricValue("flarebuild", os, image, name, timestamp, value)
+}
+
+// platformMetricName names the metrics of remote execution platforms, which
+// are reported per OS family and container image.
+func platformMetricName(prefix, os, name string) string {
+	return fmt.Sprintf(
+		"%s_%s_%s", prefix, strings.ToLower(os), strings.ToLower(name),
+	)
+}
+
+func platformExternalMetricValue(
+	prefix, os, image, name string, timestamp time.Time, value int64,
 ) *external_metrics.ExternalMetricValue {
 	return &external_metrics.ExternalMetricValue{
-		MetricName:   flarebuildMetricName(os, name),
+		MetricName:   platformMetricName(prefix, os, name),
 		MetricLabels: map[string]string{"type": name, "os": os, "image": image},
 		Timestamp:    metav1.NewTime(timestamp),
 		Value:        *resource.NewQuantity(value, resource.DecimalSI),
 	}
 }
 
-func (c *Flarebuild) Collect(cancel context.CancelFunc) error {
-	var queues, err = c.collect()
+func (c *Flarebuild) Collect(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
+	var queues, err = c.collect(ctx)
 	if err != nil {
-		klog.ErrorS(err, "failed to collect data")
-		cancel()
-		return err
+		return snapshot, err
 	}
 
 	var now = time.Now()
 	for _, q := range queues {
-		var runner = flarebuildExternalMetricValue(q.OsFamily, q.ContainerImage, "runner", now, q.Runner)
-		c.storage.OverrideOrStore(runner.MetricName, *runner)
-		var queueSize = flarebuildExternalMetricValue(q.OsFamily, q.ContainerImage, "queue_size", now, q.QueueSize)
-		c.storage.OverrideOrStore(queueSize.MetricName, *queueSize)
+		snapshot.Add(*flarebuildExternalMetricValue(q.OsFamily, q.ContainerImage, "runner", now, q.Runner))
+		snapshot.Add(*flarebuildExternalMetricValue(q.OsFamily, q.ContainerImage, "queue_size", now, q.QueueSize))
 	}
-	return nil
+	return snapshot, nil
 }
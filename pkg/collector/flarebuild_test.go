@@ -1,6 +1,7 @@
 package collector
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -21,19 +22,21 @@ func TestFlarebuildBasic(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = io.WriteString(w, `{"queueInfo": [
 {"osFamily": "MacOS", "containerImage": "", "runners": "9", "queueSize": "6"},
-{"osFamily": "Linux", "containerImage": "docker://gcr.io/flare-build-alpha/u", "runners": "4", "queueSize": "1"}
+{"osFamily": "Linux", "containerImage": "docker://gcr.io/flare-build-alpha/u", "runners": "4", "queueSize": "1"},
+{"osFamily": "Linux", "containerImage": "docker://gcr.io/flare-build-alpha/v", "runners": "2", "queueSize": "3"}
 ]}
 `)
 	}))
 	defer s.Close()
 
 	store := storage.NewExternalMetricsMap()
-	fb, err := NewFlarebuild(store, "fakeauth", s.URL)
+	fb, err := NewFlarebuild("fakeauth", s.URL)
 	assert.Nil(t, err)
-	err = fb.Collect(func() {})
+	snapshot, err := fb.Collect(context.Background())
 	assert.Nil(t, err)
+	store.Commit(snapshot.Batch())
 
-	var m = store.Data["flarebuild_macos_runner"]
+	var m = store.Data["flarebuild_macos_runner"]["image=,os=MacOS,type=runner"].Value
 	assert.Equal(t, "flarebuild_macos_runner", m.MetricName)
 	assert.Equal(
 		t,
@@ -41,7 +44,7 @@ func TestFlarebuildBasic(t *testing.T) {
 		m.MetricLabels)
 	assert.Equal(t, *resource.NewQuantity(9, resource.DecimalSI), m.Value)
 
-	m = store.Data["flarebuild_macos_queue_size"]
+	m = store.Data["flarebuild_macos_queue_size"]["image=,os=MacOS,type=queue_size"].Value
 	assert.Equal(t, "flarebuild_macos_queue_size", m.MetricName)
 	assert.Equal(
 		t,
@@ -49,7 +52,7 @@ func TestFlarebuildBasic(t *testing.T) {
 		m.MetricLabels)
 	assert.Equal(t, *resource.NewQuantity(6, resource.DecimalSI), m.Value)
 
-	m = store.Data["flarebuild_linux_runner"]
+	m = store.Data["flarebuild_linux_runner"]["image=docker://gcr.io/flare-build-alpha/u,os=Linux,type=runner"].Value
 	assert.Equal(t, "flarebuild_linux_runner", m.MetricName)
 	assert.Equal(
 		t,
@@ -57,11 +60,19 @@ func TestFlarebuildBasic(t *testing.T) {
 		m.MetricLabels)
 	assert.Equal(t, *resource.NewQuantity(4, resource.DecimalSI), m.Value)
 
-	m = store.Data["flarebuild_linux_queue_size"]
+	m = store.Data["flarebuild_linux_queue_size"]["image=docker://gcr.io/flare-build-alpha/u,os=Linux,type=queue_size"].Value
 	assert.Equal(t, "flarebuild_linux_queue_size", m.MetricName)
 	assert.Equal(
 		t,
 		map[string]string{"os": "Linux", "image": "docker://gcr.io/flare-build-alpha/u", "type": "queue_size"},
 		m.MetricLabels)
 	assert.Equal(t, *resource.NewQuantity(1, resource.DecimalSI), m.Value)
+
+	m = store.Data["flarebuild_linux_queue_size"]["image=docker://gcr.io/flare-build-alpha/v,os=Linux,type=queue_size"].Value
+	assert.Equal(t, "flarebuild_linux_queue_size", m.MetricName)
+	assert.Equal(
+		t,
+		map[string]string{"os": "Linux", "image": "docker://gcr.io/flare-build-alpha/v", "type": "queue_size"},
+		m.MetricLabels)
+	assert.Equal(t, *resource.NewQuantity(3, resource.DecimalSI), m.Value)
 }
@@ -0,0 +1,327 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	GitHubAPIEndpoint = "https://api.github.com"
+
+	GitHubActionsRunnerLabelsLabel = "runner_labels"
+
+	githubJobStatusQueued     = "queued"
+	githubJobStatusInProgress = "in_progress"
+	githubRunnerStatusOnline  = "online"
+)
+
+type githubRepository struct {
+	FullName string `json:"full_name"`
+	Archived bool   `json:"archived"`
+}
+
+type githubWorkflowRuns struct {
+	WorkflowRuns []struct {
+		ID int64 `json:"id"`
+	} `json:"workflow_runs"`
+}
+
+type githubJob struct {
+	ID     int64    `json:"id"`
+	Status string   `json:"status"`
+	Labels []string `json:"labels"`
+}
+
+type githubJobs struct {
+	Jobs []githubJob `json:"jobs"`
+}
+
+type githubRunner struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Busy   bool   `json:"busy"`
+	Labels []struct {
+		Name string `json:"name"`
+	} `json:"labels"`
+}
+
+type githubRunners struct {
+	Runners []githubRunner `json:"runners"`
+}
+
+// githubCounts holds the metrics reported for a single runner label set.
+type githubCounts struct {
+	QueuedJobs  int64
+	RunningJobs int64
+	IdleRunners int64
+	BusyRunners int64
+}
+
+// GitHubActionsCollector reports queued and running workflow jobs and the
+// state of self-hosted runners, grouped by runner label set. Jobs are read
+// from Repos, or from every repository of Org if Repos is empty. Runners are
+// read from Org and from each of Repos.
+type GitHubActionsCollector struct {
+	Endpoint string
+	Token    string
+	Org      string
+	Repos    []string
+
+	client *http.Client
+	// requests counts the requests of the current scrape and rateLimit is
+	// the hourly limit GitHub reported for the token, zero if unknown.
+	requests  int
+	rateLimit int
+}
+
+func NewGitHubActionsCollector(token, endpoint, org string, repos []string) *GitHubActionsCollector {
+	return &GitHubActionsCollector{
+		Endpoint: endpoint,
+		Token:    token,
+		Org:      org,
+		Repos:    repos,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *GitHubActionsCollector) Collect(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
+	c.requests = 0
+	var total githubCounts
+	counts := map[string]*githubCounts{}
+	sets := map[string][]string{}
+	countsFor := func(labels []string) *githubCounts {
+		key := labelSet(labels)
+		if counts[key] == nil {
+			counts[key] = &githubCounts{}
+			sets[key] = labels
+		}
+		return counts[key]
+	}
+
+	jobs, err := c.listActiveJobs(ctx)
+	if err != nil {
+		return snapshot, err
+	}
+	for _, job := range jobs {
+		switch job.Status {
+		case githubJobStatusQueued:
+			countsFor(job.Labels).QueuedJobs++
+			total.QueuedJobs++
+		case githubJobStatusInProgress:
+			countsFor(job.Labels).RunningJobs++
+			total.RunningJobs++
+		}
+	}
+
+	runners, err := c.listRunners(ctx)
+	if err != nil {
+		return snapshot, err
+	}
+	var online [][]string
+	var busy []bool
+	for _, runner := range runners {
+		if runner.Status != githubRunnerStatusOnline {
+			continue
+		}
+		labels := make([]string, 0, len(runner.Labels))
+		for _, l := range runner.Labels {
+			labels = append(labels, l.Name)
+		}
+		countsFor(labels)
+		online = append(online, labels)
+		busy = append(busy, runner.Busy)
+		if runner.Busy {
+			total.BusyRunners++
+		} else {
+			total.IdleRunners++
+		}
+	}
+	// A runner can pick up any job whose labels are a subset of its own, so
+	// it is counted under every such label set.
+	for key, set := range sets {
+		for i, labels := range online {
+			if !hasLabels(labels, set) {
+				continue
+			}
+			if busy[i] {
+				counts[key].BusyRunners++
+			} else {
+				counts[key].IdleRunners++
+			}
+		}
+	}
+
+	for labelSet, count := range counts {
+		count.addTo(&snapshot, "github_actions_", map[string]string{GitHubActionsRunnerLabelsLabel: labelSet})
+	}
+	total.addTo(&snapshot, "github_actions_total_", nil)
+	snapshot.PollAfter = c.pollAfter()
+	return snapshot, nil
+}
+
+func (g *githubCounts) addTo(snapshot *Snapshot, prefix string, labels map[string]string) {
+	for name, value := range map[string]int64{
+		"queued_jobs_count":  g.QueuedJobs,
+		"running_jobs_count": g.RunningJobs,
+		"idle_runner_count":  g.IdleRunners,
+		"busy_runner_count":  g.BusyRunners,
+	} {
+		snapshot.Add(external_metrics.ExternalMetricValue{
+			MetricName:   prefix + name,
+			MetricLabels: labels,
+			Value:        *resource.NewQuantity(value, resource.DecimalSI),
+		})
+	}
+}
+
+func (c *GitHubActionsCollector) listActiveJobs(ctx context.Context) ([]githubJob, error) {
+	repos := c.Repos
+	if len(repos) == 0 {
+		var err error
+		repos, err = c.listOrgRepos(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var jobs []githubJob
+	for _, repo := range repos {
+		for _, status := range []string{githubJobStatusQueued, githubJobStatusInProgress} {
+			var runIDs []int64
+			err := c.getPaginated(ctx, fmt.Sprintf("/repos/%s/actions/runs?status=%s", repo, status), func() interface{} {
+				return &githubWorkflowRuns{}
+			}, func(page interface{}) {
+				for _, run := range page.(*githubWorkflowRuns).WorkflowRuns {
+					runIDs = append(runIDs, run.ID)
+				}
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range runIDs {
+				err := c.getPaginated(ctx, fmt.Sprintf("/repos/%s/actions/runs/%d/jobs?filter=latest", repo, id), func() interface{} {
+					return &githubJobs{}
+				}, func(page interface{}) {
+					jobs = append(jobs, page.(*githubJobs).Jobs...)
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	klog.V(5).Infof("found %d queued or running GitHub Actions jobs in %d repositories", len(jobs), len(repos))
+	return jobs, nil
+}
+
+func (c *GitHubActionsCollector) listOrgRepos(ctx context.Context) ([]string, error) {
+	var repos []string
+	err := c.getPaginated(ctx, fmt.Sprintf("/orgs/%s/repos", c.Org), func() interface{} {
+		return &[]githubRepository{}
+	}, func(page interface{}) {
+		for _, repo := range *page.(*[]githubRepository) {
+			if !repo.Archived {
+				repos = append(repos, repo.FullName)
+			}
+		}
+	})
+	return repos, err
+}
+
+// listRunners returns the self-hosted runners of Org and Repos. A runner is
+// only returned once even if it is visible from several of them.
+func (c *GitHubActionsCollector) listRunners(ctx context.Context) ([]githubRunner, error) {
+	var paths []string
+	if c.Org != "" {
+		paths = append(paths, fmt.Sprintf("/orgs/%s/actions/runners", c.Org))
+	}
+	for _, repo := range c.Repos {
+		paths = append(paths, fmt.Sprintf("/repos/%s/actions/runners", repo))
+	}
+	seen := map[int64]bool{}
+	var runners []githubRunner
+	for _, path := range paths {
+		err := c.getPaginated(ctx, path, func() interface{} {
+			return &githubRunners{}
+		}, func(page interface{}) {
+			for _, runner := range page.(*githubRunners).Runners {
+				if !seen[runner.ID] {
+					seen[runner.ID] = true
+					runners = append(runners, runner)
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return runners, nil
+}
+
+// getPaginated decodes every page of path into a value returned by newPage
+// and passes it to onPage. It counts the requests made and remembers the rate
+// limit of the token for pollAfter.
+func (c *GitHubActionsCollector) getPaginated(ctx context.Context, path string, newPage func() interface{}, onPage func(interface{})) error {
+	header, err := getPaginated(ctx, c.client, c.Endpoint+path, http.Header{"Authorization": {"Bearer " + c.Token}}, func() interface{} {
+		c.requests++
+		return newPage()
+	}, onPage)
+	if limit, parseErr := strconv.Atoi(header.Get("X-RateLimit-Limit")); parseErr == nil {
+		c.rateLimit = limit
+	}
+	if err != nil {
+		return githubRateLimitError(header, err)
+	}
+	return nil
+}
+
+// pollAfter returns how long to wait before the next scrape, so scrapes
+// making as many requests as the last one stay within the hourly rate limit
+// of the token. Reading jobs from every repository of an organization costs
+// two requests per repository plus one per active workflow run, which would
+// exhaust the limit within minutes at the default period.
+func (c *GitHubActionsCollector) pollAfter() time.Duration {
+	if c.rateLimit <= 0 {
+		return 0
+	}
+	return time.Duration(c.requests) * time.Hour / time.Duration(c.rateLimit)
+}
+
+// githubRateLimitError turns the 403 Forbidden GitHub answers when the
+// primary rate limit is exhausted into a *RateLimitError waiting until the
+// limit resets.
+func githubRateLimitError(header http.Header, err error) error {
+	var rateLimited *RateLimitError
+	if header == nil || errors.As(err, &rateLimited) || header.Get("X-RateLimit-Remaining") != "0" {
+		return err
+	}
+	rateLimited = &RateLimitError{StatusCode: http.StatusForbidden}
+	if reset, parseErr := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); parseErr == nil {
+		if wait := time.Until(time.Unix(reset, 0)); wait > 0 {
+			rateLimited.RetryAfter = wait
+		}
+	}
+	return rateLimited
+}
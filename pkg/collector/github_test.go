@@ -0,0 +1,177 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+)
+
+func newGitHubServer(t *testing.T) *httptest.Server {
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer fake-token", r.Header.Get("Authorization"))
+		assert.Equal(t, "100", r.URL.Query().Get("per_page"))
+		w.Header().Set("X-RateLimit-Limit", "60")
+		switch r.URL.Path {
+		case "/orgs/acme/repos":
+			_, _ = io.WriteString(w, `[
+{"full_name": "acme/app", "archived": false},
+{"full_name": "acme/old", "archived": true}
+]`)
+		case "/repos/acme/app/actions/runs":
+			switch r.URL.Query().Get("status") {
+			case "queued":
+				_, _ = io.WriteString(w, `{"total_count": 1, "workflow_runs": [{"id": 1}]}`)
+			case "in_progress":
+				_, _ = io.WriteString(w, `{"total_count": 1, "workflow_runs": [{"id": 2}]}`)
+			}
+		case "/repos/acme/app/actions/runs/1/jobs":
+			_, _ = io.WriteString(w, `{"jobs": [
+{"id": 10, "status": "queued", "labels": ["self-hosted", "Linux"]},
+{"id": 11, "status": "queued", "labels": ["linux", "self-hosted"]}
+]}`)
+		case "/repos/acme/app/actions/runs/2/jobs":
+			_, _ = io.WriteString(w, `{"jobs": [
+{"id": 20, "status": "in_progress", "labels": ["self-hosted", "linux"]},
+{"id": 21, "status": "completed", "labels": ["self-hosted", "linux"]},
+{"id": 22, "status": "queued", "labels": ["ubuntu-latest"]},
+{"id": 23, "status": "queued", "labels": ["self-hosted"]}
+]}`)
+		case "/orgs/acme/actions/runners":
+			if r.URL.Query().Get("page") == "" {
+				w.Header().Set("Link", `<`+s.URL+`/orgs/acme/actions/runners?per_page=100&page=2>; rel="next", <`+s.URL+`/orgs/acme/actions/runners?per_page=100&page=2>; rel="last"`)
+				_, _ = io.WriteString(w, `{"runners": [
+{"id": 1, "status": "online", "busy": true, "labels": [{"name": "self-hosted"}, {"name": "linux"}]},
+{"id": 2, "status": "online", "busy": false, "labels": [{"name": "self-hosted"}, {"name": "linux"}]}
+]}`)
+				return
+			}
+			_, _ = io.WriteString(w, `{"runners": [
+{"id": 3, "status": "offline", "busy": false, "labels": [{"name": "self-hosted"}, {"name": "linux"}]},
+{"id": 4, "status": "online", "busy": false, "labels": [{"name": "self-hosted"}, {"name": "linux"}]}
+]}`)
+		case "/repos/acme/app/actions/runners":
+			_, _ = io.WriteString(w, `{"runners": [
+{"id": 5, "status": "online", "busy": true, "labels": [{"name": "self-hosted"}, {"name": "gpu"}]}
+]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return s
+}
+
+func TestGitHubActionsCollectorOrg(t *testing.T) {
+	s := newGitHubServer(t)
+	defer s.Close()
+	c := NewGitHubActionsCollector("fake-token", s.URL, "acme", nil)
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	// 7 requests out of 60 per hour allow a scrape every 7 minutes.
+	assert.Equal(t, 7*time.Minute, snapshot.PollAfter)
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+
+	for _, tc := range []struct {
+		name     string
+		labelSet string
+		expected int64
+	}{
+		{"github_actions_queued_jobs_count", "linux_self-hosted", 2},
+		{"github_actions_running_jobs_count", "linux_self-hosted", 1},
+		{"github_actions_idle_runner_count", "linux_self-hosted", 2},
+		{"github_actions_busy_runner_count", "linux_self-hosted", 1},
+		{"github_actions_queued_jobs_count", "ubuntu-latest", 1},
+		{"github_actions_idle_runner_count", "ubuntu-latest", 0},
+		// Runners labeled self-hosted and linux can run self-hosted jobs.
+		{"github_actions_queued_jobs_count", "self-hosted", 1},
+		{"github_actions_idle_runner_count", "self-hosted", 2},
+		{"github_actions_busy_runner_count", "self-hosted", 1},
+	} {
+		series, ok := st.Get(tc.name, labels.SelectorFromSet(map[string]string{GitHubActionsRunnerLabelsLabel: tc.labelSet}))
+		assert.True(t, ok, tc.name)
+		if assert.Len(t, series, 1, "%s{%s}", tc.name, tc.labelSet) {
+			assert.Equal(t, tc.expected, series[0].Value.Value.Value(), "%s{%s}", tc.name, tc.labelSet)
+		}
+	}
+	for name, expected := range map[string]int64{
+		"github_actions_total_queued_jobs_count":  4,
+		"github_actions_total_running_jobs_count": 1,
+		"github_actions_total_idle_runner_count":  2,
+		"github_actions_total_busy_runner_count":  1,
+	} {
+		series, ok := st.Get(name, labels.Everything())
+		assert.True(t, ok, name)
+		if assert.Len(t, series, 1, name) {
+			assert.Equal(t, expected, series[0].Value.Value.Value(), name)
+		}
+	}
+}
+
+func TestGitHubActionsCollectorRepos(t *testing.T) {
+	s := newGitHubServer(t)
+	defer s.Close()
+	c := NewGitHubActionsCollector("fake-token", s.URL, "", []string{"acme/app"})
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, snapshot.PollAfter)
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+
+	series, ok := st.Get("github_actions_busy_runner_count", labels.SelectorFromSet(map[string]string{GitHubActionsRunnerLabelsLabel: "gpu_self-hosted"}))
+	assert.True(t, ok)
+	if assert.Len(t, series, 1) {
+		assert.Equal(t, int64(1), series[0].Value.Value.Value())
+	}
+	series, ok = st.Get("github_actions_busy_runner_count", labels.SelectorFromSet(map[string]string{GitHubActionsRunnerLabelsLabel: "self-hosted"}))
+	assert.True(t, ok)
+	if assert.Len(t, series, 1) {
+		assert.Equal(t, int64(1), series[0].Value.Value.Value())
+	}
+	series, ok = st.Get("github_actions_total_queued_jobs_count", labels.Everything())
+	assert.True(t, ok)
+	if assert.Len(t, series, 1) {
+		assert.Equal(t, int64(4), series[0].Value.Value.Value())
+	}
+}
+
+func TestGitHubActionsCollectorRateLimited(t *testing.T) {
+	reset := time.Now().Add(time.Hour)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = io.WriteString(w, `{"message": "API rate limit exceeded"}`)
+	}))
+	defer s.Close()
+	c := NewGitHubActionsCollector("fake-token", s.URL, "acme", nil)
+	_, err := c.Collect(context.Background())
+	var rateLimited *RateLimitError
+	if assert.True(t, errors.As(err, &rateLimited), "got %v", err) {
+		assert.Equal(t, http.StatusForbidden, rateLimited.StatusCode)
+		assert.InDelta(t, time.Hour.Seconds(), rateLimited.RetryAfter.Seconds(), 5)
+	}
+}
@@ -0,0 +1,313 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	GitLabEndpoint = "https://gitlab.com"
+
+	GitLabRunnerTagsLabel = "runner_tags"
+
+	gitlabJobStatusPending   = "pending"
+	gitlabJobStatusRunning   = "running"
+	gitlabRunnerStatusOnline = "online"
+
+	// gitlabRunnerTagsTTL is how long the tags of a runner are cached. They
+	// are not part of the runner list, so each runner has to be fetched.
+	gitlabRunnerTagsTTL = 5 * time.Minute
+)
+
+type gitlabProject struct {
+	ID int64 `json:"id"`
+}
+
+type gitlabJob struct {
+	ID      int64    `json:"id"`
+	Status  string   `json:"status"`
+	TagList []string `json:"tag_list"`
+	Runner  *struct {
+		ID int64 `json:"id"`
+	} `json:"runner"`
+}
+
+type gitlabRunner struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+	Paused bool   `json:"paused"`
+}
+
+type gitlabRunnerDetails struct {
+	TagList     []string `json:"tag_list"`
+	RunUntagged bool     `json:"run_untagged"`
+}
+
+type gitlabRunnerTags struct {
+	tags        []string
+	runUntagged bool
+	fetched     time.Time
+}
+
+// canRun reports whether a runner with these tags picks up jobs tagged with
+// jobTags: all of them must be runner tags, and untagged jobs only run on
+// runners allowed to run untagged jobs.
+func (r gitlabRunnerTags) canRun(jobTags []string) bool {
+	if len(jobTags) == 0 {
+		return r.runUntagged || len(r.tags) == 0
+	}
+	return hasLabels(r.tags, jobTags)
+}
+
+// gitlabCounts holds the metrics reported for a single runner tag set.
+type gitlabCounts struct {
+	PendingJobs   int64
+	RunningJobs   int64
+	OnlineRunners int64
+	BusyRunners   int64
+}
+
+// GitLabCollector reports pending and running jobs of Projects and of every
+// project of Groups, and the state of the runners available to them, grouped
+// by runner tag set. Projects and Groups are numeric IDs or full paths.
+type GitLabCollector struct {
+	// Endpoint is the base URL of the GitLab instance, without /api/v4.
+	Endpoint string
+	Token    string
+	Projects []string
+	Groups   []string
+
+	client     *http.Client
+	runnerTags map[int64]gitlabRunnerTags
+}
+
+func NewGitLabCollector(token, endpoint string, projects, groups []string) *GitLabCollector {
+	return &GitLabCollector{
+		Endpoint:   strings.TrimSuffix(endpoint, "/"),
+		Token:      token,
+		Projects:   projects,
+		Groups:     groups,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		runnerTags: map[int64]gitlabRunnerTags{},
+	}
+}
+
+func (c *GitLabCollector) Collect(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
+	var total gitlabCounts
+	counts := map[string]*gitlabCounts{}
+	sets := map[string][]string{}
+	countsFor := func(tags []string) *gitlabCounts {
+		key := labelSet(tags)
+		if counts[key] == nil {
+			counts[key] = &gitlabCounts{}
+			sets[key] = tags
+		}
+		return counts[key]
+	}
+
+	jobs, err := c.listActiveJobs(ctx)
+	if err != nil {
+		return snapshot, err
+	}
+	busy := map[int64]bool{}
+	for _, job := range jobs {
+		switch job.Status {
+		case gitlabJobStatusPending:
+			countsFor(job.TagList).PendingJobs++
+			total.PendingJobs++
+		case gitlabJobStatusRunning:
+			countsFor(job.TagList).RunningJobs++
+			total.RunningJobs++
+			if job.Runner != nil {
+				busy[job.Runner.ID] = true
+			}
+		}
+	}
+
+	runners, err := c.listRunners(ctx)
+	if err != nil {
+		return snapshot, err
+	}
+	c.pruneRunnerTags(runners)
+	online := map[int64]gitlabRunnerTags{}
+	for _, runner := range runners {
+		if runner.Status != gitlabRunnerStatusOnline || runner.Paused {
+			continue
+		}
+		tags, err := c.getRunnerTags(ctx, runner.ID)
+		if err != nil {
+			return snapshot, err
+		}
+		countsFor(tags.tags)
+		online[runner.ID] = tags
+		total.OnlineRunners++
+		if busy[runner.ID] {
+			total.BusyRunners++
+		}
+	}
+	// A runner picks up any job whose tags are a subset of its own, so it is
+	// counted under every such tag set.
+	for key, set := range sets {
+		for id, tags := range online {
+			if !tags.canRun(set) {
+				continue
+			}
+			counts[key].OnlineRunners++
+			if busy[id] {
+				counts[key].BusyRunners++
+			}
+		}
+	}
+
+	for tagSet, count := range counts {
+		count.addTo(&snapshot, "gitlab_", map[string]string{GitLabRunnerTagsLabel: tagSet})
+	}
+	total.addTo(&snapshot, "gitlab_total_", nil)
+	return snapshot, nil
+}
+
+func (g *gitlabCounts) addTo(snapshot *Snapshot, prefix string, labels map[string]string) {
+	for name, value := range map[string]int64{
+		"pending_jobs_count":  g.PendingJobs,
+		"running_jobs_count":  g.RunningJobs,
+		"online_runner_count": g.OnlineRunners,
+		"busy_runner_count":   g.BusyRunners,
+		"idle_runner_count":   g.OnlineRunners - g.BusyRunners,
+	} {
+		snapshot.Add(external_metrics.ExternalMetricValue{
+			MetricName:   prefix + name,
+			MetricLabels: labels,
+			Value:        *resource.NewQuantity(value, resource.DecimalSI),
+		})
+	}
+}
+
+// projectIDs returns Projects followed by the IDs of the projects of Groups,
+// including their subgroups.
+func (c *GitLabCollector) projectIDs(ctx context.Context) ([]string, error) {
+	ids := append([]string{}, c.Projects...)
+	for _, group := range c.Groups {
+		path := fmt.Sprintf("/groups/%s/projects?include_subgroups=true&archived=false&simple=true", url.PathEscape(group))
+		err := c.getPaginated(ctx, path, func() interface{} {
+			return &[]gitlabProject{}
+		}, func(page interface{}) {
+			for _, project := range *page.(*[]gitlabProject) {
+				ids = append(ids, fmt.Sprint(project.ID))
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+func (c *GitLabCollector) listActiveJobs(ctx context.Context) ([]gitlabJob, error) {
+	projects, err := c.projectIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []gitlabJob
+	for _, project := range projects {
+		path := fmt.Sprintf("/projects/%s/jobs?scope[]=%s&scope[]=%s", url.PathEscape(project), gitlabJobStatusPending, gitlabJobStatusRunning)
+		err := c.getPaginated(ctx, path, func() interface{} {
+			return &[]gitlabJob{}
+		}, func(page interface{}) {
+			jobs = append(jobs, *page.(*[]gitlabJob)...)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	klog.V(5).Infof("found %d pending or running GitLab jobs in %d projects", len(jobs), len(projects))
+	return jobs, nil
+}
+
+// listRunners returns the runners available to Projects and Groups. A runner
+// is only returned once even if it is available to several of them.
+func (c *GitLabCollector) listRunners(ctx context.Context) ([]gitlabRunner, error) {
+	var paths []string
+	for _, project := range c.Projects {
+		paths = append(paths, fmt.Sprintf("/projects/%s/runners", url.PathEscape(project)))
+	}
+	for _, group := range c.Groups {
+		paths = append(paths, fmt.Sprintf("/groups/%s/runners", url.PathEscape(group)))
+	}
+	seen := map[int64]bool{}
+	var runners []gitlabRunner
+	for _, path := range paths {
+		err := c.getPaginated(ctx, path, func() interface{} {
+			return &[]gitlabRunner{}
+		}, func(page interface{}) {
+			for _, runner := range *page.(*[]gitlabRunner) {
+				if !seen[runner.ID] {
+					seen[runner.ID] = true
+					runners = append(runners, runner)
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return runners, nil
+}
+
+// pruneRunnerTags forgets the tags of the runners missing from runners, e.g.
+// because they were unregistered.
+func (c *GitLabCollector) pruneRunnerTags(runners []gitlabRunner) {
+	listed := make(map[int64]bool, len(runners))
+	for _, runner := range runners {
+		listed[runner.ID] = true
+	}
+	for id := range c.runnerTags {
+		if !listed[id] {
+			delete(c.runnerTags, id)
+		}
+	}
+}
+
+func (c *GitLabCollector) getRunnerTags(ctx context.Context, id int64) (gitlabRunnerTags, error) {
+	if cached, ok := c.runnerTags[id]; ok && time.Since(cached.fetched) < gitlabRunnerTagsTTL {
+		return cached, nil
+	}
+	var details gitlabRunnerDetails
+	err := c.getPaginated(ctx, fmt.Sprintf("/runners/%d", id), func() interface{} {
+		return &details
+	}, func(interface{}) {})
+	if err != nil {
+		return gitlabRunnerTags{}, err
+	}
+	tags := gitlabRunnerTags{tags: details.TagList, runUntagged: details.RunUntagged, fetched: time.Now()}
+	c.runnerTags[id] = tags
+	return tags, nil
+}
+
+// getPaginated decodes every page of the API path into a value returned by
+// newPage and passes it to onPage.
+func (c *GitLabCollector) getPaginated(ctx context.Context, path string, newPage func() interface{}, onPage func(interface{})) error {
+	_, err := getPaginated(ctx, c.client, c.Endpoint+"/api/v4"+path, http.Header{"Private-Token": {c.Token}}, newPage, onPage)
+	return err
+}
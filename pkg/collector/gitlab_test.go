@@ -0,0 +1,124 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+)
+
+func TestGitLabCollector(t *testing.T) {
+	runnerRequests := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "fake-token", r.Header.Get("PRIVATE-TOKEN"))
+		switch r.URL.EscapedPath() {
+		case "/gitlab/api/v4/groups/acme/projects":
+			assert.Equal(t, "true", r.URL.Query().Get("include_subgroups"))
+			_, _ = io.WriteString(w, `[{"id": 7}]`)
+		case "/gitlab/api/v4/projects/acme%2Fapp/jobs":
+			assert.Equal(t, []string{"pending", "running"}, r.URL.Query()["scope[]"])
+			_, _ = io.WriteString(w, `[
+{"id": 1, "status": "pending", "tag_list": ["docker", "Linux"]},
+{"id": 2, "status": "running", "tag_list": ["linux", "docker"], "runner": {"id": 10}}
+]`)
+		case "/gitlab/api/v4/projects/7/jobs":
+			_, _ = io.WriteString(w, `[
+{"id": 3, "status": "pending", "tag_list": []},
+{"id": 4, "status": "pending", "tag_list": ["docker"]}
+]`)
+		case "/gitlab/api/v4/projects/acme%2Fapp/runners":
+			_, _ = io.WriteString(w, `[
+{"id": 10, "status": "online", "paused": false},
+{"id": 11, "status": "online", "paused": false},
+{"id": 12, "status": "offline", "paused": false}
+]`)
+		case "/gitlab/api/v4/groups/acme/runners":
+			_, _ = io.WriteString(w, `[
+{"id": 11, "status": "online", "paused": false},
+{"id": 13, "status": "online", "paused": true}
+]`)
+		case "/gitlab/api/v4/runners/10":
+			runnerRequests++
+			_, _ = io.WriteString(w, `{"tag_list": ["docker", "linux"], "run_untagged": false}`)
+		case "/gitlab/api/v4/runners/11":
+			runnerRequests++
+			_, _ = io.WriteString(w, `{"tag_list": ["docker", "linux"], "run_untagged": true}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	c := NewGitLabCollector("fake-token", s.URL+"/gitlab/", []string{"acme/app"}, []string{"acme"})
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+
+	for _, tc := range []struct {
+		name     string
+		tagSet   string
+		expected int64
+	}{
+		{"gitlab_pending_jobs_count", "docker_linux", 1},
+		{"gitlab_running_jobs_count", "docker_linux", 1},
+		{"gitlab_online_runner_count", "docker_linux", 2},
+		{"gitlab_busy_runner_count", "docker_linux", 1},
+		{"gitlab_idle_runner_count", "docker_linux", 1},
+		{"gitlab_pending_jobs_count", "", 1},
+		// Only runner 11 runs untagged jobs.
+		{"gitlab_online_runner_count", "", 1},
+		{"gitlab_idle_runner_count", "", 1},
+		// Runners tagged docker and linux pick up docker jobs.
+		{"gitlab_pending_jobs_count", "docker", 1},
+		{"gitlab_online_runner_count", "docker", 2},
+		{"gitlab_busy_runner_count", "docker", 1},
+	} {
+		series, ok := st.Get(tc.name, labels.SelectorFromSet(map[string]string{GitLabRunnerTagsLabel: tc.tagSet}))
+		assert.True(t, ok, tc.name)
+		if assert.Len(t, series, 1, "%s{%s}", tc.name, tc.tagSet) {
+			assert.Equal(t, tc.expected, series[0].Value.Value.Value(), "%s{%s}", tc.name, tc.tagSet)
+		}
+	}
+	for name, expected := range map[string]int64{
+		"gitlab_total_pending_jobs_count":  3,
+		"gitlab_total_running_jobs_count":  1,
+		"gitlab_total_online_runner_count": 2,
+		"gitlab_total_busy_runner_count":   1,
+	} {
+		series, ok := st.Get(name, labels.Everything())
+		assert.True(t, ok, name)
+		if assert.Len(t, series, 1, name) {
+			assert.Equal(t, expected, series[0].Value.Value.Value(), name)
+		}
+	}
+
+	// Runner tags are cached between scrapes, and forgotten once a runner
+	// is no longer listed.
+	c.runnerTags[99] = gitlabRunnerTags{tags: []string{"gone"}, fetched: time.Now()}
+	_, err = c.Collect(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, runnerRequests)
+	assert.Len(t, c.runnerTags, 2)
+	assert.NotContains(t, c.runnerTags, int64(99))
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var linkNext = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// getJSON sends req with client and decodes the JSON body of a 200 OK
+// response into v. It returns the response headers, e.g. for pagination.
+// Rate limited requests return a *RateLimitError, other status codes an
+// error including the beginning of the body.
+func getJSON(client *http.Client, req *http.Request, v interface{}) (http.Header, error) {
+	req.Header.Set("Accept", "application/json")
+	res, err := sendRequest(client, req)
+	if err != nil {
+		if res != nil {
+			return res.Header, err
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return res.Header, fmt.Errorf("%s %s: %w", req.Method, req.URL.Redacted(), err)
+	}
+	return res.Header, nil
+}
+
+// sendRequest sends req with client and returns the response, whose body the
+// caller must close, if it is 200 OK. Other responses are returned with their
+// body closed, along with the errors documented by getJSON.
+func sendRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := rateLimitError(res); err != nil {
+		res.Body.Close()
+		return res, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return res, fmt.Errorf("%s %s: request failed with %s: %s", req.Method, req.URL.Redacted(), res.Status, strings.TrimSpace(string(body)))
+	}
+	return res, nil
+}
+
+// nextLink returns the URL of the next page from the Link header used for
+// pagination by GitHub and GitLab, or "" on the last page.
+func nextLink(header http.Header) string {
+	if match := linkNext.FindStringSubmatch(header.Get("Link")); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// getPaginated decodes every page of endpoint into a value returned by newPage
+// and passes it to onPage, following the "next" links of the Link header used
+// by GitHub and GitLab. Every request asks for 100 items per page and carries
+// header. It returns the headers of the last response, even on errors.
+func getPaginated(ctx context.Context, client *http.Client, endpoint string, header http.Header, newPage func() interface{}, onPage func(interface{})) (http.Header, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("per_page", "100")
+	u.RawQuery = q.Encode()
+	next := u.String()
+	var resHeader http.Header
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, "GET", next, nil)
+		if err != nil {
+			return resHeader, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		req.Header.Set("User-Agent", "buildscaler")
+		page := newPage()
+		resHeader, err = getJSON(client, req, page)
+		if err != nil {
+			return resHeader, err
+		}
+		onPage(page)
+		next = nextLink(resHeader)
+	}
+	return resHeader, nil
+}
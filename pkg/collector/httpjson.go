@@ -0,0 +1,392 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/util/jsonpath"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+)
+
+const defaultHTTPJSONMaxPages = 100
+
+// HTTPJSONMetric maps a JSON response to the series of one metric. Paths are
+// JSONPath expressions as accepted by kubectl, with or without the enclosing
+// braces.
+//
+// Items selects the objects producing a series each, e.g. .queues[*]; the
+// whole document is the single item if it is empty. Value and Labels are
+// evaluated against every item. Without Value, every item counts as 1, so
+// Items alone counts the objects of a list. The values of items with the same
+// labels, including items of different pages, are summed.
+type HTTPJSONMetric struct {
+	Name   string            `json:"name"`
+	Items  string            `json:"items,omitempty"`
+	Value  string            `json:"value,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	items  *jsonpath.JSONPath
+	value  *jsonpath.JSONPath
+	labels map[string]*jsonpath.JSONPath
+}
+
+// Compile validates m and parses its paths. It must be called before m is
+// used by a collector.
+func (m *HTTPJSONMetric) Compile() error {
+	if m.Name == "" {
+		return errors.New("name: required")
+	}
+	var err error
+	if m.Items != "" {
+		if m.items, err = parseJSONPath("items", m.Items); err != nil {
+			return err
+		}
+	}
+	if m.Value != "" {
+		if m.value, err = parseJSONPath("value", m.Value); err != nil {
+			return err
+		}
+	}
+	m.labels = make(map[string]*jsonpath.JSONPath, len(m.Labels))
+	for label, path := range m.Labels {
+		if label == "" {
+			return errors.New("labels: empty label name")
+		}
+		if m.labels[label], err = parseJSONPath("labels."+label, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseJSONPath(field, path string) (*jsonpath.JSONPath, error) {
+	if !strings.HasPrefix(path, "{") {
+		path = "{" + path + "}"
+	}
+	p := jsonpath.New(field).AllowMissingKeys(true)
+	if err := p.Parse(path); err != nil {
+		return nil, fmt.Errorf("%s: invalid JSONPath %q: %w", field, path, err)
+	}
+	return p, nil
+}
+
+// HTTPJSONPagination follows the pages of a paginated response. At most one
+// of LinkHeader, NextURL and NextCursor is expected to be set.
+type HTTPJSONPagination struct {
+	// LinkHeader follows the rel="next" URL of the Link header.
+	LinkHeader bool `json:"linkHeader,omitempty"`
+	// NextURL is the path of the next page URL in the response, which may
+	// be relative to the current one.
+	NextURL string `json:"nextURL,omitempty"`
+	// NextCursor is the path of an opaque cursor in the response, sent back
+	// in the query parameter CursorParam.
+	NextCursor  string `json:"nextCursor,omitempty"`
+	CursorParam string `json:"cursorParam,omitempty"`
+	// MaxPages bounds the number of requests of a scrape, 100 by default.
+	MaxPages int `json:"maxPages,omitempty"`
+
+	nextURL    *jsonpath.JSONPath
+	nextCursor *jsonpath.JSONPath
+}
+
+// Compile validates p and parses its paths.
+func (p *HTTPJSONPagination) Compile() error {
+	var err error
+	if p.NextURL != "" {
+		if p.nextURL, err = parseJSONPath("nextURL", p.NextURL); err != nil {
+			return err
+		}
+	}
+	if p.NextCursor != "" {
+		if p.CursorParam == "" {
+			return errors.New("cursorParam: required with nextCursor")
+		}
+		if p.nextCursor, err = parseJSONPath("nextCursor", p.NextCursor); err != nil {
+			return err
+		}
+	}
+	if p.MaxPages < 0 {
+		return errors.New("maxPages: must be positive")
+	}
+	if p.MaxPages == 0 {
+		p.MaxPages = defaultHTTPJSONMaxPages
+	}
+	return nil
+}
+
+// HTTPJSONCollector reads metrics from any HTTP endpoint returning JSON, so
+// in-house schedulers and CI vendors without a dedicated collector can be
+// scraped from configuration alone.
+type HTTPJSONCollector struct {
+	URL        string
+	Headers    http.Header
+	Pagination HTTPJSONPagination
+	Metrics    []HTTPJSONMetric
+
+	client *http.Client
+}
+
+// NewHTTPJSONCollector compiles pagination and metrics and returns a
+// collector sending headers with every request.
+func NewHTTPJSONCollector(endpoint string, headers http.Header, pagination HTTPJSONPagination, metrics []HTTPJSONMetric) (*HTTPJSONCollector, error) {
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, err
+	}
+	if err := pagination.Compile(); err != nil {
+		return nil, fmt.Errorf("pagination: %w", err)
+	}
+	for i := range metrics {
+		if err := metrics[i].Compile(); err != nil {
+			return nil, fmt.Errorf("metrics[%d]: %w", i, err)
+		}
+	}
+	return &HTTPJSONCollector{
+		URL:        endpoint,
+		Headers:    headers,
+		Pagination: pagination,
+		Metrics:    metrics,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// httpJSONSeries accumulates the value of one metric per label set.
+type httpJSONSeries struct {
+	labels map[string]map[string]string
+	values map[string]float64
+}
+
+func (c *HTTPJSONCollector) Collect(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
+	series := make([]httpJSONSeries, len(c.Metrics))
+	for i := range series {
+		series[i] = httpJSONSeries{labels: map[string]map[string]string{}, values: map[string]float64{}}
+	}
+	next := c.URL
+	for page := 1; next != ""; page++ {
+		if page > c.Pagination.MaxPages {
+			klog.Warningf("%s: stopped after %d pages", c.URL, c.Pagination.MaxPages)
+			break
+		}
+		var document interface{}
+		header, err := c.get(ctx, next, &document)
+		if err != nil {
+			return snapshot, err
+		}
+		for i := range c.Metrics {
+			if err := c.Metrics[i].extract(document, &series[i]); err != nil {
+				return snapshot, fmt.Errorf("metric %s: %w", c.Metrics[i].Name, err)
+			}
+		}
+		if next, err = c.nextPage(next, header, document); err != nil {
+			return snapshot, err
+		}
+	}
+	for i, m := range c.Metrics {
+		keys := make([]string, 0, len(series[i].values))
+		for key := range series[i].values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			snapshot.Add(external_metrics.ExternalMetricValue{
+				MetricName:   m.Name,
+				MetricLabels: series[i].labels[key],
+				Value:        floatQuantity(series[i].values[key]),
+			})
+		}
+	}
+	return snapshot, nil
+}
+
+// extract adds the items of document to series. Null items, and items
+// without a value or with a null one, are skipped.
+func (m *HTTPJSONMetric) extract(document interface{}, series *httpJSONSeries) error {
+	items := []interface{}{document}
+	if m.items != nil {
+		values, err := findJSONPath(m.items, document)
+		if err != nil {
+			return err
+		}
+		items = values
+	}
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		value := 1.0
+		if m.value != nil {
+			values, err := findJSONPath(m.value, item)
+			if err != nil {
+				return err
+			}
+			// A null value is missing, like an absent one.
+			if len(values) == 0 || values[0] == nil {
+				continue
+			}
+			if value, err = jsonNumber(values[0]); err != nil {
+				return fmt.Errorf("value: %w", err)
+			}
+		}
+		var labels map[string]string
+		if len(m.labels) > 0 {
+			labels = make(map[string]string, len(m.labels))
+		}
+		for label, path := range m.labels {
+			values, err := findJSONPath(path, item)
+			if err != nil {
+				return err
+			}
+			if len(values) > 0 {
+				labels[label] = jsonString(values[0])
+			} else {
+				labels[label] = ""
+			}
+		}
+		key := storage.SeriesKey(labels)
+		series.labels[key] = labels
+		series.values[key] += value
+	}
+	return nil
+}
+
+// nextPage returns the URL of the page following current, or "" if it was
+// the last one.
+func (c *HTTPJSONCollector) nextPage(current string, header http.Header, document interface{}) (string, error) {
+	p := c.Pagination
+	var next string
+	switch {
+	case p.LinkHeader:
+		next = nextLink(header)
+	case p.nextURL != nil:
+		values, err := findJSONPath(p.nextURL, document)
+		if err != nil || len(values) == 0 {
+			return "", err
+		}
+		next = jsonString(values[0])
+	case p.nextCursor != nil:
+		values, err := findJSONPath(p.nextCursor, document)
+		if err != nil || len(values) == 0 {
+			return "", err
+		}
+		cursor := jsonString(values[0])
+		if cursor == "" {
+			return "", nil
+		}
+		u, err := url.Parse(current)
+		if err != nil {
+			return "", err
+		}
+		query := u.Query()
+		query.Set(p.CursorParam, cursor)
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+	if next == "" {
+		return "", nil
+	}
+	base, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(next)
+	if err != nil {
+		return "", fmt.Errorf("invalid next page URL %q: %w", next, err)
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+func (c *HTTPJSONCollector) get(ctx context.Context, endpoint string, v interface{}) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.Headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("User-Agent", "buildscaler")
+	return getJSON(c.client, req, v)
+}
+
+// findJSONPath returns the values selected by path in data, flattened.
+func findJSONPath(path *jsonpath.JSONPath, data interface{}) ([]interface{}, error) {
+	results, err := path.FindResults(data)
+	if err != nil {
+		return nil, err
+	}
+	var values []interface{}
+	for _, result := range results {
+		for _, value := range result {
+			if !value.IsValid() || (value.Kind() == reflect.Interface && value.IsNil()) {
+				values = append(values, nil)
+				continue
+			}
+			values = append(values, value.Interface())
+		}
+	}
+	return values, nil
+}
+
+// jsonNumber converts a decoded JSON number, numeric string or boolean to a
+// float.
+func jsonNumber(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return 0, fmt.Errorf("expected a number, got %T", value)
+	}
+}
+
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// floatQuantity keeps integers exact and other values to the thousandth.
+func floatQuantity(value float64) resource.Quantity {
+	if value == math.Trunc(value) && math.Abs(value) < 1<<53 {
+		return *resource.NewQuantity(int64(value), resource.DecimalSI)
+	}
+	return *resource.NewMilliQuantity(int64(math.Round(value*1000)), resource.DecimalSI)
+}
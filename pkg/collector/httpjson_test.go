@@ -0,0 +1,173 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+)
+
+func collectHTTPJSON(t *testing.T, c *HTTPJSONCollector) *storage.ExternalMetricsMap {
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+	return st
+}
+
+func assertSeries(t *testing.T, st *storage.ExternalMetricsMap, name string, set map[string]string, expected string) {
+	series, ok := st.Get(name, labels.SelectorFromSet(set))
+	assert.True(t, ok, name)
+	if assert.Len(t, series, 1, "%s%v", name, set) {
+		assert.Equal(t, expected, series[0].Value.Value.String(), "%s%v", name, set)
+	}
+}
+
+func TestHTTPJSONCollector(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		_, _ = io.WriteString(w, `{
+"queues": [
+  {"name": "linux", "waiting": 3, "running": "2", "load": 0.25},
+  {"name": "macos", "waiting": 1, "running": "0", "load": 1.5},
+  {"name": "linux", "waiting": 2, "running": "1", "load": 0}
+],
+"agents": [
+  {"os": "linux", "busy": true},
+  {"os": "linux", "busy": false},
+  {"os": "windows", "busy": true}
+],
+"healthy": true
+}`)
+	}))
+	defer s.Close()
+
+	c, err := NewHTTPJSONCollector(s.URL, http.Header{"Authorization": {"Bearer secret"}}, HTTPJSONPagination{}, []HTTPJSONMetric{
+		{Name: "sched_waiting_jobs", Items: ".queues[*]", Value: ".waiting", Labels: map[string]string{"queue": ".name"}},
+		{Name: "sched_running_jobs", Items: "{.queues[*]}", Value: "{.running}", Labels: map[string]string{"queue": "{.name}"}},
+		{Name: "sched_load", Items: ".queues[?(@.name==\"macos\")]", Value: ".load"},
+		{Name: "sched_agents", Items: ".agents[*]", Labels: map[string]string{"os": ".os"}},
+		{Name: "sched_busy_agents", Items: ".agents[*]", Value: ".busy"},
+		{Name: "sched_healthy", Value: ".healthy"},
+	})
+	assert.NoError(t, err)
+	st := collectHTTPJSON(t, c)
+
+	assertSeries(t, st, "sched_waiting_jobs", map[string]string{"queue": "linux"}, "5")
+	assertSeries(t, st, "sched_waiting_jobs", map[string]string{"queue": "macos"}, "1")
+	assertSeries(t, st, "sched_running_jobs", map[string]string{"queue": "linux"}, "3")
+	assertSeries(t, st, "sched_load", nil, "1500m")
+	assertSeries(t, st, "sched_agents", map[string]string{"os": "linux"}, "2")
+	assertSeries(t, st, "sched_agents", map[string]string{"os": "windows"}, "1")
+	assertSeries(t, st, "sched_busy_agents", nil, "2")
+	assertSeries(t, st, "sched_healthy", nil, "1")
+}
+
+func TestHTTPJSONCollectorPagination(t *testing.T) {
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path + "?" + r.URL.RawQuery {
+		case "/link?":
+			w.Header().Set("Link", `<`+s.URL+`/link?page=2>; rel="next"`)
+			_, _ = io.WriteString(w, `{"jobs": [{"state": "queued"}]}`)
+		case "/link?page=2":
+			_, _ = io.WriteString(w, `{"jobs": [{"state": "queued"}, {"state": "running"}]}`)
+		case "/next?":
+			_, _ = io.WriteString(w, `{"jobs": [{"state": "queued"}], "next": "/next?page=2"}`)
+		case "/next?page=2":
+			_, _ = io.WriteString(w, `{"jobs": [{"state": "queued"}], "next": null}`)
+		case "/cursor?":
+			_, _ = io.WriteString(w, `{"jobs": [{"state": "queued"}], "meta": {"cursor": "abc"}}`)
+		case "/cursor?after=abc":
+			_, _ = io.WriteString(w, `{"jobs": [{"state": "running"}], "meta": {"cursor": ""}}`)
+		case "/loop?":
+			_, _ = io.WriteString(w, `{"jobs": [{"state": "queued"}], "next": "/loop"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+	metrics := func() []HTTPJSONMetric {
+		return []HTTPJSONMetric{{Name: "jobs", Items: ".jobs[*]", Labels: map[string]string{"state": ".state"}}}
+	}
+
+	for _, tc := range []struct {
+		path       string
+		pagination HTTPJSONPagination
+		queued     string
+	}{
+		{"/link", HTTPJSONPagination{LinkHeader: true}, "2"},
+		{"/next", HTTPJSONPagination{NextURL: ".next"}, "2"},
+		{"/cursor", HTTPJSONPagination{NextCursor: ".meta.cursor", CursorParam: "after"}, "1"},
+		{"/loop", HTTPJSONPagination{NextURL: ".next", MaxPages: 3}, "3"},
+	} {
+		c, err := NewHTTPJSONCollector(s.URL+tc.path, nil, tc.pagination, metrics())
+		assert.NoError(t, err)
+		st := collectHTTPJSON(t, c)
+		assertSeries(t, st, "jobs", map[string]string{"state": "queued"}, tc.queued)
+	}
+}
+
+func TestHTTPJSONMetricCompile(t *testing.T) {
+	_, err := NewHTTPJSONCollector("http://localhost", nil, HTTPJSONPagination{}, []HTTPJSONMetric{{Items: ".jobs[*]"}})
+	assert.EqualError(t, err, "metrics[0]: name: required")
+	_, err = NewHTTPJSONCollector("http://localhost", nil, HTTPJSONPagination{}, []HTTPJSONMetric{{Name: "jobs", Value: ".jobs[0"}})
+	assert.Error(t, err)
+	_, err = NewHTTPJSONCollector("http://localhost", nil, HTTPJSONPagination{NextCursor: ".cursor"}, nil)
+	assert.EqualError(t, err, "pagination: cursorParam: required with nextCursor")
+}
+
+func TestHTTPJSONCollectorInvalidValue(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"count": {"nested": 1}}`)
+	}))
+	defer s.Close()
+	c, err := NewHTTPJSONCollector(s.URL, nil, HTTPJSONPagination{}, []HTTPJSONMetric{{Name: "count", Value: ".count"}})
+	assert.NoError(t, err)
+	_, err = c.Collect(context.Background())
+	assert.EqualError(t, err, "metric count: value: expected a number, got map[string]interface {}")
+}
+
+func TestHTTPJSONCollectorNullValue(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{
+"count": null,
+"queues": [{"name": "linux", "waiting": null}, {"name": "linux", "waiting": 2}, null],
+"healthy": true
+}`)
+	}))
+	defer s.Close()
+	c, err := NewHTTPJSONCollector(s.URL, nil, HTTPJSONPagination{}, []HTTPJSONMetric{
+		{Name: "count", Value: ".count"},
+		{Name: "waiting", Items: ".queues[*]", Value: ".waiting", Labels: map[string]string{"queue": ".name"}},
+		{Name: "queues", Items: ".queues[*]", Labels: map[string]string{"queue": ".name"}},
+		{Name: "healthy", Value: ".healthy"},
+	})
+	assert.NoError(t, err)
+	st := collectHTTPJSON(t, c)
+
+	_, ok := st.Get("count", labels.Everything())
+	assert.False(t, ok)
+	assertSeries(t, st, "waiting", map[string]string{"queue": "linux"}, "2")
+	assertSeries(t, st, "queues", map[string]string{"queue": "linux"}, "2")
+	assertSeries(t, st, "healthy", nil, "1")
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	InClusterNamespaceLabel = "namespace"
+
+	TektonTaskRunLabel  = "tekton.dev/taskRun"
+	ArgoWorkflowLabel   = "workflows.argoproj.io/workflow"
+	tektonSucceeded     = "Succeeded"
+	tektonReasonRunning = "Running"
+
+	// inClusterSyncTimeout is how long a scrape waits for the cache to be
+	// filled, e.g. right after startup.
+	inClusterSyncTimeout = time.Minute
+)
+
+var (
+	TektonPipelineRunKind = schema.GroupVersionKind{Group: "tekton.dev", Version: "v1beta1", Kind: "PipelineRun"}
+	TektonTaskRunKind     = schema.GroupVersionKind{Group: "tekton.dev", Version: "v1beta1", Kind: "TaskRun"}
+	ArgoWorkflowKind      = schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Workflow"}
+)
+
+// InClusterCollector reports pending and running Tekton PipelineRuns and
+// TaskRuns, Argo Workflows, and the pending, running and unschedulable pods
+// they created, read from the cluster buildscaler runs in. Every metric is
+// labeled with the namespace and with the GroupByLabels of the object.
+type InClusterCollector struct {
+	Tekton        bool
+	Argo          bool
+	GroupByLabels []string
+
+	reader    client.Reader
+	cache     cache.Cache
+	startOnce sync.Once
+	cancel    context.CancelFunc
+}
+
+// NewInClusterCollector returns a collector reading from a controller-runtime
+// cache of the objects in namespace, or in all namespaces if it is empty.
+// The cache is started by the first Collect and stopped by Close.
+func NewInClusterCollector(cfg *rest.Config, namespace string, tekton, argo bool, groupByLabels []string) (*InClusterCollector, error) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	// Only cache the pods that Tekton or Argo created and that did not
+	// terminate yet, instead of every pod of the cluster. A label selector
+	// cannot match either of two labels, so pods are only filtered by
+	// label when a single CI system is enabled.
+	pods := labels.Everything()
+	if tekton != argo {
+		ownerLabel := TektonTaskRunLabel
+		if argo {
+			ownerLabel = ArgoWorkflowLabel
+		}
+		owned, err := labels.NewRequirement(ownerLabel, selection.Exists, nil)
+		if err != nil {
+			return nil, err
+		}
+		pods = labels.NewSelector().Add(*owned)
+	}
+	c, err := cache.New(cfg, cache.Options{
+		Scheme:    scheme,
+		Namespace: namespace,
+		SelectorsByObject: cache.SelectorsByObject{
+			&corev1.Pod{}: {
+				Label: pods,
+				Field: fields.AndSelectors(
+					fields.OneTermNotEqualSelector("status.phase", string(corev1.PodSucceeded)),
+					fields.OneTermNotEqualSelector("status.phase", string(corev1.PodFailed)),
+				),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	collector := newInClusterCollector(c, tekton, argo, groupByLabels)
+	collector.cache = c
+	return collector, nil
+}
+
+func newInClusterCollector(reader client.Reader, tekton, argo bool, groupByLabels []string) *InClusterCollector {
+	return &InClusterCollector{
+		Tekton:        tekton,
+		Argo:          argo,
+		GroupByLabels: groupByLabels,
+		reader:        reader,
+	}
+}
+
+// Close stops the cache.
+func (c *InClusterCollector) Close() error {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	return nil
+}
+
+func (c *InClusterCollector) start() {
+	if c.cache == nil {
+		return
+	}
+	var ctx context.Context
+	ctx, c.cancel = context.WithCancel(context.Background())
+	go func() {
+		if err := c.cache.Start(ctx); err != nil {
+			klog.Errorf("in-cluster cache stopped: %s", err)
+		}
+	}()
+}
+
+func (c *InClusterCollector) Collect(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
+	c.startOnce.Do(c.start)
+	if c.cache != nil {
+		// Listing before the cache is filled would report empty lists.
+		syncCtx, cancel := context.WithTimeout(ctx, inClusterSyncTimeout)
+		synced := c.cache.WaitForCacheSync(syncCtx)
+		cancel()
+		if !synced {
+			return snapshot, errors.New("in-cluster cache did not sync")
+		}
+	}
+	if c.Tekton {
+		counter := newSeriesCounter("tekton_",
+			"pipelinerun_pending_count", "pipelinerun_running_count",
+			"taskrun_pending_count", "taskrun_running_count",
+			"pod_pending_count", "pod_running_count", "pod_unschedulable_count")
+		for kind, prefix := range map[schema.GroupVersionKind]string{
+			TektonPipelineRunKind: "pipelinerun_",
+			TektonTaskRunKind:     "taskrun_",
+		} {
+			runs, err := c.list(ctx, kind)
+			if err != nil {
+				return snapshot, err
+			}
+			for _, run := range runs {
+				if state := tektonRunState(run); state != "" {
+					counter.inc(prefix+state+"_count", c.seriesLabels(run.GetNamespace(), run.GetLabels()))
+				}
+			}
+		}
+		if err := c.countPods(ctx, TektonTaskRunLabel, counter); err != nil {
+			return snapshot, err
+		}
+		counter.addTo(&snapshot)
+	}
+	if c.Argo {
+		counter := newSeriesCounter("argo_",
+			"workflow_pending_count", "workflow_running_count",
+			"pod_pending_count", "pod_running_count", "pod_unschedulable_count")
+		workflows, err := c.list(ctx, ArgoWorkflowKind)
+		if err != nil {
+			return snapshot, err
+		}
+		for _, workflow := range workflows {
+			phase, _, _ := unstructured.NestedString(workflow.Object, "status", "phase")
+			switch phase {
+			case "", "Pending":
+				counter.inc("workflow_pending_count", c.seriesLabels(workflow.GetNamespace(), workflow.GetLabels()))
+			case "Running":
+				counter.inc("workflow_running_count", c.seriesLabels(workflow.GetNamespace(), workflow.GetLabels()))
+			}
+		}
+		if err := c.countPods(ctx, ArgoWorkflowLabel, counter); err != nil {
+			return snapshot, err
+		}
+		counter.addTo(&snapshot)
+	}
+	return snapshot, nil
+}
+
+func (c *InClusterCollector) list(ctx context.Context, kind schema.GroupVersionKind) ([]unstructured.Unstructured, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(kind.GroupVersion().WithKind(kind.Kind + "List"))
+	if err := c.reader.List(ctx, list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// countPods counts the pods having the label ownerLabel, which Tekton and
+// Argo set on the pods they create.
+func (c *InClusterCollector) countPods(ctx context.Context, ownerLabel string, counter *seriesCounter) error {
+	var pods corev1.PodList
+	if err := c.reader.List(ctx, &pods, client.HasLabels{ownerLabel}); err != nil {
+		return err
+	}
+	for _, pod := range pods.Items {
+		labels := c.seriesLabels(pod.Namespace, pod.Labels)
+		switch pod.Status.Phase {
+		case corev1.PodPending:
+			counter.inc("pod_pending_count", labels)
+			if podUnschedulable(&pod) {
+				counter.inc("pod_unschedulable_count", labels)
+			}
+		case corev1.PodRunning:
+			counter.inc("pod_running_count", labels)
+		}
+	}
+	return nil
+}
+
+func (c *InClusterCollector) seriesLabels(namespace string, objectLabels map[string]string) map[string]string {
+	labels := map[string]string{InClusterNamespaceLabel: namespace}
+	for _, key := range c.GroupByLabels {
+		labels[key] = objectLabels[key]
+	}
+	return labels
+}
+
+// tektonRunState returns "pending" or "running" for an unfinished
+// PipelineRun or TaskRun, and "" for a finished one.
+func tektonRunState(run unstructured.Unstructured) string {
+	conditions, _, _ := unstructured.NestedSlice(run.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != tektonSucceeded {
+			continue
+		}
+		switch {
+		case condition["status"] != string(corev1.ConditionUnknown):
+			return ""
+		case condition["reason"] == tektonReasonRunning:
+			return "running"
+		}
+	}
+	return "pending"
+}
+
+func podUnschedulable(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse && condition.Reason == corev1.PodReasonUnschedulable {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+)
+
+func newRun(kind schema.GroupVersionKind, namespace, name, team string, status map[string]interface{}) *unstructured.Unstructured {
+	run := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	run.SetGroupVersionKind(kind)
+	run.SetNamespace(namespace)
+	run.SetName(name)
+	run.SetLabels(map[string]string{"team": team})
+	if status != nil {
+		run.Object["status"] = status
+	}
+	return run
+}
+
+func tektonStatus(status, reason string) map[string]interface{} {
+	return map[string]interface{}{
+		"conditions": []interface{}{
+			map[string]interface{}{"type": "Succeeded", "status": status, "reason": reason},
+		},
+	}
+}
+
+func newPod(namespace, name, ownerLabel, team string, phase corev1.PodPhase, unschedulable bool) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{ownerLabel: "owner", "team": team},
+		},
+		Status: corev1.PodStatus{Phase: phase},
+	}
+	if unschedulable {
+		pod.Status.Conditions = []corev1.PodCondition{{
+			Type:   corev1.PodScheduled,
+			Status: corev1.ConditionFalse,
+			Reason: corev1.PodReasonUnschedulable,
+		}}
+	}
+	return pod
+}
+
+func TestInClusterCollector(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, clientgoscheme.AddToScheme(scheme))
+	objects := []client.Object{
+		newRun(TektonPipelineRunKind, "ci", "pr-1", "web", nil),
+		newRun(TektonPipelineRunKind, "ci", "pr-2", "web", tektonStatus("Unknown", "Running")),
+		newRun(TektonPipelineRunKind, "ci", "pr-3", "web", tektonStatus("True", "Succeeded")),
+		newRun(TektonTaskRunKind, "ci", "tr-1", "web", tektonStatus("Unknown", "Pending")),
+		newRun(TektonTaskRunKind, "ci", "tr-2", "api", tektonStatus("Unknown", "Running")),
+		newRun(ArgoWorkflowKind, "argo", "wf-1", "data", map[string]interface{}{"phase": "Pending"}),
+		newRun(ArgoWorkflowKind, "argo", "wf-2", "data", map[string]interface{}{"phase": "Running"}),
+		newRun(ArgoWorkflowKind, "argo", "wf-3", "data", map[string]interface{}{"phase": "Failed"}),
+		newPod("ci", "tr-1-pod", TektonTaskRunLabel, "web", corev1.PodPending, true),
+		newPod("ci", "tr-2-pod", TektonTaskRunLabel, "api", corev1.PodRunning, false),
+		newPod("argo", "wf-1-pod", ArgoWorkflowLabel, "data", corev1.PodPending, false),
+		newPod("argo", "wf-2-pod", ArgoWorkflowLabel, "data", corev1.PodRunning, false),
+		newPod("ci", "unrelated", "app", "web", corev1.PodPending, true),
+	}
+	reader := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+	c := newInClusterCollector(reader, true, true, []string{"team"})
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, c.Close())
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+
+	for _, tc := range []struct {
+		name      string
+		namespace string
+		team      string
+		expected  int64
+	}{
+		{"tekton_pipelinerun_pending_count", "ci", "web", 1},
+		{"tekton_pipelinerun_running_count", "ci", "web", 1},
+		{"tekton_taskrun_pending_count", "ci", "web", 1},
+		{"tekton_taskrun_running_count", "ci", "web", 0},
+		{"tekton_taskrun_running_count", "ci", "api", 1},
+		{"tekton_pod_pending_count", "ci", "web", 1},
+		{"tekton_pod_unschedulable_count", "ci", "web", 1},
+		{"tekton_pod_running_count", "ci", "api", 1},
+		{"argo_workflow_pending_count", "argo", "data", 1},
+		{"argo_workflow_running_count", "argo", "data", 1},
+		{"argo_pod_pending_count", "argo", "data", 1},
+		{"argo_pod_unschedulable_count", "argo", "data", 0},
+	} {
+		selector := labels.SelectorFromSet(map[string]string{InClusterNamespaceLabel: tc.namespace, "team": tc.team})
+		series, ok := st.Get(tc.name, selector)
+		assert.True(t, ok, tc.name)
+		if assert.Len(t, series, 1, "%s{%s}", tc.name, selector) {
+			assert.Equal(t, tc.expected, series[0].Value.Value.Value(), "%s{%s}", tc.name, selector)
+		}
+	}
+	for name, expected := range map[string]int64{
+		"tekton_total_pod_pending_count":       1,
+		"tekton_total_pod_unschedulable_count": 1,
+		"tekton_total_taskrun_running_count":   1,
+		"argo_total_workflow_running_count":    1,
+	} {
+		series, ok := st.Get(name, labels.Everything())
+		assert.True(t, ok, name)
+		if assert.Len(t, series, 1, name) {
+			assert.Equal(t, expected, series[0].Value.Value.Value(), name)
+		}
+	}
+}
+
+// unsyncedCache is a cache that never finishes filling.
+type unsyncedCache struct {
+	cache.Cache
+}
+
+func (unsyncedCache) Start(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (unsyncedCache) WaitForCacheSync(ctx context.Context) bool {
+	return false
+}
+
+func TestInClusterCollectorNotSynced(t *testing.T) {
+	reader := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+	c := newInClusterCollector(reader, true, false, nil)
+	c.cache = unsyncedCache{}
+	defer c.Close()
+	snapshot, err := c.Collect(context.Background())
+	assert.EqualError(t, err, "in-cluster cache did not sync")
+	assert.Empty(t, snapshot.Metrics)
+}
@@ -13,8 +13,64 @@ limitations under the License.
 
 package collector
 
-import "context"
+import (
+	"context"
+	"time"
 
+	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+)
+
+// Snapshot holds all metrics returned by a single successful scrape.
+type Snapshot struct {
+	Metrics []external_metrics.ExternalMetricValue
+	// PollAfter is how long the CI platform asked clients to wait before
+	// the next scrape, zero if it did not ask.
+	PollAfter time.Duration
+	// Retained selects the series of previous scrapes to keep although
+	// they are missing from Metrics, see PartialError.
+	Retained []storage.Selection
+}
+
+// PartialError is returned by Collect together with a snapshot of the parts
+// of the CI platform that were scraped, e.g. the Buildkite organizations whose
+// token worked. The snapshot is committed like a successful one, and retains
+// the series of the parts that failed.
+type PartialError struct {
+	Err error
+}
+
+func (e *PartialError) Error() string {
+	return "partially failed: " + e.Err.Error()
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// Add appends a metric to the snapshot.
+func (s *Snapshot) Add(value external_metrics.ExternalMetricValue) {
+	s.Metrics = append(s.Metrics, value)
+}
+
+// Batch stages every metric of the snapshot under its metric name, ready to
+// be committed to a storage.MetricsStore.
+func (s Snapshot) Batch() *storage.Batch {
+	batch := storage.NewBatch()
+	for _, value := range s.Metrics {
+		batch.Add(value.MetricName, value)
+	}
+	for _, selection := range s.Retained {
+		batch.Retain(selection)
+	}
+	return batch
+}
+
+// CIMetricsCollector scrapes a CI platform. Collect must return when ctx is
+// done, and must not have side effects: the caller decides what to do with
+// the snapshot, or with the error. Collectors holding resources, like a
+// watch cache, also implement io.Closer and are closed when replaced.
 type CIMetricsCollector interface {
-	Collect(cancel context.CancelFunc) error
+	Collect(ctx context.Context) (Snapshot, error)
 }
@@ -0,0 +1,202 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	JenkinsLabelLabel = "label"
+
+	jenkinsQueueTree    = "items[id,buildable,blocked,stuck,why,assignedLabel[name]]"
+	jenkinsComputerTree = "computer[displayName,offline,numExecutors,assignedLabels[name],executors[idle]]"
+)
+
+// jenkinsWhyLabel extracts the label a queue item waits for from its "why"
+// text, e.g. "Waiting for next available executor on ‘linux’" or "There are
+// no nodes with the label ‘linux’".
+var jenkinsWhyLabel = regexp.MustCompile(`(?:executor on|label) [‘'"]([^’'"]+)[’'"]`)
+
+type jenkinsQueue struct {
+	Items []jenkinsQueueItem `json:"items"`
+}
+
+type jenkinsQueueItem struct {
+	ID            int64  `json:"id"`
+	Buildable     bool   `json:"buildable"`
+	Blocked       bool   `json:"blocked"`
+	Stuck         bool   `json:"stuck"`
+	Why           string `json:"why"`
+	AssignedLabel *struct {
+		Name string `json:"name"`
+	} `json:"assignedLabel"`
+}
+
+type jenkinsComputers struct {
+	Computer []jenkinsComputer `json:"computer"`
+}
+
+type jenkinsComputer struct {
+	DisplayName    string `json:"displayName"`
+	Offline        bool   `json:"offline"`
+	NumExecutors   int64  `json:"numExecutors"`
+	AssignedLabels []struct {
+		Name string `json:"name"`
+	} `json:"assignedLabels"`
+	Executors []struct {
+		Idle bool `json:"idle"`
+	} `json:"executors"`
+}
+
+// jenkinsCounts holds the metrics reported for a single node label.
+type jenkinsCounts struct {
+	QueuedItems    int64
+	BuildableItems int64
+	BusyExecutors  int64
+	IdleExecutors  int64
+}
+
+// JenkinsCollector reports the build queue and the executors of online
+// nodes, per node label. A node with several labels is counted for each of
+// them, while the totals count it once.
+type JenkinsCollector struct {
+	Endpoint string
+	User     string
+	Token    string
+
+	client *http.Client
+}
+
+func NewJenkinsCollector(endpoint, user, token string) *JenkinsCollector {
+	return &JenkinsCollector{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		User:     user,
+		Token:    token,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *JenkinsCollector) Collect(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
+	counts := map[string]*jenkinsCounts{}
+	// Labels and label expressions, e.g. "linux && docker", may contain
+	// characters label values cannot.
+	countsFor := func(label string) *jenkinsCounts {
+		key := labelValue(label)
+		if counts[key] == nil {
+			counts[key] = &jenkinsCounts{}
+		}
+		return counts[key]
+	}
+	var total jenkinsCounts
+
+	var queue jenkinsQueue
+	if err := c.get(ctx, "/queue/api/json", jenkinsQueueTree, &queue); err != nil {
+		return snapshot, err
+	}
+	for _, item := range queue.Items {
+		count := countsFor(jenkinsItemLabel(item))
+		count.QueuedItems++
+		total.QueuedItems++
+		if item.Buildable {
+			count.BuildableItems++
+			total.BuildableItems++
+		}
+	}
+
+	var computers jenkinsComputers
+	if err := c.get(ctx, "/computer/api/json", jenkinsComputerTree, &computers); err != nil {
+		return snapshot, err
+	}
+	for _, computer := range computers.Computer {
+		if computer.Offline {
+			continue
+		}
+		var busy int64
+		for _, executor := range computer.Executors {
+			if !executor.Idle {
+				busy++
+			}
+		}
+		idle := computer.NumExecutors - busy
+		if idle < 0 {
+			idle = 0
+		}
+		total.BusyExecutors += busy
+		total.IdleExecutors += idle
+		for _, label := range computer.AssignedLabels {
+			count := countsFor(label.Name)
+			count.BusyExecutors += busy
+			count.IdleExecutors += idle
+		}
+	}
+
+	for label, count := range counts {
+		count.addTo(&snapshot, "jenkins_", map[string]string{JenkinsLabelLabel: label})
+	}
+	total.addTo(&snapshot, "jenkins_total_", nil)
+	return snapshot, nil
+}
+
+func (j *jenkinsCounts) addTo(snapshot *Snapshot, prefix string, labels map[string]string) {
+	for name, value := range map[string]int64{
+		"queued_items_count":    j.QueuedItems,
+		"buildable_items_count": j.BuildableItems,
+		"busy_executor_count":   j.BusyExecutors,
+		"idle_executor_count":   j.IdleExecutors,
+	} {
+		snapshot.Add(external_metrics.ExternalMetricValue{
+			MetricName:   prefix + name,
+			MetricLabels: labels,
+			Value:        *resource.NewQuantity(value, resource.DecimalSI),
+		})
+	}
+}
+
+// jenkinsItemLabel returns the label or label expression a queue item is
+// waiting for, or "" if it can run on any node or the label is unknown.
+func jenkinsItemLabel(item jenkinsQueueItem) string {
+	if item.AssignedLabel != nil && item.AssignedLabel.Name != "" {
+		return item.AssignedLabel.Name
+	}
+	if match := jenkinsWhyLabel.FindStringSubmatch(item.Why); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+func (c *JenkinsCollector) get(ctx context.Context, path, tree string, v interface{}) error {
+	endpoint, err := url.Parse(c.Endpoint + path)
+	if err != nil {
+		return err
+	}
+	endpoint.RawQuery = url.Values{"tree": {tree}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.User, c.Token)
+	req.Header.Set("User-Agent", "buildscaler")
+	_, err = getJSON(c.client, req, v)
+	return err
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+)
+
+func TestJenkinsCollector(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, token, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "admin", user)
+		assert.Equal(t, "api-token", token)
+		assert.NotEmpty(t, r.URL.Query().Get("tree"))
+		switch r.URL.Path {
+		case "/jenkins/queue/api/json":
+			_, _ = io.WriteString(w, `{"items": [
+{"id": 1, "buildable": true, "why": "Waiting for next available executor on ‘linux’"},
+{"id": 2, "buildable": true, "why": "There are no nodes with the label ‘linux’"},
+{"id": 3, "buildable": false, "blocked": true, "why": "Build #4 is already in progress", "assignedLabel": {"name": "linux"}},
+{"id": 4, "buildable": true, "why": "Waiting for next available executor"},
+{"id": 5, "buildable": true, "why": "There are no nodes with the label ‘linux && docker’", "assignedLabel": {"name": "linux && docker"}}
+]}`)
+		case "/jenkins/computer/api/json":
+			_, _ = io.WriteString(w, `{"computer": [
+{"displayName": "Built-In Node", "offline": false, "numExecutors": 2, "assignedLabels": [{"name": "built-in"}], "executors": [{"idle": true}, {"idle": true}]},
+{"displayName": "agent-1", "offline": false, "numExecutors": 2, "assignedLabels": [{"name": "agent-1"}, {"name": "linux"}], "executors": [{"idle": false}, {"idle": true}]},
+{"displayName": "agent-2", "offline": false, "numExecutors": 1, "assignedLabels": [{"name": "agent-2"}, {"name": "linux"}], "executors": [{"idle": false}]},
+{"displayName": "agent-3", "offline": true, "numExecutors": 4, "assignedLabels": [{"name": "agent-3"}, {"name": "linux"}], "executors": []}
+]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	c := NewJenkinsCollector(s.URL+"/jenkins/", "admin", "api-token")
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+
+	for _, tc := range []struct {
+		name     string
+		label    string
+		expected int64
+	}{
+		{"jenkins_queued_items_count", "linux", 3},
+		{"jenkins_buildable_items_count", "linux", 2},
+		{"jenkins_busy_executor_count", "linux", 2},
+		{"jenkins_idle_executor_count", "linux", 1},
+		{"jenkins_idle_executor_count", "agent-1", 1},
+		{"jenkins_idle_executor_count", "built-in", 2},
+		{"jenkins_queued_items_count", "", 1},
+		{"jenkins_queued_items_count", "linux_docker", 1},
+		{"jenkins_idle_executor_count", "linux_docker", 0},
+	} {
+		series, ok := st.Get(tc.name, labels.SelectorFromSet(map[string]string{JenkinsLabelLabel: tc.label}))
+		assert.True(t, ok, tc.name)
+		if assert.Len(t, series, 1, "%s{%s}", tc.name, tc.label) {
+			assert.Equal(t, tc.expected, series[0].Value.Value.Value(), "%s{%s}", tc.name, tc.label)
+		}
+	}
+	for name, expected := range map[string]int64{
+		"jenkins_total_queued_items_count":    5,
+		"jenkins_total_buildable_items_count": 4,
+		"jenkins_total_busy_executor_count":   2,
+		"jenkins_total_idle_executor_count":   3,
+	} {
+		series, ok := st.Get(name, labels.Everything())
+		assert.True(t, ok, name)
+		if assert.Len(t, series, 1, name) {
+			assert.Equal(t, expected, series[0].Value.Value.Value(), name)
+		}
+	}
+}
+
+func TestJenkinsCollectorUnauthorized(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer s.Close()
+	c := NewJenkinsCollector(s.URL, "admin", "wrong")
+	_, err := c.Collect(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "401 Unauthorized")
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var invalidLabelValueChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// labelSet returns the label value identifying a set of runner labels or
+// tags: the lower-cased labels, sorted and joined with "_". Commas are not
+// allowed in Kubernetes label values, so they cannot be used as separator.
+func labelSet(labels []string) string {
+	set := make([]string, 0, len(labels))
+	for _, l := range labels {
+		set = append(set, strings.ToLower(l))
+	}
+	sort.Strings(set)
+	return labelValue(strings.Join(set, "_"))
+}
+
+// hasLabels reports whether labels include every label of required, ignoring
+// case, e.g. whether a runner can run a job requiring them.
+func hasLabels(labels, required []string) bool {
+	have := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		have[strings.ToLower(l)] = true
+	}
+	for _, l := range required {
+		if !have[strings.ToLower(l)] {
+			return false
+		}
+	}
+	return true
+}
+
+// labelValue turns s into a valid Kubernetes label value. Runs of characters
+// other than alphanumerics, '-', '_' and '.' are replaced with "_", and
+// leading and trailing non-alphanumerics are trimmed. Values longer than 63
+// characters are cut and end with a hash of s, so they stay distinct.
+func labelValue(s string) string {
+	value := invalidLabelValueChars.ReplaceAllString(s, "_")
+	value = strings.TrimFunc(value, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(value) > validation.LabelValueMaxLength {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(s))
+		value = fmt.Sprintf("%s-%08x", value[:validation.LabelValueMaxLength-9], h.Sum32())
+	}
+	return value
+}
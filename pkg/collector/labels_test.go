@@ -0,0 +1,43 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestLabelSet(t *testing.T) {
+	assert.Equal(t, "linux_self-hosted_x64", labelSet([]string{"self-hosted", "X64", "Linux"}))
+	assert.Equal(t, "", labelSet(nil))
+
+	long := labelSet([]string{"self-hosted", "linux", "x64", "ubuntu-22.04", "gpu-nvidia-a100", "large-disk-ssd"})
+	assert.Len(t, long, 63)
+	assert.Empty(t, validation.IsValidLabelValue(long))
+	assert.NotEqual(t, long, labelSet([]string{"self-hosted", "linux", "x64", "ubuntu-22.04", "gpu-nvidia-a100", "large-disk-ssd", "arm64"}))
+}
+
+func TestLabelValue(t *testing.T) {
+	assert.Equal(t, "linux_docker", labelValue("linux && docker"))
+	assert.Equal(t, "a_b", labelValue("(a||b)"))
+	assert.Equal(t, "", labelValue("!"))
+}
+
+func TestHasLabels(t *testing.T) {
+	assert.True(t, hasLabels([]string{"self-hosted", "Linux"}, []string{"linux"}))
+	assert.True(t, hasLabels([]string{"self-hosted"}, nil))
+	assert.False(t, hasLabels([]string{"self-hosted"}, []string{"self-hosted", "gpu"}))
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	prometheusNameLabel = "__name__"
+	// Prometheus text format is requested, as servers negotiating the format
+	// may otherwise answer with OpenMetrics features the parser rejects.
+	prometheusAccept = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+)
+
+// PrometheusCollector translates Prometheus metrics into external metrics,
+// either by scraping an endpoint exposing the Prometheus text format, like
+// buildkite-agent-metrics or GitLab Runner, or by running an instant PromQL
+// query against a Prometheus compatible API.
+type PrometheusCollector struct {
+	// URL is the endpoint scraped, e.g. http://runner:9252/metrics, or the
+	// base URL of the Prometheus API, e.g. http://prometheus:9090, when
+	// Query is set.
+	URL   string
+	Query string
+	// MetricName names the results of Query, instead of their __name__
+	// label which aggregations drop.
+	MetricName string
+	// Match keeps only the metrics whose name fully matches one of these
+	// regular expressions. Every metric is kept if it is empty.
+	Match   []string
+	Headers http.Header
+
+	match  []*regexp.Regexp
+	client *http.Client
+}
+
+func NewPrometheusCollector(endpoint, query, metricName string, match []string, headers http.Header) (*PrometheusCollector, error) {
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, err
+	}
+	c := &PrometheusCollector{
+		URL:        strings.TrimSuffix(endpoint, "/"),
+		Query:      query,
+		MetricName: metricName,
+		Match:      match,
+		Headers:    headers,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, m := range match {
+		regex, err := regexp.Compile("^(?:" + m + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid match %q: %w", m, err)
+		}
+		c.match = append(c.match, regex)
+	}
+	return c, nil
+}
+
+func (c *PrometheusCollector) Collect(ctx context.Context) (Snapshot, error) {
+	if c.Query != "" {
+		return c.query(ctx)
+	}
+	return c.scrape(ctx)
+}
+
+func (c *PrometheusCollector) scrape(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
+	req, err := c.newRequest(ctx, c.URL)
+	if err != nil {
+		return snapshot, err
+	}
+	req.Header.Set("Accept", prometheusAccept)
+	res, err := sendRequest(c.client, req)
+	if err != nil {
+		return snapshot, err
+	}
+	defer res.Body.Close()
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(res.Body)
+	if err != nil {
+		return snapshot, fmt.Errorf("GET %s: %w", req.URL.Redacted(), err)
+	}
+	for name, family := range families {
+		for _, m := range family.Metric {
+			labels := make(map[string]string, len(m.Label))
+			for _, label := range m.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				c.add(&snapshot, name, labels, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				c.add(&snapshot, name, labels, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				c.add(&snapshot, name, labels, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				c.add(&snapshot, name+"_sum", labels, summary.GetSampleSum())
+				c.add(&snapshot, name+"_count", labels, float64(summary.GetSampleCount()))
+				for _, q := range summary.Quantile {
+					c.add(&snapshot, name, withLabel(labels, "quantile", formatFloat(q.GetQuantile())), q.GetValue())
+				}
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				c.add(&snapshot, name+"_sum", labels, histogram.GetSampleSum())
+				c.add(&snapshot, name+"_count", labels, float64(histogram.GetSampleCount()))
+				for _, b := range histogram.Bucket {
+					c.add(&snapshot, name+"_bucket", withLabel(labels, "le", formatFloat(b.GetUpperBound())), float64(b.GetCumulativeCount()))
+				}
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+type prometheusQueryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+type prometheusSample struct {
+	Metric map[string]string `json:"metric"`
+	// Value is a [<unix time>, "<value>"] pair.
+	Value [2]interface{} `json:"value"`
+}
+
+func (c *PrometheusCollector) query(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
+	req, err := c.newRequest(ctx, c.URL+"/api/v1/query?"+url.Values{"query": {c.Query}}.Encode())
+	if err != nil {
+		return snapshot, err
+	}
+	var response prometheusQueryResponse
+	if _, err := getJSON(c.client, req, &response); err != nil {
+		return snapshot, err
+	}
+	if response.Status != "success" {
+		return snapshot, fmt.Errorf("query %q failed: %s", c.Query, response.Error)
+	}
+	var samples []prometheusSample
+	switch response.Data.ResultType {
+	case "vector":
+		if err := json.Unmarshal(response.Data.Result, &samples); err != nil {
+			return snapshot, err
+		}
+	case "scalar":
+		var sample prometheusSample
+		if err := json.Unmarshal(response.Data.Result, &sample.Value); err != nil {
+			return snapshot, err
+		}
+		samples = append(samples, sample)
+	default:
+		return snapshot, fmt.Errorf("query %q: unsupported result type %s, expected vector or scalar", c.Query, response.Data.ResultType)
+	}
+	for _, sample := range samples {
+		name := c.MetricName
+		if name == "" {
+			name = sample.Metric[prometheusNameLabel]
+		}
+		if name == "" {
+			return snapshot, fmt.Errorf("query %q: result without %s, metric name required", c.Query, prometheusNameLabel)
+		}
+		raw, ok := sample.Value[1].(string)
+		if !ok {
+			return snapshot, fmt.Errorf("query %q: invalid sample value %v", c.Query, sample.Value[1])
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return snapshot, fmt.Errorf("query %q: %w", c.Query, err)
+		}
+		var labels map[string]string
+		for label, labelValue := range sample.Metric {
+			if label == prometheusNameLabel {
+				continue
+			}
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			labels[label] = labelValue
+		}
+		c.add(&snapshot, name, labels, value)
+	}
+	return snapshot, nil
+}
+
+// add adds a sample kept by Match to snapshot. Colons, valid in Prometheus
+// recording rule names, are replaced since external metric names are path
+// segments of the API. The le="+Inf" of the last histogram bucket becomes
+// le="inf", "+Inf" not being a valid label value to select. Samples without
+// a finite value are dropped.
+func (c *PrometheusCollector) add(snapshot *Snapshot, name string, labels map[string]string, value float64) {
+	if !c.matches(name) || math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	name = strings.ReplaceAll(name, ":", "_")
+	if labels["le"] == "+Inf" {
+		labels = withLabel(labels, "le", "inf")
+	}
+	if len(labels) == 0 {
+		labels = nil
+	}
+	snapshot.Add(external_metrics.ExternalMetricValue{
+		MetricName:   name,
+		MetricLabels: labels,
+		Value:        floatQuantity(value),
+	})
+}
+
+func (c *PrometheusCollector) matches(name string) bool {
+	if len(c.match) == 0 {
+		return true
+	}
+	for _, regex := range c.match {
+		if regex.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *PrometheusCollector) newRequest(ctx context.Context, endpoint string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.Headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("User-Agent", "buildscaler")
+	return req, nil
+}
+
+func withLabel(labels map[string]string, name, value string) map[string]string {
+	copied := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		copied[k] = v
+	}
+	copied[name] = value
+	return copied
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+)
+
+const prometheusText = `# HELP buildkite_queues_scheduled_jobs_count Buildkite scheduled jobs
+# TYPE buildkite_queues_scheduled_jobs_count gauge
+buildkite_queues_scheduled_jobs_count{queue="default"} 3
+buildkite_queues_scheduled_jobs_count{queue="deploy"} 0
+# TYPE gitlab_runner_jobs gauge
+gitlab_runner_jobs{executor_stage="prepare_executor",state="running"} 2
+# TYPE job_duration_seconds histogram
+job_duration_seconds_bucket{le="60"} 1
+job_duration_seconds_bucket{le="+Inf"} 4
+job_duration_seconds_sum 300.5
+job_duration_seconds_count 4
+# TYPE queue:wait_seconds:avg untyped
+queue:wait_seconds:avg NaN
+queue:jobs:sum 7
+`
+
+func TestPrometheusCollectorScrape(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/metrics", r.URL.Path)
+		assert.Contains(t, r.Header.Get("Accept"), "text/plain")
+		_, _ = io.WriteString(w, prometheusText)
+	}))
+	defer s.Close()
+
+	c, err := NewPrometheusCollector(s.URL+"/metrics", "", "", nil, nil)
+	assert.NoError(t, err)
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+
+	assertSeries(t, st, "buildkite_queues_scheduled_jobs_count", map[string]string{"queue": "default"}, "3")
+	assertSeries(t, st, "gitlab_runner_jobs", map[string]string{"state": "running"}, "2")
+	// The +Inf bucket is selectable by a HorizontalPodAutoscaler.
+	selector, err := labels.Parse("le=inf")
+	assert.NoError(t, err)
+	series, ok := st.Get("job_duration_seconds_bucket", selector)
+	assert.True(t, ok)
+	if assert.Len(t, series, 1) {
+		assert.Equal(t, int64(4), series[0].Value.Value.Value())
+	}
+	assertSeries(t, st, "job_duration_seconds_bucket", map[string]string{"le": "60"}, "1")
+	assertSeries(t, st, "job_duration_seconds_sum", nil, "300500m")
+	assertSeries(t, st, "queue_jobs_sum", nil, "7")
+	_, ok = st.Get("queue_wait_seconds_avg", labels.Everything())
+	assert.False(t, ok, "NaN values are dropped")
+
+	c, err = NewPrometheusCollector(s.URL+"/metrics", "", "", []string{"buildkite_.*", "queue:jobs:sum"}, nil)
+	assert.NoError(t, err)
+	snapshot, err = c.Collect(context.Background())
+	assert.NoError(t, err)
+	var names []string
+	for _, m := range snapshot.Metrics {
+		names = append(names, m.MetricName)
+	}
+	assert.ElementsMatch(t, []string{
+		"buildkite_queues_scheduled_jobs_count",
+		"buildkite_queues_scheduled_jobs_count",
+		"queue_jobs_sum",
+	}, names)
+}
+
+func TestPrometheusCollectorQuery(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/prometheus/api/v1/query", r.URL.Path)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		switch r.URL.Query().Get("query") {
+		case `sum by (queue) (buildkite_queues_scheduled_jobs_count)`:
+			_, _ = io.WriteString(w, `{"status": "success", "data": {"resultType": "vector", "result": [
+{"metric": {"queue": "default"}, "value": [1650000000.123, "3"]},
+{"metric": {"queue": "deploy"}, "value": [1650000000.123, "0.5"]}
+]}}`)
+		case `gitlab_runner_jobs`:
+			_, _ = io.WriteString(w, `{"status": "success", "data": {"resultType": "vector", "result": [
+{"metric": {"__name__": "gitlab_runner_jobs", "state": "running"}, "value": [1650000000.123, "2"]}
+]}}`)
+		case `scalar(sum(up))`:
+			_, _ = io.WriteString(w, `{"status": "success", "data": {"resultType": "scalar", "result": [1650000000.123, "12"]}}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(w, `{"status": "error", "errorType": "bad_data", "error": "parse error"}`)
+		}
+	}))
+	defer s.Close()
+	header := http.Header{"Authorization": {"Bearer token"}}
+
+	for _, tc := range []struct {
+		query      string
+		metricName string
+		name       string
+		labels     map[string]string
+		expected   string
+	}{
+		{`sum by (queue) (buildkite_queues_scheduled_jobs_count)`, "scheduled_jobs", "scheduled_jobs", map[string]string{"queue": "deploy"}, "500m"},
+		{`gitlab_runner_jobs`, "", "gitlab_runner_jobs", map[string]string{"state": "running"}, "2"},
+		{`scalar(sum(up))`, "targets_up", "targets_up", nil, "12"},
+	} {
+		c, err := NewPrometheusCollector(s.URL+"/prometheus/", tc.query, tc.metricName, nil, header)
+		assert.NoError(t, err)
+		snapshot, err := c.Collect(context.Background())
+		assert.NoError(t, err, tc.query)
+		st := storage.NewExternalMetricsMap()
+		st.Commit(snapshot.Batch())
+		assertSeries(t, st, tc.name, tc.labels, tc.expected)
+	}
+
+	c, err := NewPrometheusCollector(s.URL+"/prometheus", `sum by (queue) (buildkite_queues_scheduled_jobs_count)`, "", nil, header)
+	assert.NoError(t, err)
+	_, err = c.Collect(context.Background())
+	assert.EqualError(t, err, `query "sum by (queue) (buildkite_queues_scheduled_jobs_count)": result without __name__, metric name required`)
+
+	c, err = NewPrometheusCollector(s.URL+"/prometheus", `sum(`, "", nil, header)
+	assert.NoError(t, err)
+	_, err = c.Collect(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "400 Bad Request")
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimitError is returned by Collect when the CI platform rejected a
+// request with 429 Too Many Requests or 503 Service Unavailable. RetryAfter
+// is the delay asked for in the Retry-After header, zero if there was none.
+type RateLimitError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited with %d %s, retry after %s", e.StatusCode, http.StatusText(e.StatusCode), e.RetryAfter)
+	}
+	return fmt.Sprintf("rate limited with %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// rateLimitError returns a *RateLimitError if res was rejected because of
+// rate limiting, nil otherwise.
+func rateLimitError(res *http.Response) error {
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+	return &RateLimitError{
+		StatusCode: res.StatusCode,
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, given either as a number of
+// seconds or as an HTTP date. It returns zero for empty or invalid values and
+// for dates in the past.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(value)
+	if err != nil || date.Before(now) {
+		return 0
+	}
+	return date.Sub(now)
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, time.March, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"120", time.Minute * 2},
+		{" 5 ", time.Second * 5},
+		{"-1", 0},
+		{"soon", 0},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	} {
+		assert.Equal(t, tc.expected, parseRetryAfter(tc.value, now), "Retry-After: %q", tc.value)
+	}
+}
+
+func TestRateLimitError(t *testing.T) {
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	assert.NoError(t, rateLimitError(res))
+
+	res.StatusCode = http.StatusTooManyRequests
+	res.Header.Set("Retry-After", "30")
+	err := rateLimitError(res)
+	assert.Equal(t, &RateLimitError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Second * 30}, err)
+	assert.EqualError(t, err, "rate limited with 429 Too Many Requests, retry after 30s")
+}
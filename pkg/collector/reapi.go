@@ -0,0 +1,168 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// REAPIOSFamilyProperty and REAPIContainerImageProperty are the platform
+	// properties standardized by the Remote Execution API.
+	REAPIOSFamilyProperty       = "OSFamily"
+	REAPIContainerImageProperty = "container-image"
+
+	reapiUnknownOSFamily = "unknown"
+)
+
+// reapiPlatformQueues is the protojson encoding of ListPlatformQueuesResponse,
+// returned by the ListPlatformQueues method of Buildbarn's BuildQueueState
+// service, defined in pkg/proto/buildqueuestate/buildqueuestate.proto of
+// github.com/buildbarn/bb-remote-execution. bb_scheduler serves it over gRPC,
+// so Endpoint is expected to be a gRPC-JSON gateway in front of it. Only the
+// fields reported are decoded.
+type reapiPlatformQueues struct {
+	PlatformQueues []struct {
+		Name struct {
+			InstanceNamePrefix string `json:"instanceNamePrefix"`
+			Platform           struct {
+				Properties []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"properties"`
+			} `json:"platform"`
+		} `json:"name"`
+		SizeClassQueues []struct {
+			SizeClass      int64 `json:"sizeClass"`
+			WorkersCount   int64 `json:"workersCount"`
+			RootInvocation struct {
+				QueuedOperationsCount  int64 `json:"queuedOperationsCount"`
+				ExecutingWorkersCount  int64 `json:"executingWorkersCount"`
+				IdleWorkersCount       int64 `json:"idleWorkersCount"`
+				IdleSynchronizingCount int64 `json:"idleSynchronizingWorkersCount"`
+			} `json:"rootInvocation"`
+		} `json:"sizeClassQueues"`
+	} `json:"platformQueues"`
+}
+
+// reapiPlatform identifies the series of a platform queue.
+type reapiPlatform struct {
+	OSFamily       string
+	ContainerImage string
+}
+
+// reapiCounts holds the metrics reported for a single platform, summed over
+// its size classes and instance names.
+type reapiCounts struct {
+	QueuedOperations int64
+	Workers          int64
+	ExecutingWorkers int64
+	IdleWorkers      int64
+}
+
+// REAPICollector reports the queue depth and workers of the platform queues
+// of a Remote Execution API scheduler, e.g. Buildbarn, per OS family and
+// container image like the Flarebuild collector.
+type REAPICollector struct {
+	// Endpoint is the URL returning the platform queues as JSON.
+	Endpoint string
+	Token    string
+	// OSFamilyProperty and ContainerImageProperty are the platform property
+	// names the series are labeled with.
+	OSFamilyProperty       string
+	ContainerImageProperty string
+
+	client *http.Client
+}
+
+func NewREAPICollector(endpoint, token string) *REAPICollector {
+	return &REAPICollector{
+		Endpoint:               endpoint,
+		Token:                  token,
+		OSFamilyProperty:       REAPIOSFamilyProperty,
+		ContainerImageProperty: REAPIContainerImageProperty,
+		client:                 &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *REAPICollector) Collect(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
+	req, err := http.NewRequestWithContext(ctx, "GET", c.Endpoint, nil)
+	if err != nil {
+		return snapshot, err
+	}
+	req.Header.Set("User-Agent", "buildscaler")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	var doc reapiPlatformQueues
+	if _, err := getJSON(c.client, req, &doc); err != nil {
+		return snapshot, err
+	}
+
+	counts := map[reapiPlatform]*reapiCounts{}
+	for _, queue := range doc.PlatformQueues {
+		platform := reapiPlatform{OSFamily: reapiUnknownOSFamily}
+		for _, property := range queue.Name.Platform.Properties {
+			switch property.Name {
+			case c.OSFamilyProperty:
+				platform.OSFamily = property.Value
+			case c.ContainerImageProperty:
+				platform.ContainerImage = property.Value
+			}
+		}
+		count, ok := counts[platform]
+		if !ok {
+			count = &reapiCounts{}
+			counts[platform] = count
+		}
+		for _, sizeClass := range queue.SizeClassQueues {
+			invocation := sizeClass.RootInvocation
+			count.QueuedOperations += invocation.QueuedOperationsCount
+			count.Workers += sizeClass.WorkersCount
+			count.ExecutingWorkers += invocation.ExecutingWorkersCount
+			count.IdleWorkers += invocation.IdleWorkersCount + invocation.IdleSynchronizingCount
+		}
+	}
+
+	platforms := make([]reapiPlatform, 0, len(counts))
+	for platform := range counts {
+		platforms = append(platforms, platform)
+	}
+	sort.Slice(platforms, func(i, j int) bool {
+		if platforms[i].OSFamily != platforms[j].OSFamily {
+			return platforms[i].OSFamily < platforms[j].OSFamily
+		}
+		return platforms[i].ContainerImage < platforms[j].ContainerImage
+	})
+	now := time.Now()
+	for _, platform := range platforms {
+		count := counts[platform]
+		klog.V(5).Infof("REAPI platform %+v: %+v", platform, *count)
+		for name, value := range map[string]int64{
+			"queue_size":        count.QueuedOperations,
+			"workers":           count.Workers,
+			"executing_workers": count.ExecutingWorkers,
+			"idle_workers":      count.IdleWorkers,
+		} {
+			snapshot.Add(*platformExternalMetricValue("reapi", platform.OSFamily, platform.ContainerImage, name, now, value))
+		}
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+)
+
+func TestREAPICollector(t *testing.T) {
+	// A ListPlatformQueuesResponse in the protojson encoding, with zero
+	// values omitted like bb_scheduler sends them.
+	response, err := ioutil.ReadFile("testdata/reapi_platform_queues.json")
+	assert.NoError(t, err)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/buildqueuestate/platform_queues", r.URL.Path)
+		assert.Equal(t, "Bearer fake-token", r.Header.Get("Authorization"))
+		_, _ = w.Write(response)
+	}))
+	defer s.Close()
+
+	c := NewREAPICollector(s.URL+"/buildqueuestate/platform_queues", "fake-token")
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+
+	for _, tc := range []struct {
+		name     string
+		series   string
+		expected int64
+	}{
+		{"reapi_linux_queue_size", "image=docker://ubuntu:20.04,os=Linux,type=queue_size", 9},
+		{"reapi_linux_workers", "image=docker://ubuntu:20.04,os=Linux,type=workers", 7},
+		{"reapi_linux_executing_workers", "image=docker://ubuntu:20.04,os=Linux,type=executing_workers", 4},
+		{"reapi_linux_idle_workers", "image=docker://ubuntu:20.04,os=Linux,type=idle_workers", 2},
+		{"reapi_macos_queue_size", "image=,os=MacOS,type=queue_size", 0},
+		{"reapi_macos_executing_workers", "image=,os=MacOS,type=executing_workers", 2},
+		{"reapi_unknown_workers", "image=,os=unknown,type=workers", 0},
+		{"reapi_unknown_queue_size", "image=,os=unknown,type=queue_size", 0},
+	} {
+		series, ok := st.Data[tc.name][tc.series]
+		if assert.True(t, ok, "%s{%s}", tc.name, tc.series) {
+			assert.Equal(t, *resource.NewQuantity(tc.expected, resource.DecimalSI), series.Value.Value, "%s{%s}", tc.name, tc.series)
+		}
+	}
+}
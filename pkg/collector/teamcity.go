@@ -0,0 +1,247 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	TeamCityPoolLabel = "pool"
+
+	teamCityPoolFields  = "nextHref,agentPool(id,name,projects(project(id)))"
+	teamCityAgentFields = "nextHref,agent(id,connected,authorized,enabled,pool(id),build(id))"
+	teamCityQueueFields = "nextHref,build(id,buildType(projectId),compatibleAgents(agent(id)))"
+)
+
+type teamCityPools struct {
+	NextHref  string `json:"nextHref"`
+	AgentPool []struct {
+		ID       int64  `json:"id"`
+		Name     string `json:"name"`
+		Projects struct {
+			Project []struct {
+				ID string `json:"id"`
+			} `json:"project"`
+		} `json:"projects"`
+	} `json:"agentPool"`
+}
+
+type teamCityAgents struct {
+	NextHref string `json:"nextHref"`
+	Agent    []struct {
+		ID         int64 `json:"id"`
+		Connected  bool  `json:"connected"`
+		Authorized bool  `json:"authorized"`
+		Enabled    bool  `json:"enabled"`
+		Pool       struct {
+			ID int64 `json:"id"`
+		} `json:"pool"`
+		Build *struct {
+			ID int64 `json:"id"`
+		} `json:"build"`
+	} `json:"agent"`
+}
+
+type teamCityQueue struct {
+	NextHref string `json:"nextHref"`
+	Build    []struct {
+		ID        int64 `json:"id"`
+		BuildType struct {
+			ProjectID string `json:"projectId"`
+		} `json:"buildType"`
+		CompatibleAgents struct {
+			Agent []struct {
+				ID int64 `json:"id"`
+			} `json:"agent"`
+		} `json:"compatibleAgents"`
+	} `json:"build"`
+}
+
+// teamCityCounts holds the metrics reported for a single agent pool.
+type teamCityCounts struct {
+	QueuedBuilds     int64
+	ConnectedAgents  int64
+	AuthorizedAgents int64
+	BusyAgents       int64
+}
+
+// TeamCityCollector reports the queued builds and the agents of a TeamCity
+// server, in total and per agent pool.
+type TeamCityCollector struct {
+	Endpoint string
+	Token    string
+
+	client *http.Client
+}
+
+func NewTeamCityCollector(endpoint, token string) *TeamCityCollector {
+	return &TeamCityCollector{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Token:    token,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *TeamCityCollector) Collect(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
+	counts := map[string]*teamCityCounts{}
+	poolNames := map[int64]string{}
+	projectPools := map[string][]string{}
+	err := c.getPaginated(ctx, "/app/rest/agentPools", nil, teamCityPoolFields, func() interface{} { return &teamCityPools{} }, func(page interface{}) string {
+		pools := page.(*teamCityPools)
+		for _, pool := range pools.AgentPool {
+			poolNames[pool.ID] = pool.Name
+			counts[pool.Name] = &teamCityCounts{}
+			for _, project := range pool.Projects.Project {
+				projectPools[project.ID] = append(projectPools[project.ID], pool.Name)
+			}
+		}
+		return pools.NextHref
+	})
+	if err != nil {
+		return snapshot, err
+	}
+
+	var total teamCityCounts
+	agentPools := map[int64]string{}
+	// defaultFilter:false includes disconnected and unauthorized agents.
+	query := url.Values{"locator": {"defaultFilter:false"}}
+	err = c.getPaginated(ctx, "/app/rest/agents", query, teamCityAgentFields, func() interface{} { return &teamCityAgents{} }, func(page interface{}) string {
+		agents := page.(*teamCityAgents)
+		for _, agent := range agents.Agent {
+			name, ok := poolNames[agent.Pool.ID]
+			if !ok {
+				continue
+			}
+			agentPools[agent.ID] = name
+			if !agent.Connected {
+				continue
+			}
+			counts[name].ConnectedAgents++
+			total.ConnectedAgents++
+			if !agent.Authorized || !agent.Enabled {
+				continue
+			}
+			counts[name].AuthorizedAgents++
+			total.AuthorizedAgents++
+			if agent.Build != nil {
+				counts[name].BusyAgents++
+				total.BusyAgents++
+			}
+		}
+		return agents.NextHref
+	})
+	if err != nil {
+		return snapshot, err
+	}
+
+	err = c.getPaginated(ctx, "/app/rest/buildQueue", nil, teamCityQueueFields, func() interface{} { return &teamCityQueue{} }, func(page interface{}) string {
+		queue := page.(*teamCityQueue)
+		for _, build := range queue.Build {
+			total.QueuedBuilds++
+			// A build waits for the pools of its compatible agents or,
+			// without any, e.g. when a pool is scaled to zero, for the
+			// pools of its project.
+			pools := map[string]bool{}
+			for _, agent := range build.CompatibleAgents.Agent {
+				if name, ok := agentPools[agent.ID]; ok {
+					pools[name] = true
+				}
+			}
+			if len(pools) == 0 {
+				for _, name := range projectPools[build.BuildType.ProjectID] {
+					pools[name] = true
+				}
+			}
+			for name := range pools {
+				counts[name].QueuedBuilds++
+			}
+		}
+		return queue.NextHref
+	})
+	if err != nil {
+		return snapshot, err
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		klog.V(5).Infof("TeamCity pool %s: %+v", name, *counts[name])
+		counts[name].addTo(&snapshot, "teamcity_", map[string]string{TeamCityPoolLabel: name})
+	}
+	total.addTo(&snapshot, "teamcity_total_", nil)
+	return snapshot, nil
+}
+
+func (t *teamCityCounts) addTo(snapshot *Snapshot, prefix string, labels map[string]string) {
+	for name, value := range map[string]int64{
+		"queued_builds_count":    t.QueuedBuilds,
+		"connected_agent_count":  t.ConnectedAgents,
+		"authorized_agent_count": t.AuthorizedAgents,
+		"busy_agent_count":       t.BusyAgents,
+		"idle_agent_count":       t.AuthorizedAgents - t.BusyAgents,
+	} {
+		snapshot.Add(external_metrics.ExternalMetricValue{
+			MetricName:   prefix + name,
+			MetricLabels: labels,
+			Value:        *resource.NewQuantity(value, resource.DecimalSI),
+		})
+	}
+}
+
+// getPaginated calls onPage with every page of path, following the nextHref
+// onPage returns, relative to Endpoint.
+func (c *TeamCityCollector) getPaginated(ctx context.Context, path string, query url.Values, fields string, newPage func() interface{}, onPage func(interface{}) string) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	next := path + "?" + query.Encode()
+	for next != "" {
+		endpoint, err := url.Parse(c.Endpoint + next)
+		if err != nil {
+			return err
+		}
+		// nextHref keeps the locator but not necessarily the fields.
+		q := endpoint.Query()
+		if q.Get("fields") == "" {
+			q.Set("fields", fields)
+			endpoint.RawQuery = q.Encode()
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+		req.Header.Set("User-Agent", "buildscaler")
+		page := newPage()
+		if _, err := getJSON(c.client, req, page); err != nil {
+			return err
+		}
+		next = onPage(page)
+	}
+	return nil
+}
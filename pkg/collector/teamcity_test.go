@@ -0,0 +1,105 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+)
+
+func TestTeamCityCollector(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer fake-token", r.Header.Get("Authorization"))
+		assert.NotEmpty(t, r.URL.Query().Get("fields"))
+		switch r.URL.Path {
+		case "/app/rest/agentPools":
+			_, _ = io.WriteString(w, `{"count": 3, "agentPool": [
+{"id": 0, "name": "Default", "projects": {"project": [{"id": "_Root"}]}},
+{"id": 1, "name": "k8s", "projects": {"project": [{"id": "App"}, {"id": "Web"}]}},
+{"id": 2, "name": "macos", "projects": {"project": [{"id": "Mobile"}]}}
+]}`)
+		case "/app/rest/agents":
+			assert.Equal(t, "defaultFilter:false", r.URL.Query().Get("locator"))
+			_, _ = io.WriteString(w, `{"count": 5, "agent": [
+{"id": 1, "connected": true, "authorized": true, "enabled": true, "pool": {"id": 1}, "build": {"id": 100}},
+{"id": 2, "connected": true, "authorized": true, "enabled": true, "pool": {"id": 1}},
+{"id": 3, "connected": true, "authorized": false, "enabled": true, "pool": {"id": 1}},
+{"id": 4, "connected": false, "authorized": true, "enabled": true, "pool": {"id": 1}},
+{"id": 5, "connected": true, "authorized": true, "enabled": true, "pool": {"id": 0}}
+]}`)
+		case "/app/rest/buildQueue":
+			if r.URL.Query().Get("locator") == "" {
+				_, _ = io.WriteString(w, `{"count": 2, "nextHref": "/app/rest/buildQueue?locator=count:2,start:2", "build": [
+{"id": 200, "buildType": {"projectId": "App"}, "compatibleAgents": {"agent": [{"id": 1}, {"id": 2}, {"id": 5}]}},
+{"id": 201, "buildType": {"projectId": "App"}, "compatibleAgents": {"agent": [{"id": 2}]}}
+]}`)
+				return
+			}
+			_, _ = io.WriteString(w, `{"count": 1, "build": [
+{"id": 202, "buildType": {"projectId": "Mobile"}, "compatibleAgents": {}}
+]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	c := NewTeamCityCollector(s.URL+"/", "fake-token")
+	snapshot, err := c.Collect(context.Background())
+	assert.NoError(t, err)
+	st := storage.NewExternalMetricsMap()
+	st.Commit(snapshot.Batch())
+
+	for _, tc := range []struct {
+		name     string
+		pool     string
+		expected int64
+	}{
+		{"teamcity_queued_builds_count", "k8s", 2},
+		{"teamcity_queued_builds_count", "Default", 1},
+		{"teamcity_queued_builds_count", "macos", 1},
+		{"teamcity_connected_agent_count", "k8s", 3},
+		{"teamcity_authorized_agent_count", "k8s", 2},
+		{"teamcity_busy_agent_count", "k8s", 1},
+		{"teamcity_idle_agent_count", "k8s", 1},
+		{"teamcity_idle_agent_count", "Default", 1},
+		{"teamcity_connected_agent_count", "macos", 0},
+	} {
+		series, ok := st.Get(tc.name, labels.SelectorFromSet(map[string]string{TeamCityPoolLabel: tc.pool}))
+		assert.True(t, ok, tc.name)
+		if assert.Len(t, series, 1, "%s{%s}", tc.name, tc.pool) {
+			assert.Equal(t, tc.expected, series[0].Value.Value.Value(), "%s{%s}", tc.name, tc.pool)
+		}
+	}
+	for name, expected := range map[string]int64{
+		"teamcity_total_queued_builds_count":    3,
+		"teamcity_total_connected_agent_count":  4,
+		"teamcity_total_authorized_agent_count": 3,
+		"teamcity_total_idle_agent_count":       2,
+	} {
+		series, ok := st.Get(name, labels.Everything())
+		assert.True(t, ok, name)
+		if assert.Len(t, series, 1, name) {
+			assert.Equal(t, expected, series[0].Value.Value.Value(), name)
+		}
+	}
+}
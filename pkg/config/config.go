@@ -0,0 +1,715 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config loads buildscaler's declarative configuration file.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/elotl/buildscaler/pkg/collector"
+	"github.com/elotl/buildscaler/pkg/derived"
+	"github.com/elotl/buildscaler/pkg/relabel"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	APIVersion = "buildscaler/v1"
+
+	BuildkitePlatform     = "buildkite"
+	CircleCIPlatform      = "circleci"
+	FlarebuildPlatform    = "flarebuild"
+	GitHubActionsPlatform = "github-actions"
+	GitLabPlatform        = "gitlab"
+	JenkinsPlatform       = "jenkins"
+	AzureDevOpsPlatform   = "azure-devops"
+	InClusterPlatform     = "in-cluster"
+	HTTPJSONPlatform      = "http-json"
+	PrometheusPlatform    = "prometheus"
+	REAPIPlatform         = "reapi"
+	DronePlatform         = "drone"
+	WoodpeckerPlatform    = "woodpecker"
+	TeamCityPlatform      = "teamcity"
+
+	DefaultScrapePeriod           = 5 * time.Second
+	DefaultBuildkiteEndpoint      = collector.BuildkiteAgentAPIEndpoint
+	DefaultBuildkiteAPIEndpoint   = collector.BuildkiteGraphQLEndpoint
+	DefaultCircleCIEndpoint       = collector.CircleCIAPIEndpoint
+	DefaultCircleCIMaxPipelineAge = 30 * time.Minute
+	DefaultFlarebuildEndpoint     = "https://api.stg.flare.build/api/v1"
+	DefaultGitHubEndpoint         = collector.GitHubAPIEndpoint
+	DefaultGitLabEndpoint         = collector.GitLabEndpoint
+)
+
+var Platforms = []string{
+	BuildkitePlatform,
+	CircleCIPlatform,
+	FlarebuildPlatform,
+	GitHubActionsPlatform,
+	GitLabPlatform,
+	JenkinsPlatform,
+	AzureDevOpsPlatform,
+	InClusterPlatform,
+	HTTPJSONPlatform,
+	PrometheusPlatform,
+	REAPIPlatform,
+	DronePlatform,
+	WoodpeckerPlatform,
+	TeamCityPlatform,
+}
+
+// Config is the content of the file passed with --config.
+type Config struct {
+	APIVersion string `json:"apiVersion"`
+	// ScrapePeriod is used by collectors that do not set their own.
+	ScrapePeriod   metav1.Duration `json:"scrapePeriod,omitempty"`
+	Collectors     []Collector     `json:"collectors"`
+	DerivedMetrics []DerivedMetric `json:"derivedMetrics,omitempty"`
+	// Relabel rules are applied to the metrics of every collector, after
+	// the collector's own rules.
+	Relabel []relabel.Rule `json:"relabel,omitempty"`
+}
+
+// Collector configures a single CI platform scraper. Exactly one of the
+// platform sections matching Platform must be set.
+type Collector struct {
+	// Name identifies the collector in logs, it defaults to Platform and
+	// must be unique.
+	Name         string          `json:"name,omitempty"`
+	Platform     string          `json:"platform"`
+	ScrapePeriod metav1.Duration `json:"scrapePeriod,omitempty"`
+	Relabel      []relabel.Rule  `json:"relabel,omitempty"`
+
+	Buildkite     *Buildkite     `json:"buildkite,omitempty"`
+	CircleCI      *CircleCI      `json:"circleci,omitempty"`
+	Flarebuild    *Flarebuild    `json:"flarebuild,omitempty"`
+	GitHubActions *GitHubActions `json:"githubActions,omitempty"`
+	GitLab        *GitLab        `json:"gitlab,omitempty"`
+	Jenkins       *Jenkins       `json:"jenkins,omitempty"`
+	AzureDevOps   *AzureDevOps   `json:"azureDevOps,omitempty"`
+	InCluster     *InCluster     `json:"inCluster,omitempty"`
+	HTTPJSON      *HTTPJSON      `json:"httpJSON,omitempty"`
+	Prometheus    *Prometheus    `json:"prometheus,omitempty"`
+	REAPI         *REAPI         `json:"reapi,omitempty"`
+	Drone         *Drone         `json:"drone,omitempty"`
+	Woodpecker    *Drone         `json:"woodpecker,omitempty"`
+	TeamCity      *TeamCity      `json:"teamcity,omitempty"`
+}
+
+type Buildkite struct {
+	Endpoint string   `json:"endpoint,omitempty"`
+	Token    Secret   `json:"token,omitempty"`
+	Queues   []string `json:"queues,omitempty"`
+	// Orgs and Clusters are scraped with their own agent tokens instead of
+	// Token. Series of clusters are also labeled with the cluster name.
+	Orgs     []BuildkiteOrg     `json:"orgs,omitempty"`
+	Clusters []BuildkiteCluster `json:"clusters,omitempty"`
+	// API enables the metrics read from the Buildkite GraphQL API.
+	API *BuildkiteAPI `json:"api,omitempty"`
+}
+
+// BuildkiteAPI is a Buildkite API access token with GraphQL access to the
+// scraped organizations, and the metrics it is used for.
+type BuildkiteAPI struct {
+	Endpoint string `json:"endpoint,omitempty"`
+	Token    Secret `json:"token"`
+	// WaitTimes reports the age of the oldest waiting job of every queue,
+	// and quantiles of the ages of its waiting jobs.
+	WaitTimes bool `json:"waitTimes,omitempty"`
+	// Pipelines reports the scheduled and running jobs of every queue per
+	// pipeline.
+	Pipelines bool `json:"pipelines,omitempty"`
+	// AgentQueryRules reports the scheduled and running jobs of every queue
+	// per value of these agent tags, e.g. os and arch.
+	AgentQueryRules []string `json:"agentQueryRules,omitempty"`
+	// Agents reports whether every connected agent is running a job, which
+	// is also served as a custom metric of the pod named after the agent
+	// hostname.
+	Agents bool `json:"agents,omitempty"`
+}
+
+// BuildkiteOrg is the agent token of a Buildkite organization, whose series
+// are labeled with the organization slug. Queues defaults to the queues of the
+// buildkite section.
+type BuildkiteOrg struct {
+	Token  Secret   `json:"token"`
+	Queues []string `json:"queues,omitempty"`
+}
+
+// BuildkiteCluster is a Buildkite cluster, whose agent token only sees the
+// queues of the cluster. Name defaults to the cluster name Buildkite reports
+// and Queues to the queues of the buildkite section.
+type BuildkiteCluster struct {
+	Name   string   `json:"name,omitempty"`
+	Token  Secret   `json:"token"`
+	Queues []string `json:"queues,omitempty"`
+}
+
+type CircleCI struct {
+	Endpoint       string          `json:"endpoint,omitempty"`
+	Token          Secret          `json:"token"`
+	ProjectSlug    string          `json:"projectSlug"`
+	MaxPipelineAge metav1.Duration `json:"maxPipelineAge,omitempty"`
+}
+
+type Flarebuild struct {
+	Endpoint string `json:"endpoint,omitempty"`
+	APIKey   Secret `json:"apiKey"`
+}
+
+// GitHubActions reads jobs from Repos, given as owner/name, or from every
+// repository of Org when Repos is empty. Endpoint is the API URL of GitHub
+// Enterprise Server, e.g. https://github.example.com/api/v3.
+type GitHubActions struct {
+	Endpoint string   `json:"endpoint,omitempty"`
+	Token    Secret   `json:"token"`
+	Org      string   `json:"org,omitempty"`
+	Repos    []string `json:"repos,omitempty"`
+}
+
+// GitLab reads jobs of Projects and of every project of Groups, given as
+// numeric IDs or full paths. Endpoint is the base URL of a self-managed
+// instance, e.g. https://gitlab.example.com.
+type GitLab struct {
+	Endpoint string   `json:"endpoint,omitempty"`
+	Token    Secret   `json:"token"`
+	Projects []string `json:"projects,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// Jenkins authenticates with User and one of its API tokens.
+type Jenkins struct {
+	Endpoint string `json:"endpoint"`
+	User     string `json:"user"`
+	Token    Secret `json:"token"`
+}
+
+// AzureDevOps reads the agent pools of the organization at Endpoint, e.g.
+// https://dev.azure.com/acme, with a personal access token. All self-hosted
+// pools are read if Pools is empty.
+type AzureDevOps struct {
+	Endpoint string   `json:"endpoint"`
+	Token    Secret   `json:"token"`
+	Pools    []string `json:"pools,omitempty"`
+}
+
+// InCluster counts the Tekton PipelineRuns and TaskRuns, Argo Workflows and
+// their pods in Namespace, or in all namespaces if it is empty. Metrics are
+// labeled with the namespace and with the values of GroupByLabels.
+type InCluster struct {
+	Namespace     string   `json:"namespace,omitempty"`
+	Tekton        bool     `json:"tekton,omitempty"`
+	Argo          bool     `json:"argo,omitempty"`
+	GroupByLabels []string `json:"groupByLabels,omitempty"`
+}
+
+// HTTPJSON scrapes any endpoint returning JSON, mapping the response to
+// metrics with JSONPath expressions.
+type HTTPJSON struct {
+	URL        string                       `json:"url"`
+	Headers    []HTTPHeader                 `json:"headers,omitempty"`
+	Pagination collector.HTTPJSONPagination `json:"pagination,omitempty"`
+	Metrics    []collector.HTTPJSONMetric   `json:"metrics"`
+}
+
+// HTTPHeader is sent with every request. The value of Secret, if set, is
+// appended to Value, so that value "Bearer " and a token secret make an
+// Authorization header.
+type HTTPHeader struct {
+	Name   string  `json:"name"`
+	Value  string  `json:"value,omitempty"`
+	Secret *Secret `json:"secret,omitempty"`
+}
+
+// Header resolves the secrets of the headers of h.
+func (h *HTTPJSON) Header() (http.Header, error) {
+	return resolveHeaders(h.Headers)
+}
+
+// Prometheus scrapes the Prometheus text format exposed at URL or, if Query
+// is set, runs the PromQL instant query against the Prometheus API at URL.
+// Results without a __name__ label, e.g. of aggregations, are named
+// MetricName. Only metrics whose name matches one of the Match regular
+// expressions are kept, if any is set.
+type Prometheus struct {
+	URL        string       `json:"url"`
+	Query      string       `json:"query,omitempty"`
+	MetricName string       `json:"metricName,omitempty"`
+	Match      []string     `json:"match,omitempty"`
+	Headers    []HTTPHeader `json:"headers,omitempty"`
+}
+
+// Header resolves the secrets of the headers of p.
+func (p *Prometheus) Header() (http.Header, error) {
+	return resolveHeaders(p.Headers)
+}
+
+// REAPI reads the platform queues of a Remote Execution API scheduler from
+// Endpoint, sending Token, if set, as a bearer token. Series are labeled with
+// the values of the OSFamilyProperty and ContainerImageProperty platform
+// properties.
+type REAPI struct {
+	Endpoint               string  `json:"endpoint"`
+	Token                  *Secret `json:"token,omitempty"`
+	OSFamilyProperty       string  `json:"osFamilyProperty,omitempty"`
+	ContainerImageProperty string  `json:"containerImageProperty,omitempty"`
+}
+
+// Drone configures the drone and woodpecker platforms. Token must belong to
+// an admin. Series are labeled with the values of the stage Labels.
+type Drone struct {
+	Endpoint string   `json:"endpoint"`
+	Token    Secret   `json:"token"`
+	Labels   []string `json:"labels,omitempty"`
+}
+
+// TeamCity reads the server at Endpoint, its root URL, with an access token
+// allowed to view agents and the build queue.
+type TeamCity struct {
+	Endpoint string `json:"endpoint"`
+	Token    Secret `json:"token"`
+}
+
+func resolveHeaders(headers []HTTPHeader) (http.Header, error) {
+	header := http.Header{}
+	for _, h := range headers {
+		value := h.Value
+		if h.Secret != nil {
+			secret, err := h.Secret.Resolve()
+			if err != nil {
+				return nil, fmt.Errorf("header %s: %w", h.Name, err)
+			}
+			value += secret
+		}
+		header.Add(h.Name, value)
+	}
+	return header, nil
+}
+
+type DerivedMetric struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+// Secret is read from an environment variable or a file, so credentials can
+// stay in Kubernetes Secrets instead of the ConfigMap holding the config.
+type Secret struct {
+	Env  string `json:"env,omitempty"`
+	File string `json:"file,omitempty"`
+}
+
+// Resolve returns the secret value. It is called every time collectors are
+// (re)created, so rotated secrets are picked up on reload.
+func (s Secret) Resolve() (string, error) {
+	var value string
+	switch {
+	case s.Env != "":
+		value = os.Getenv(s.Env)
+		if value == "" {
+			return "", fmt.Errorf("environment variable %s is not set", s.Env)
+		}
+	case s.File != "":
+		content, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return "", err
+		}
+		value = strings.TrimSpace(string(content))
+		if value == "" {
+			return "", fmt.Errorf("secret file %s is empty", s.File)
+		}
+	}
+	return value, nil
+}
+
+func (s Secret) validate(field string) error {
+	if (s.Env == "") == (s.File == "") {
+		return fmt.Errorf("%s: exactly one of env or file must be set", field)
+	}
+	return nil
+}
+
+// Parse decodes, defaults and validates a YAML or JSON config.
+func Parse(content []byte) (*Config, error) {
+	var c Config
+	if err := yaml.UnmarshalStrict(content, &c); err != nil {
+		return nil, err
+	}
+	c.Default()
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Default fills in every unset optional field.
+func (c *Config) Default() {
+	if c.ScrapePeriod.Duration == 0 {
+		c.ScrapePeriod.Duration = DefaultScrapePeriod
+	}
+	for i := range c.Collectors {
+		col := &c.Collectors[i]
+		if col.Name == "" {
+			col.Name = col.Platform
+		}
+		if col.ScrapePeriod.Duration == 0 {
+			col.ScrapePeriod = c.ScrapePeriod
+		}
+		if col.Buildkite != nil {
+			if col.Buildkite.Endpoint == "" {
+				col.Buildkite.Endpoint = DefaultBuildkiteEndpoint
+			}
+			if col.Buildkite.API != nil && col.Buildkite.API.Endpoint == "" {
+				col.Buildkite.API.Endpoint = DefaultBuildkiteAPIEndpoint
+			}
+		}
+		if col.CircleCI != nil {
+			if col.CircleCI.Endpoint == "" {
+				col.CircleCI.Endpoint = DefaultCircleCIEndpoint
+			}
+			if col.CircleCI.MaxPipelineAge.Duration == 0 {
+				col.CircleCI.MaxPipelineAge.Duration = DefaultCircleCIMaxPipelineAge
+			}
+		}
+		if col.Flarebuild != nil && col.Flarebuild.Endpoint == "" {
+			col.Flarebuild.Endpoint = DefaultFlarebuildEndpoint
+		}
+		if col.GitHubActions != nil && col.GitHubActions.Endpoint == "" {
+			col.GitHubActions.Endpoint = DefaultGitHubEndpoint
+		}
+		if col.GitLab != nil && col.GitLab.Endpoint == "" {
+			col.GitLab.Endpoint = DefaultGitLabEndpoint
+		}
+		if col.REAPI != nil {
+			if col.REAPI.OSFamilyProperty == "" {
+				col.REAPI.OSFamilyProperty = collector.REAPIOSFamilyProperty
+			}
+			if col.REAPI.ContainerImageProperty == "" {
+				col.REAPI.ContainerImageProperty = collector.REAPIContainerImageProperty
+			}
+		}
+	}
+}
+
+// Validate checks c and compiles its relabel rules. All problems are
+// reported at once.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.APIVersion != APIVersion {
+		errs = append(errs, fmt.Errorf("apiVersion: expected %q, got %q", APIVersion, c.APIVersion))
+	}
+	if c.ScrapePeriod.Duration < 0 {
+		errs = append(errs, errors.New("scrapePeriod: must be positive"))
+	}
+	if len(c.Collectors) == 0 {
+		errs = append(errs, errors.New("collectors: at least one collector is required"))
+	}
+	names := map[string]bool{}
+	for i := range c.Collectors {
+		col := &c.Collectors[i]
+		field := fmt.Sprintf("collectors[%d]", i)
+		if names[col.Name] {
+			errs = append(errs, fmt.Errorf("%s.name: duplicate collector name %q", field, col.Name))
+		}
+		names[col.Name] = true
+		if col.ScrapePeriod.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("%s.scrapePeriod: must be positive", field))
+		}
+		errs = append(errs, col.validatePlatform(field)...)
+		errs = append(errs, compileRules(field+".relabel", col.Relabel)...)
+	}
+	for i, d := range c.DerivedMetrics {
+		if _, err := derived.NewMetric(d.Name, d.Expression); err != nil {
+			errs = append(errs, fmt.Errorf("derivedMetrics[%d]: %w", i, err))
+		}
+	}
+	errs = append(errs, compileRules("relabel", c.Relabel)...)
+	return utilerrors.NewAggregate(errs)
+}
+
+func (b *Buildkite) validate(field string) []error {
+	var errs []error
+	if b.API != nil {
+		if err := b.API.Token.validate(field + ".api.token"); err != nil {
+			errs = append(errs, err)
+		}
+		for i, tag := range b.API.AgentQueryRules {
+			switch tag {
+			case "", collector.BuildkiteQueueLabel, collector.BuildkiteOrgLabel, collector.BuildkiteClusterLabel:
+				errs = append(errs, fmt.Errorf("%s.api.agentQueryRules[%d]: %q is not a valid agent tag", field, i, tag))
+			}
+		}
+	}
+	if len(b.Orgs) == 0 && len(b.Clusters) == 0 {
+		if err := b.Token.validate(field + ".token"); err != nil {
+			errs = append(errs, err)
+		}
+		return errs
+	}
+	if b.Token != (Secret{}) {
+		errs = append(errs, fmt.Errorf("%s.token: must not be set with orgs or clusters", field))
+	}
+	for i, org := range b.Orgs {
+		if err := org.Token.validate(fmt.Sprintf("%s.orgs[%d].token", field, i)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	names := map[string]bool{}
+	for i, cluster := range b.Clusters {
+		if cluster.Name != "" && names[cluster.Name] {
+			errs = append(errs, fmt.Errorf("%s.clusters[%d].name: duplicate cluster %s", field, i, cluster.Name))
+		}
+		names[cluster.Name] = true
+		if err := cluster.Token.validate(fmt.Sprintf("%s.clusters[%d].token", field, i)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func (col *Collector) validatePlatform(field string) []error {
+	var errs []error
+	sections := 0
+	for _, set := range []bool{col.Buildkite != nil, col.CircleCI != nil, col.Flarebuild != nil, col.GitHubActions != nil, col.GitLab != nil, col.Jenkins != nil, col.AzureDevOps != nil, col.InCluster != nil, col.HTTPJSON != nil, col.Prometheus != nil, col.REAPI != nil, col.Drone != nil, col.Woodpecker != nil, col.TeamCity != nil} {
+		if set {
+			sections++
+		}
+	}
+	if sections > 1 {
+		errs = append(errs, fmt.Errorf("%s: only the %s section may be set", field, col.Platform))
+	}
+	switch col.Platform {
+	case BuildkitePlatform:
+		if col.Buildkite == nil {
+			return append(errs, fmt.Errorf("%s.buildkite: required for platform %s", field, col.Platform))
+		}
+		errs = append(errs, col.Buildkite.validate(field+".buildkite")...)
+	case CircleCIPlatform:
+		if col.CircleCI == nil {
+			return append(errs, fmt.Errorf("%s.circleci: required for platform %s", field, col.Platform))
+		}
+		if err := col.CircleCI.Token.validate(field + ".circleci.token"); err != nil {
+			errs = append(errs, err)
+		}
+		if col.CircleCI.ProjectSlug == "" {
+			errs = append(errs, fmt.Errorf("%s.circleci.projectSlug: required", field))
+		}
+	case FlarebuildPlatform:
+		if col.Flarebuild == nil {
+			return append(errs, fmt.Errorf("%s.flarebuild: required for platform %s", field, col.Platform))
+		}
+		if err := col.Flarebuild.APIKey.validate(field + ".flarebuild.apiKey"); err != nil {
+			errs = append(errs, err)
+		}
+	case GitHubActionsPlatform:
+		if col.GitHubActions == nil {
+			return append(errs, fmt.Errorf("%s.githubActions: required for platform %s", field, col.Platform))
+		}
+		if err := col.GitHubActions.Token.validate(field + ".githubActions.token"); err != nil {
+			errs = append(errs, err)
+		}
+		if col.GitHubActions.Org == "" && len(col.GitHubActions.Repos) == 0 {
+			errs = append(errs, fmt.Errorf("%s.githubActions: at least one of org or repos must be set", field))
+		}
+		for i, repo := range col.GitHubActions.Repos {
+			if parts := strings.Split(repo, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				errs = append(errs, fmt.Errorf("%s.githubActions.repos[%d]: expected owner/name, got %q", field, i, repo))
+			}
+		}
+	case GitLabPlatform:
+		if col.GitLab == nil {
+			return append(errs, fmt.Errorf("%s.gitlab: required for platform %s", field, col.Platform))
+		}
+		if err := col.GitLab.Token.validate(field + ".gitlab.token"); err != nil {
+			errs = append(errs, err)
+		}
+		if len(col.GitLab.Projects) == 0 && len(col.GitLab.Groups) == 0 {
+			errs = append(errs, fmt.Errorf("%s.gitlab: at least one of projects or groups must be set", field))
+		}
+	case JenkinsPlatform:
+		if col.Jenkins == nil {
+			return append(errs, fmt.Errorf("%s.jenkins: required for platform %s", field, col.Platform))
+		}
+		if col.Jenkins.Endpoint == "" {
+			errs = append(errs, fmt.Errorf("%s.jenkins.endpoint: required", field))
+		}
+		if col.Jenkins.User == "" {
+			errs = append(errs, fmt.Errorf("%s.jenkins.user: required", field))
+		}
+		if err := col.Jenkins.Token.validate(field + ".jenkins.token"); err != nil {
+			errs = append(errs, err)
+		}
+	case AzureDevOpsPlatform:
+		if col.AzureDevOps == nil {
+			return append(errs, fmt.Errorf("%s.azureDevOps: required for platform %s", field, col.Platform))
+		}
+		if col.AzureDevOps.Endpoint == "" {
+			errs = append(errs, fmt.Errorf("%s.azureDevOps.endpoint: required", field))
+		}
+		if err := col.AzureDevOps.Token.validate(field + ".azureDevOps.token"); err != nil {
+			errs = append(errs, err)
+		}
+	case InClusterPlatform:
+		if col.InCluster == nil {
+			return append(errs, fmt.Errorf("%s.inCluster: required for platform %s", field, col.Platform))
+		}
+		if !col.InCluster.Tekton && !col.InCluster.Argo {
+			errs = append(errs, fmt.Errorf("%s.inCluster: at least one of tekton or argo must be set", field))
+		}
+	case HTTPJSONPlatform:
+		if col.HTTPJSON == nil {
+			return append(errs, fmt.Errorf("%s.httpJSON: required for platform %s", field, col.Platform))
+		}
+		errs = append(errs, col.HTTPJSON.validate(field+".httpJSON")...)
+	case PrometheusPlatform:
+		if col.Prometheus == nil {
+			return append(errs, fmt.Errorf("%s.prometheus: required for platform %s", field, col.Platform))
+		}
+		errs = append(errs, col.Prometheus.validate(field+".prometheus")...)
+	case REAPIPlatform:
+		if col.REAPI == nil {
+			return append(errs, fmt.Errorf("%s.reapi: required for platform %s", field, col.Platform))
+		}
+		errs = append(errs, validateURL(field+".reapi.endpoint", col.REAPI.Endpoint)...)
+		if col.REAPI.Token != nil {
+			if err := col.REAPI.Token.validate(field + ".reapi.token"); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	case DronePlatform:
+		if col.Drone == nil {
+			return append(errs, fmt.Errorf("%s.drone: required for platform %s", field, col.Platform))
+		}
+		errs = append(errs, col.Drone.validate(field+".drone")...)
+	case WoodpeckerPlatform:
+		if col.Woodpecker == nil {
+			return append(errs, fmt.Errorf("%s.woodpecker: required for platform %s", field, col.Platform))
+		}
+		errs = append(errs, col.Woodpecker.validate(field+".woodpecker")...)
+	case TeamCityPlatform:
+		if col.TeamCity == nil {
+			return append(errs, fmt.Errorf("%s.teamcity: required for platform %s", field, col.Platform))
+		}
+		errs = append(errs, validateURL(field+".teamcity.endpoint", col.TeamCity.Endpoint)...)
+		if err := col.TeamCity.Token.validate(field + ".teamcity.token"); err != nil {
+			errs = append(errs, err)
+		}
+	default:
+		errs = append(errs, fmt.Errorf("%s.platform: unknown platform %q, expected one of %s", field, col.Platform, Platforms))
+	}
+	return errs
+}
+
+func (h *HTTPJSON) validate(field string) []error {
+	errs := validateURL(field+".url", h.URL)
+	errs = append(errs, validateHeaders(field+".headers", h.Headers)...)
+	if err := h.Pagination.Compile(); err != nil {
+		errs = append(errs, fmt.Errorf("%s.pagination.%w", field, err))
+	}
+	if len(h.Metrics) == 0 {
+		errs = append(errs, fmt.Errorf("%s.metrics: at least one metric is required", field))
+	}
+	for i := range h.Metrics {
+		if err := h.Metrics[i].Compile(); err != nil {
+			errs = append(errs, fmt.Errorf("%s.metrics[%d].%w", field, i, err))
+		}
+	}
+	return errs
+}
+
+func (p *Prometheus) validate(field string) []error {
+	errs := validateURL(field+".url", p.URL)
+	errs = append(errs, validateHeaders(field+".headers", p.Headers)...)
+	if p.Query == "" && p.MetricName != "" {
+		errs = append(errs, fmt.Errorf("%s.metricName: only allowed with query", field))
+	}
+	for i, m := range p.Match {
+		if _, err := regexp.Compile(m); err != nil {
+			errs = append(errs, fmt.Errorf("%s.match[%d]: %w", field, i, err))
+		}
+	}
+	return errs
+}
+
+func (d *Drone) validate(field string) []error {
+	errs := validateURL(field+".endpoint", d.Endpoint)
+	if err := d.Token.validate(field + ".token"); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func validateURL(field, value string) []error {
+	if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return []error{fmt.Errorf("%s: expected an http or https URL, got %q", field, value)}
+	}
+	return nil
+}
+
+func validateHeaders(field string, headers []HTTPHeader) []error {
+	var errs []error
+	for i, header := range headers {
+		if header.Name == "" {
+			errs = append(errs, fmt.Errorf("%s[%d].name: required", field, i))
+		}
+		if header.Secret != nil {
+			if err := header.Secret.validate(fmt.Sprintf("%s[%d].secret", field, i)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+func compileRules(field string, rules []relabel.Rule) []error {
+	var errs []error
+	for i := range rules {
+		if err := rules[i].Compile(); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d]: %w", field, i, err))
+		}
+	}
+	return errs
+}
+
+// CustomMetrics reports whether a collector of c reports series served as
+// custom metrics of pods, i.e. Buildkite agent metrics.
+func (c *Config) CustomMetrics() bool {
+	for _, col := range c.Collectors {
+		if col.Buildkite != nil && col.Buildkite.API != nil && col.Buildkite.API.Agents {
+			return true
+		}
+	}
+	return false
+}
+
+// Metrics parses the derived metrics of c.
+func (c *Config) Metrics() ([]*derived.Metric, error) {
+	metrics := make([]*derived.Metric, 0, len(c.DerivedMetrics))
+	for _, d := range c.DerivedMetrics {
+		m, err := derived.NewMetric(d.Name, d.Expression)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
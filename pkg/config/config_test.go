@@ -0,0 +1,363 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(`
+apiVersion: buildscaler/v1
+scrapePeriod: 10s
+collectors:
+  - platform: buildkite
+    buildkite:
+      token:
+        env: BUILDKITE_AGENT_TOKEN
+      queues: [default, deploy]
+    relabel:
+      - sourceLabels: [queue]
+        regex: (.*)-spot
+        targetLabel: queue
+  - name: circleci-app
+    platform: circleci
+    scrapePeriod: 1m
+    circleci:
+      token:
+        file: /etc/buildscaler/circleci-token
+      projectSlug: gh/org/app
+  - platform: github-actions
+    githubActions:
+      token:
+        env: GITHUB_TOKEN
+      org: acme
+  - platform: gitlab
+    gitlab:
+      endpoint: https://gitlab.example.com
+      token:
+        file: /etc/buildscaler/gitlab-token
+      groups: [acme]
+derivedMetrics:
+  - name: desired_agents
+    expression: buildkite_running_jobs_count + buildkite_scheduled_jobs_count + 2
+`))
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Collectors, 4)
+
+	bk := cfg.Collectors[0]
+	assert.Equal(t, "buildkite", bk.Name)
+	assert.Equal(t, 10*time.Second, bk.ScrapePeriod.Duration)
+	assert.Equal(t, DefaultBuildkiteEndpoint, bk.Buildkite.Endpoint)
+	assert.Equal(t, []string{"default", "deploy"}, bk.Buildkite.Queues)
+	assert.Equal(t, "replace", bk.Relabel[0].Action)
+
+	cc := cfg.Collectors[1]
+	assert.Equal(t, "circleci-app", cc.Name)
+	assert.Equal(t, time.Minute, cc.ScrapePeriod.Duration)
+	assert.Equal(t, DefaultCircleCIEndpoint, cc.CircleCI.Endpoint)
+	assert.Equal(t, DefaultCircleCIMaxPipelineAge, cc.CircleCI.MaxPipelineAge.Duration)
+
+	gh := cfg.Collectors[2]
+	assert.Equal(t, "github-actions", gh.Name)
+	assert.Equal(t, DefaultGitHubEndpoint, gh.GitHubActions.Endpoint)
+	assert.Equal(t, "acme", gh.GitHubActions.Org)
+
+	gl := cfg.Collectors[3]
+	assert.Equal(t, "gitlab", gl.Name)
+	assert.Equal(t, "https://gitlab.example.com", gl.GitLab.Endpoint)
+	assert.Equal(t, []string{"acme"}, gl.GitLab.Groups)
+
+	metrics, err := cfg.Metrics()
+	assert.NoError(t, err)
+	assert.Equal(t, "desired_agents", metrics[0].Name)
+
+	assert.False(t, cfg.CustomMetrics())
+	bk.Buildkite.API = &BuildkiteAPI{Agents: true}
+	assert.True(t, cfg.CustomMetrics())
+}
+
+func TestParse_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"unknown field": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: buildkite
+    buildkite:
+      token: {env: TOKEN}
+      queue: default
+`,
+		"wrong version": `
+apiVersion: buildscaler/v2
+collectors:
+  - platform: buildkite
+    buildkite:
+      token: {env: TOKEN}
+`,
+		"buildkite token with clusters": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: buildkite
+    buildkite:
+      token: {env: TOKEN}
+      clusters:
+        - name: linux
+          token: {env: LINUX_CLUSTER_TOKEN}
+`,
+		"buildkite org without token": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: buildkite
+    buildkite:
+      orgs:
+        - queues: [default]
+`,
+		"buildkite api without token": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: buildkite
+    buildkite:
+      token: {env: TOKEN}
+      api:
+        waitTimes: true
+`,
+		"buildkite api with queue agent tag": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: buildkite
+    buildkite:
+      token: {env: TOKEN}
+      api:
+        token: {env: API_TOKEN}
+        agentQueryRules: [queue, os]
+`,
+		"no collectors": `
+apiVersion: buildscaler/v1
+`,
+		"unknown platform": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: travis
+`,
+		"jenkins without endpoint": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: jenkins
+    jenkins:
+      user: admin
+      token: {env: JENKINS_API_TOKEN}
+`,
+		"missing section": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: circleci
+`,
+		"duplicate name": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: buildkite
+    buildkite:
+      token: {env: TOKEN}
+  - platform: buildkite
+    buildkite:
+      token: {env: OTHER_TOKEN}
+`,
+		"secret without source": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: flarebuild
+    flarebuild:
+      apiKey: {}
+`,
+		"github repo without owner": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: github-actions
+    githubActions:
+      token: {env: GITHUB_TOKEN}
+      repos: [app]
+`,
+		"github without org or repos": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: github-actions
+    githubActions:
+      token: {env: GITHUB_TOKEN}
+`,
+		"gitlab without projects or groups": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: gitlab
+    gitlab:
+      token: {env: GITLAB_TOKEN}
+`,
+		"azure devops without endpoint": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: azure-devops
+    azureDevOps:
+      token: {env: AZURE_DEVOPS_PAT}
+`,
+		"in-cluster without tekton or argo": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: in-cluster
+    inCluster:
+      namespace: ci
+`,
+		"http-json with invalid path": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: http-json
+    httpJSON:
+      url: https://scheduler.example.com/api/queues
+      metrics:
+        - name: waiting_jobs
+          items: .queues[*
+`,
+		"http-json without url": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: http-json
+    httpJSON:
+      metrics:
+        - name: waiting_jobs
+`,
+		"prometheus with invalid match": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: prometheus
+    prometheus:
+      url: http://buildkite-agent-metrics:8080/metrics
+      match: ["buildkite_(.*"]
+`,
+		"prometheus metric name without query": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: prometheus
+    prometheus:
+      url: http://buildkite-agent-metrics:8080/metrics
+      metricName: scheduled_jobs
+`,
+		"reapi without endpoint": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: reapi
+    reapi:
+      token: {env: REAPI_TOKEN}
+`,
+		"woodpecker with drone section": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: woodpecker
+    drone:
+      endpoint: https://ci.example.com
+      token: {env: WOODPECKER_TOKEN}
+`,
+		"teamcity without token": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: teamcity
+    teamcity:
+      endpoint: https://teamcity.example.com
+`,
+		"invalid relabel": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: buildkite
+    buildkite:
+      token: {env: TOKEN}
+relabel:
+  - action: keep
+    regex: "("
+`,
+		"invalid derived metric": `
+apiVersion: buildscaler/v1
+collectors:
+  - platform: buildkite
+    buildkite:
+      token: {env: TOKEN}
+derivedMetrics:
+  - name: desired_agents
+    expression: "1 +"
+`,
+	}
+	for name, content := range cases {
+		_, err := Parse([]byte(content))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestSecret_Resolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildscaler")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("from-file\n"), 0600))
+
+	value, err := Secret{File: path}.Resolve()
+	assert.NoError(t, err)
+	assert.Equal(t, "from-file", value)
+
+	os.Setenv("BUILDSCALER_TEST_TOKEN", "from-env")
+	defer os.Unsetenv("BUILDSCALER_TEST_TOKEN")
+	value, err = Secret{Env: "BUILDSCALER_TEST_TOKEN"}.Resolve()
+	assert.NoError(t, err)
+	assert.Equal(t, "from-env", value)
+
+	_, err = Secret{Env: "BUILDSCALER_TEST_UNSET"}.Resolve()
+	assert.Error(t, err)
+}
+
+func TestHTTPJSON_Header(t *testing.T) {
+	cfg, err := Parse([]byte(`
+apiVersion: buildscaler/v1
+collectors:
+  - platform: http-json
+    httpJSON:
+      url: https://scheduler.example.com/api/queues
+      headers:
+        - name: Accept-Language
+          value: en
+        - name: Authorization
+          value: "Bearer "
+          secret: {env: BUILDSCALER_TEST_TOKEN}
+      pagination:
+        nextCursor: .meta.cursor
+        cursorParam: after
+      metrics:
+        - name: waiting_jobs
+          items: .queues[*]
+          value: .waiting
+          labels:
+            queue: .name
+`))
+	assert.NoError(t, err)
+	h := cfg.Collectors[0].HTTPJSON
+	assert.Equal(t, 100, h.Pagination.MaxPages)
+	assert.Equal(t, ".waiting", h.Metrics[0].Value)
+
+	os.Setenv("BUILDSCALER_TEST_TOKEN", "secret")
+	defer os.Unsetenv("BUILDSCALER_TEST_TOKEN")
+	header, err := h.Header()
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer secret", header.Get("Authorization"))
+	assert.Equal(t, "en", header.Get("Accept-Language"))
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package derived
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// derivedSource is the storage.Batch source of derived metrics, so a derived
+// series is deleted once its inputs are gone.
+const derivedSource = "derived metrics"
+
+// Metric is computed from an expression over other stored metrics, e.g.
+// buildkite_running_jobs_count + buildkite_scheduled_jobs_count + 2.
+//
+// The expression is evaluated once per label set: series of different
+// metrics are matched when their labels are identical, so a per-queue
+// metric yields one derived series per queue. A metric stored without any
+// labels, like buildkite_total_idle_agent_count, is used for every label set.
+type Metric struct {
+	Name       string
+	Expression string
+	expr       node
+}
+
+func NewMetric(name, expression string) (*Metric, error) {
+	if !metricNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid derived metric name %q", name)
+	}
+	expr, err := parseExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+	m := &Metric{Name: name, Expression: expression, expr: expr}
+	for _, referenced := range m.Metrics() {
+		if referenced == name {
+			return nil, fmt.Errorf("derived metric %s refers to itself", name)
+		}
+	}
+	return m, nil
+}
+
+// ParseMetric parses a derived metric given as "<name>=<expression>".
+func ParseMetric(s string) (*Metric, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid derived metric %q, expected <name>=<expression>", s)
+	}
+	return NewMetric(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+}
+
+// Metrics returns the names of all metrics the expression refers to.
+func (m *Metric) Metrics() []string {
+	names := map[string]struct{}{}
+	m.expr.metrics(names)
+	result := make([]string, 0, len(names))
+	for name := range names {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Evaluator computes derived metrics from the storage and writes them back,
+// so they are served like any scraped metric.
+type Evaluator struct {
+	storage storage.MetricsStore
+	metrics []*Metric
+}
+
+func NewEvaluator(storage storage.MetricsStore, metrics []*Metric) *Evaluator {
+	return &Evaluator{storage: storage, metrics: metrics}
+}
+
+// Evaluate computes every derived metric, in order, and commits the results
+// as a single batch. A derived metric may refer to the ones before it.
+func (e *Evaluator) Evaluate() {
+	if len(e.metrics) == 0 {
+		return
+	}
+	batch := storage.NewBatch()
+	batch.Source = derivedSource
+	computed := map[string][]external_metrics.ExternalMetricValue{}
+	for _, m := range e.metrics {
+		values := e.evaluate(m, computed)
+		computed[m.Name] = values
+		for _, value := range values {
+			batch.Add(m.Name, value)
+		}
+	}
+	e.storage.Commit(batch)
+}
+
+type operand struct {
+	labels map[string]string
+	value  float64
+}
+
+func (e *Evaluator) lookup(name string, computed map[string][]external_metrics.ExternalMetricValue) ([]external_metrics.ExternalMetricValue, bool) {
+	if values, ok := computed[name]; ok {
+		return values, true
+	}
+	series, ok := e.storage.Get(name, labels.Everything())
+	if !ok {
+		return nil, false
+	}
+	values := make([]external_metrics.ExternalMetricValue, 0, len(series))
+	for _, s := range series {
+		values = append(values, s.Value)
+	}
+	return values, true
+}
+
+func (e *Evaluator) evaluate(m *Metric, computed map[string][]external_metrics.ExternalMetricValue) []external_metrics.ExternalMetricValue {
+	// operands maps metric name -> series key -> value.
+	operands := map[string]map[string]operand{}
+	var labelSets map[string]map[string]string
+	for _, name := range m.Metrics() {
+		values, ok := e.lookup(name, computed)
+		if !ok {
+			klog.V(4).Infof("derived metric %s: metric %s not found, skipping", m.Name, name)
+			return nil
+		}
+		series := make(map[string]operand, len(values))
+		for _, v := range values {
+			series[storage.SeriesKey(v.MetricLabels)] = operand{labels: v.MetricLabels, value: v.Value.AsApproximateFloat64()}
+		}
+		operands[name] = series
+		if _, scalar := series[""]; scalar && len(series) == 1 {
+			continue
+		}
+		if labelSets == nil {
+			labelSets = map[string]map[string]string{}
+			for key, o := range series {
+				labelSets[key] = o.labels
+			}
+			continue
+		}
+		for key := range labelSets {
+			if _, ok := series[key]; !ok {
+				delete(labelSets, key)
+			}
+		}
+	}
+	if labelSets == nil {
+		labelSets = map[string]map[string]string{"": nil}
+	}
+
+	keys := make([]string, 0, len(labelSets))
+	for key := range labelSets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]external_metrics.ExternalMetricValue, 0, len(keys))
+	for _, key := range keys {
+		values := make(map[string]float64, len(operands))
+		for name, series := range operands {
+			if o, ok := series[key]; ok {
+				values[name] = o.value
+			} else {
+				values[name] = series[""].value
+			}
+		}
+		v := m.expr.eval(values)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			klog.V(4).Infof("derived metric %s{%s} is not a number, skipping", m.Name, key)
+			continue
+		}
+		result = append(result, external_metrics.ExternalMetricValue{
+			MetricName:   m.Name,
+			MetricLabels: labelSets[key],
+			Value:        *resource.NewMilliQuantity(int64(math.Round(v*1000)), resource.DecimalSI),
+		})
+	}
+	return result
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package derived
+
+import (
+	"testing"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+func TestParseExpression(t *testing.T) {
+	cases := []struct {
+		expression string
+		values     map[string]float64
+		expected   float64
+	}{
+		{"1 + 2 * 3", nil, 7},
+		{"(1 + 2) * 3", nil, 9},
+		{"10 - 4 - 3", nil, 3},
+		{"-2 * -3", nil, 6},
+		{"running + scheduled + 2", map[string]float64{"running": 3, "scheduled": 4}, 9},
+		{"waiting / max(idle, 1)", map[string]float64{"waiting": 6, "idle": 0}, 6},
+		{"waiting / max(idle, 1)", map[string]float64{"waiting": 6, "idle": 3}, 2},
+		{"min(a, b, 0.5)", map[string]float64{"a": 1, "b": 2}, 0.5},
+		{"ceil(a / 4)", map[string]float64{"a": 5}, 2},
+	}
+	for _, tc := range cases {
+		n, err := parseExpression(tc.expression)
+		assert.NoError(t, err, tc.expression)
+		assert.Equal(t, tc.expected, n.eval(tc.values), tc.expression)
+	}
+
+	for _, invalid := range []string{"", "1 +", "(1", "1 2", "foo(1)", "abs(1, 2)", "max()", "1 $ 2"} {
+		_, err := parseExpression(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseMetric(t *testing.T) {
+	m, err := ParseMetric("desired_agents = running + scheduled + 2")
+	assert.NoError(t, err)
+	assert.Equal(t, "desired_agents", m.Name)
+	assert.Equal(t, []string{"running", "scheduled"}, m.Metrics())
+
+	for _, invalid := range []string{"desired_agents", "desired-agents=1", "a=a+1", "a=1+"} {
+		_, err := ParseMetric(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func store(st *storage.ExternalMetricsMap, name, value string, metricLabels map[string]string) {
+	st.OverrideOrStore(name, external_metrics.ExternalMetricValue{
+		MetricName:   name,
+		MetricLabels: metricLabels,
+		Value:        resource.MustParse(value),
+	})
+}
+
+func TestEvaluator_Evaluate(t *testing.T) {
+	st := storage.NewExternalMetricsMap()
+	store(st, "buildkite_running_jobs_count", "1", map[string]string{"queue": "default"})
+	store(st, "buildkite_running_jobs_count", "2", map[string]string{"queue": "deploy"})
+	store(st, "buildkite_running_jobs_count", "5", map[string]string{"queue": "only-running"})
+	store(st, "buildkite_scheduled_jobs_count", "3", map[string]string{"queue": "default"})
+	store(st, "buildkite_scheduled_jobs_count", "0", map[string]string{"queue": "deploy"})
+	store(st, "buildkite_total_idle_agent_count", "0", nil)
+
+	var metrics []*Metric
+	for _, d := range []string{
+		"desired_agents=buildkite_running_jobs_count + buildkite_scheduled_jobs_count + 2",
+		"pressure=buildkite_scheduled_jobs_count / max(buildkite_total_idle_agent_count, 1)",
+		"desired_agents_halved=desired_agents / 2",
+		"ratio=buildkite_scheduled_jobs_count / buildkite_total_idle_agent_count",
+		"missing=not_my_metric + 1",
+	} {
+		m, err := ParseMetric(d)
+		assert.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	NewEvaluator(st, metrics).Evaluate()
+
+	expect := func(name string, expected map[string]string) {
+		series, ok := st.Get(name, labels.Everything())
+		assert.True(t, ok, name)
+		got := map[string]string{}
+		for _, s := range series {
+			got[s.Value.MetricLabels["queue"]] = s.Value.Value.String()
+		}
+		assert.Equal(t, expected, got, name)
+	}
+	expect("desired_agents", map[string]string{"default": "6", "deploy": "4"})
+	expect("pressure", map[string]string{"default": "3", "deploy": "0"})
+	expect("desired_agents_halved", map[string]string{"default": "3", "deploy": "2"})
+	// Division by zero yields no series.
+	_, ok := st.Get("ratio", labels.Everything())
+	assert.False(t, ok)
+	_, ok = st.Get("missing", labels.Everything())
+	assert.False(t, ok)
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package derived
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// node is a parsed expression. eval is called once per label set with the
+// value of every referenced metric for that label set.
+type node interface {
+	eval(values map[string]float64) float64
+	metrics(names map[string]struct{})
+}
+
+type number float64
+
+func (n number) eval(map[string]float64) float64 { return float64(n) }
+func (n number) metrics(map[string]struct{})     {}
+
+type metric string
+
+func (m metric) eval(values map[string]float64) float64 { return values[string(m)] }
+func (m metric) metrics(names map[string]struct{})      { names[string(m)] = struct{}{} }
+
+type binary struct {
+	op          byte
+	left, right node
+}
+
+func (b *binary) eval(values map[string]float64) float64 {
+	l, r := b.left.eval(values), b.right.eval(values)
+	switch b.op {
+	case '+':
+		return l + r
+	case '-':
+		return l - r
+	case '*':
+		return l * r
+	default:
+		// Division by zero yields NaN or Inf, which callers drop.
+		return l / r
+	}
+}
+
+func (b *binary) metrics(names map[string]struct{}) {
+	b.left.metrics(names)
+	b.right.metrics(names)
+}
+
+type negate struct {
+	operand node
+}
+
+func (n *negate) eval(values map[string]float64) float64 { return -n.operand.eval(values) }
+func (n *negate) metrics(names map[string]struct{})      { n.operand.metrics(names) }
+
+type call struct {
+	function string
+	args     []node
+}
+
+var functions = map[string]func(args []float64) float64{
+	"max": func(args []float64) float64 {
+		result := math.Inf(-1)
+		for _, a := range args {
+			result = math.Max(result, a)
+		}
+		return result
+	},
+	"min": func(args []float64) float64 {
+		result := math.Inf(1)
+		for _, a := range args {
+			result = math.Min(result, a)
+		}
+		return result
+	},
+	"abs":   func(args []float64) float64 { return math.Abs(args[0]) },
+	"ceil":  func(args []float64) float64 { return math.Ceil(args[0]) },
+	"floor": func(args []float64) float64 { return math.Floor(args[0]) },
+}
+
+// arity is the number of arguments each function takes, -1 means one or more.
+var arity = map[string]int{"max": -1, "min": -1, "abs": 1, "ceil": 1, "floor": 1}
+
+func (c *call) eval(values map[string]float64) float64 {
+	args := make([]float64, 0, len(c.args))
+	for _, a := range c.args {
+		args = append(args, a.eval(values))
+	}
+	return functions[c.function](args)
+}
+
+func (c *call) metrics(names map[string]struct{}) {
+	for _, a := range c.args {
+		a.metrics(names)
+	}
+}
+
+// parser is a recursive descent parser for the grammar:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/") unary }
+//	unary   = "-" unary | primary
+//	primary = number | name | name "(" expr { "," expr } ")" | "(" expr ")"
+type parser struct {
+	input string
+	pos   int
+}
+
+func parseExpression(input string) (node, error) {
+	p := &parser{input: input}
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos != len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+	return n, nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid expression %q at position %d: %s", p.input, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space character, or 0 at the end of the input.
+func (p *parser) peek() byte {
+	p.skipSpaces()
+	if p.pos == len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *parser) expr() (node, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) term() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (node, error) {
+	if p.peek() == '-' {
+		p.pos++
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &negate{operand: operand}, nil
+	}
+	return p.primary()
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+func (p *parser) primary() (node, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected ')'")
+		}
+		p.pos++
+		return n, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.input) && (p.input[p.pos] == '.' || (p.input[p.pos] >= '0' && p.input[p.pos] <= '9')) {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", p.input[start:p.pos])
+		}
+		return number(v), nil
+	case isNameChar(c, true):
+		start := p.pos
+		for p.pos < len(p.input) && isNameChar(p.input[p.pos], false) {
+			p.pos++
+		}
+		name := p.input[start:p.pos]
+		if p.peek() != '(' {
+			return metric(name), nil
+		}
+		return p.call(strings.ToLower(name))
+	case c == 0:
+		return nil, p.errorf("unexpected end of expression")
+	default:
+		return nil, p.errorf("unexpected %q", string(c))
+	}
+}
+
+func (p *parser) call(function string) (node, error) {
+	n, ok := arity[function]
+	if !ok {
+		return nil, p.errorf("unknown function %s", function)
+	}
+	p.pos++ // (
+	c := &call{function: function}
+	for {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, arg)
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	if p.peek() != ')' {
+		return nil, p.errorf("expected ')'")
+	}
+	p.pos++
+	if n >= 0 && len(c.args) != n {
+		return nil, p.errorf("%s takes %d argument(s), got %d", function, n, len(c.args))
+	}
+	return c, nil
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package relabel
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// MetricNameLabel refers to the metric name in SourceLabels and TargetLabel,
+// which allows renaming metrics.
+const MetricNameLabel = "__name__"
+
+const (
+	ActionReplace   = "replace"
+	ActionKeep      = "keep"
+	ActionDrop      = "drop"
+	ActionLabelDrop = "labeldrop"
+)
+
+var Actions = []string{ActionReplace, ActionKeep, ActionDrop, ActionLabelDrop}
+
+// Rule rewrites the labels of scraped metrics before they are stored. It
+// follows the semantics of Prometheus relabel_config: the values of
+// SourceLabels are joined with Separator and matched against Regex.
+//
+//   - replace sets TargetLabel to Replacement, with $1 etc. expanded, when
+//     Regex matches. An empty result removes TargetLabel.
+//   - keep drops the metric unless Regex matches, drop drops it when it does.
+//   - labeldrop removes every label whose name matches Regex.
+type Rule struct {
+	SourceLabels []string `json:"sourceLabels,omitempty"`
+	Separator    string   `json:"separator,omitempty"`
+	Regex        string   `json:"regex,omitempty"`
+	TargetLabel  string   `json:"targetLabel,omitempty"`
+	Replacement  string   `json:"replacement,omitempty"`
+	Action       string   `json:"action,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// Compile validates r and fills in defaults. It must be called before Apply.
+func (r *Rule) Compile() error {
+	if r.Action == "" {
+		r.Action = ActionReplace
+	}
+	if r.Separator == "" {
+		r.Separator = ";"
+	}
+	if r.Regex == "" {
+		r.Regex = "(.*)"
+	}
+	if r.Replacement == "" && r.Action == ActionReplace {
+		r.Replacement = "$1"
+	}
+	regex, err := regexp.Compile("^(?:" + r.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid relabel regex %q: %w", r.Regex, err)
+	}
+	r.regex = regex
+	switch r.Action {
+	case ActionReplace:
+		if r.TargetLabel == "" {
+			return fmt.Errorf("relabel action %s requires targetLabel", r.Action)
+		}
+	case ActionKeep, ActionDrop:
+		if len(r.SourceLabels) == 0 {
+			return fmt.Errorf("relabel action %s requires sourceLabels", r.Action)
+		}
+	case ActionLabelDrop:
+	default:
+		return fmt.Errorf("unknown relabel action %q, expected one of %s", r.Action, Actions)
+	}
+	return nil
+}
+
+// Apply runs rules on value in order. It returns false if the metric is
+// dropped. The labels of value are not modified in place.
+func Apply(rules []Rule, value external_metrics.ExternalMetricValue) (external_metrics.ExternalMetricValue, bool) {
+	if len(rules) == 0 {
+		return value, true
+	}
+	metricLabels := make(map[string]string, len(value.MetricLabels)+1)
+	for k, v := range value.MetricLabels {
+		metricLabels[k] = v
+	}
+	metricLabels[MetricNameLabel] = value.MetricName
+	for i := range rules {
+		if !rules[i].apply(metricLabels) {
+			return value, false
+		}
+	}
+	value.MetricName = metricLabels[MetricNameLabel]
+	delete(metricLabels, MetricNameLabel)
+	value.MetricLabels = metricLabels
+	return value, true
+}
+
+func (r *Rule) apply(metricLabels map[string]string) bool {
+	values := make([]string, 0, len(r.SourceLabels))
+	for _, l := range r.SourceLabels {
+		values = append(values, metricLabels[l])
+	}
+	source := strings.Join(values, r.Separator)
+	switch r.Action {
+	case ActionKeep:
+		return r.regex.MatchString(source)
+	case ActionDrop:
+		return !r.regex.MatchString(source)
+	case ActionLabelDrop:
+		for l := range metricLabels {
+			if l != MetricNameLabel && r.regex.MatchString(l) {
+				delete(metricLabels, l)
+			}
+		}
+	default:
+		match := r.regex.FindStringSubmatchIndex(source)
+		if match == nil {
+			return true
+		}
+		target := string(r.regex.ExpandString(nil, r.Replacement, source, match))
+		if target == "" && r.TargetLabel != MetricNameLabel {
+			delete(metricLabels, r.TargetLabel)
+		} else if target != "" {
+			metricLabels[r.TargetLabel] = target
+		}
+	}
+	return true
+}
+
+// Store relabels every metric written to the wrapped storage.
+type Store struct {
+	storage.MetricsStore
+	rules []Rule
+}
+
+func NewStore(store storage.MetricsStore, rules []Rule) *Store {
+	return &Store{MetricsStore: store, rules: rules}
+}
+
+func (s *Store) OverrideOrStore(key string, value external_metrics.ExternalMetricValue) {
+	if value, ok := Apply(s.rules, value); ok {
+		s.MetricsStore.OverrideOrStore(value.MetricName, value)
+	}
+}
+
+func (s *Store) Commit(b *storage.Batch) (uint64, time.Time) {
+	relabeled := storage.NewBatch()
+	relabeled.Source = b.Source
+	// Retained series are selected by their scraped labels, which may no
+	// longer match after relabeling.
+	for _, selection := range b.Retained() {
+		relabeled.Retain(selection)
+	}
+	for i := 0; i < b.Len(); i++ {
+		_, value := b.At(i)
+		if value, ok := Apply(s.rules, value); ok {
+			relabeled.Add(value.MetricName, value)
+		}
+	}
+	return s.MetricsStore.Commit(relabeled)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package relabel
+
+import (
+	"testing"
+
+	"github.com/elotl/buildscaler/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+func compile(t *testing.T, rules ...Rule) []Rule {
+	for i := range rules {
+		assert.NoError(t, rules[i].Compile())
+	}
+	return rules
+}
+
+func TestApply(t *testing.T) {
+	value := external_metrics.ExternalMetricValue{
+		MetricName:   "buildkite_waiting_jobs_count",
+		MetricLabels: map[string]string{"queue": "linux-spot", "org": "elotl"},
+	}
+	cases := []struct {
+		name           string
+		rules          []Rule
+		expectedName   string
+		expectedLabels map[string]string
+		expectedKeep   bool
+	}{
+		{
+			name:           "replace",
+			rules:          []Rule{{SourceLabels: []string{"queue"}, Regex: "(.*)-spot", TargetLabel: "queue"}},
+			expectedName:   "buildkite_waiting_jobs_count",
+			expectedLabels: map[string]string{"queue": "linux", "org": "elotl"},
+			expectedKeep:   true,
+		},
+		{
+			name:           "replace no match",
+			rules:          []Rule{{SourceLabels: []string{"queue"}, Regex: "(.*)-ondemand", TargetLabel: "queue"}},
+			expectedName:   "buildkite_waiting_jobs_count",
+			expectedLabels: map[string]string{"queue": "linux-spot", "org": "elotl"},
+			expectedKeep:   true,
+		},
+		{
+			name: "rename metric",
+			rules: []Rule{{
+				SourceLabels: []string{MetricNameLabel},
+				Regex:        "buildkite_(.*)",
+				TargetLabel:  MetricNameLabel,
+				Replacement:  "bk_$1",
+			}},
+			expectedName:   "bk_waiting_jobs_count",
+			expectedLabels: map[string]string{"queue": "linux-spot", "org": "elotl"},
+			expectedKeep:   true,
+		},
+		{
+			name:           "labeldrop",
+			rules:          []Rule{{Action: ActionLabelDrop, Regex: "org"}},
+			expectedName:   "buildkite_waiting_jobs_count",
+			expectedLabels: map[string]string{"queue": "linux-spot"},
+			expectedKeep:   true,
+		},
+		{
+			name:         "keep",
+			rules:        []Rule{{Action: ActionKeep, SourceLabels: []string{"queue"}, Regex: "macos"}},
+			expectedKeep: false,
+		},
+		{
+			name:         "drop",
+			rules:        []Rule{{Action: ActionDrop, SourceLabels: []string{"org", "queue"}, Regex: "elotl;.*"}},
+			expectedKeep: false,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, keep := Apply(compile(t, tc.rules...), value)
+			assert.Equal(t, tc.expectedKeep, keep)
+			if keep {
+				assert.Equal(t, tc.expectedName, got.MetricName)
+				assert.Equal(t, tc.expectedLabels, got.MetricLabels)
+			}
+			// The input must not be modified.
+			assert.Equal(t, map[string]string{"queue": "linux-spot", "org": "elotl"}, value.MetricLabels)
+		})
+	}
+}
+
+func TestRule_Compile(t *testing.T) {
+	for _, invalid := range []Rule{
+		{Action: "replace"},
+		{Action: "keep"},
+		{Action: "unknown", SourceLabels: []string{"queue"}},
+		{Action: "drop", SourceLabels: []string{"queue"}, Regex: "("},
+	} {
+		assert.Error(t, invalid.Compile(), invalid.Action)
+	}
+}
+
+func TestStore_Commit(t *testing.T) {
+	st := storage.NewExternalMetricsMap()
+	store := NewStore(st, compile(t,
+		Rule{Action: ActionDrop, SourceLabels: []string{"queue"}, Regex: "ignored"},
+		Rule{SourceLabels: []string{"queue"}, Regex: "(.*)-spot", TargetLabel: "queue"},
+	))
+	batch := storage.NewBatch()
+	for _, queue := range []string{"linux-spot", "ignored"} {
+		batch.Add("waiting", external_metrics.ExternalMetricValue{
+			MetricName:   "waiting",
+			MetricLabels: map[string]string{"queue": queue},
+			Value:        resource.MustParse("1"),
+		})
+	}
+	store.Commit(batch)
+
+	got, ok := st.Get("waiting", labels.Everything())
+	assert.True(t, ok)
+	assert.Len(t, got, 1)
+	assert.Equal(t, map[string]string{"queue": "linux"}, got[0].Value.MetricLabels)
+}
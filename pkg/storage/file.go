@@ -0,0 +1,182 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+type snapshotSeries struct {
+	Key         string                               `json:"key"`
+	Value       external_metrics.ExternalMetricValue `json:"value"`
+	LastUpdated time.Time                            `json:"lastUpdated"`
+	Generation  uint64                               `json:"generation"`
+	Source      string                               `json:"source,omitempty"`
+}
+
+type snapshot struct {
+	Generation uint64           `json:"generation"`
+	LastCommit time.Time        `json:"lastCommit"`
+	Series     []snapshotSeries `json:"series"`
+}
+
+// FileStore keeps metrics in an ExternalMetricsMap and writes a JSON snapshot
+// of it to disk after every change. The snapshot is loaded on startup, so a
+// restarted buildscaler serves the last known values right away instead of
+// waiting for the first scrape.
+type FileStore struct {
+	*ExternalMetricsMap
+	path    string
+	writeMu sync.Mutex
+}
+
+var _ MetricsStore = &FileStore{}
+
+func NewFileStore(metrics *ExternalMetricsMap, path string) (*FileStore, error) {
+	fs := &FileStore{
+		ExternalMetricsMap: metrics,
+		path:               path,
+	}
+	if err := fs.load(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *FileStore) load() error {
+	payload, err := ioutil.ReadFile(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		klog.V(2).Infof("no metrics snapshot at %s, starting empty", fs.path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(payload, &snap); err != nil {
+		return err
+	}
+	fs.RWMutex.Lock()
+	defer fs.RWMutex.Unlock()
+	fs.generation = snap.Generation
+	fs.lastCommit = snap.LastCommit
+	for _, s := range snap.Series {
+		series, ok := fs.Data[s.Key]
+		if !ok {
+			series = make(map[string]Series)
+			fs.Data[s.Key] = series
+		}
+		series[SeriesKey(s.Value.MetricLabels)] = Series{
+			Value:       s.Value,
+			LastUpdated: s.LastUpdated,
+			Generation:  s.Generation,
+			Source:      s.Source,
+		}
+	}
+	klog.V(2).Infof("loaded %d metric series from %s", len(snap.Series), fs.path)
+	return nil
+}
+
+func (fs *FileStore) save() {
+	fs.writeMu.Lock()
+	defer fs.writeMu.Unlock()
+	fs.RWMutex.RLock()
+	snap := snapshot{
+		Generation: fs.generation,
+		LastCommit: fs.lastCommit,
+	}
+	for key, series := range fs.Data {
+		for _, s := range series {
+			snap.Series = append(snap.Series, snapshotSeries{
+				Key:         key,
+				Value:       s.Value,
+				LastUpdated: s.LastUpdated,
+				Generation:  s.Generation,
+				Source:      s.Source,
+			})
+		}
+	}
+	fs.RWMutex.RUnlock()
+
+	payload, err := json.Marshal(snap)
+	if err != nil {
+		klog.Errorf("cannot encode metrics snapshot: %s", err)
+		return
+	}
+	// Write to a temporary file first, so a crash mid-write never leaves a
+	// truncated snapshot behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.path), filepath.Base(fs.path)+".tmp")
+	if err != nil {
+		klog.Errorf("cannot write metrics snapshot: %s", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(payload); err != nil {
+		tmp.Close()
+		klog.Errorf("cannot write metrics snapshot: %s", err)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		klog.Errorf("cannot write metrics snapshot: %s", err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), fs.path); err != nil {
+		klog.Errorf("cannot write metrics snapshot: %s", err)
+	}
+}
+
+func (fs *FileStore) OverrideOrStore(key string, value external_metrics.ExternalMetricValue) {
+	fs.ExternalMetricsMap.OverrideOrStore(key, value)
+	fs.save()
+}
+
+func (fs *FileStore) Commit(b *Batch) (uint64, time.Time) {
+	generation, committedAt := fs.ExternalMetricsMap.Commit(b)
+	fs.save()
+	return generation, committedAt
+}
+
+func (fs *FileStore) Delete(key string, selector labels.Selector) int {
+	deleted := fs.ExternalMetricsMap.Delete(key, selector)
+	if deleted > 0 {
+		fs.save()
+	}
+	return deleted
+}
+
+func (fs *FileStore) DeleteSource(source string) int {
+	deleted := fs.ExternalMetricsMap.DeleteSource(source)
+	if deleted > 0 {
+		fs.save()
+	}
+	return deleted
+}
+
+func (fs *FileStore) EvictStale(now time.Time) int {
+	evicted := fs.ExternalMetricsMap.EvictStale(now)
+	if evicted > 0 {
+		fs.save()
+	}
+	return evicted
+}
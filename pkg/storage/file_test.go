@@ -0,0 +1,74 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+func TestFileStore_SurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildscaler")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.json")
+
+	fs, err := NewFileStore(NewExternalMetricsMap(), path)
+	assert.NoError(t, err)
+	assert.Empty(t, fs.ListExternalMetricInfo())
+
+	batch := NewBatch()
+	batch.Source = "buildkite"
+	for _, queue := range []string{"default", "deploy"} {
+		batch.Add("buildkite_waiting_jobs_count", external_metrics.ExternalMetricValue{
+			MetricName:   "buildkite_waiting_jobs_count",
+			MetricLabels: map[string]string{"queue": queue},
+			Value:        resource.MustParse("3"),
+		})
+	}
+	generation, committedAt := fs.Commit(batch)
+	assert.Equal(t, 1, fs.Delete("buildkite_waiting_jobs_count", labels.SelectorFromSet(map[string]string{"queue": "deploy"})))
+
+	restarted, err := NewFileStore(NewExternalMetricsMap(), path)
+	assert.NoError(t, err)
+	lastGeneration, lastCommit := restarted.LastCommit()
+	assert.Equal(t, generation, lastGeneration)
+	assert.True(t, committedAt.Equal(lastCommit))
+
+	got, ok := restarted.Get("buildkite_waiting_jobs_count", labels.Everything())
+	assert.True(t, ok)
+	assert.Len(t, got, 1)
+	assert.Equal(t, map[string]string{"queue": "default"}, got[0].Value.MetricLabels)
+	assert.Equal(t, int64(3), got[0].Value.Value.Value())
+	assert.True(t, committedAt.Equal(got[0].LastUpdated))
+	assert.Equal(t, "buildkite", got[0].Source)
+}
+
+func TestFileStore_CorruptSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildscaler")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+
+	_, err = NewFileStore(NewExternalMetricsMap(), path)
+	assert.Error(t, err)
+}
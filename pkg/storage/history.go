@@ -0,0 +1,71 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"time"
+
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// Sample is a single scraped value of a series.
+type Sample struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// History is a fixed size ring buffer of the most recent samples of a series.
+type History struct {
+	samples []Sample
+	next    int
+	full    bool
+}
+
+func NewHistory(size int) *History {
+	return &History{samples: make([]Sample, size)}
+}
+
+func (h *History) Add(sample Sample) {
+	if len(h.samples) == 0 {
+		return
+	}
+	h.samples[h.next] = sample
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Since returns the samples taken at or after t, oldest first.
+func (h *History) Since(t time.Time) []Sample {
+	ordered := h.samples[:h.next]
+	if h.full {
+		ordered = append(append([]Sample{}, h.samples[h.next:]...), h.samples[:h.next]...)
+	}
+	var result []Sample
+	for _, sample := range ordered {
+		if !sample.Timestamp.Before(t) {
+			result = append(result, sample)
+		}
+	}
+	return result
+}
+
+// SeriesHistory is a copy of the current value of a series together with the
+// time it was last updated and its samples in the requested time window.
+type SeriesHistory struct {
+	Value       external_metrics.ExternalMetricValue
+	LastUpdated time.Time
+	Samples     []Sample
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+func TestHistory_Since(t *testing.T) {
+	start := time.Now()
+	h := NewHistory(3)
+	assert.Empty(t, h.Since(start))
+
+	for i := 0; i < 5; i++ {
+		h.Add(Sample{Timestamp: start.Add(time.Duration(i) * time.Minute), Value: float64(i)})
+	}
+	assert.Equal(t, []Sample{
+		{Timestamp: start.Add(2 * time.Minute), Value: 2},
+		{Timestamp: start.Add(3 * time.Minute), Value: 3},
+		{Timestamp: start.Add(4 * time.Minute), Value: 4},
+	}, h.Since(start))
+	assert.Equal(t, []Sample{
+		{Timestamp: start.Add(4 * time.Minute), Value: 4},
+	}, h.Since(start.Add(4*time.Minute)))
+}
+
+func TestExternalMetricsMap_History(t *testing.T) {
+	st := NewExternalMetricsMap()
+	st.HistorySize = 10
+	for _, v := range []string{"1", "5", "3"} {
+		batch := NewBatch()
+		batch.Add("metric", external_metrics.ExternalMetricValue{
+			MetricName:   "metric",
+			MetricLabels: map[string]string{"queue": "default"},
+			Value:        resource.MustParse(v),
+		})
+		st.Commit(batch)
+	}
+
+	got, ok := st.History("metric", labels.Everything(), time.Now().Add(-time.Minute))
+	assert.True(t, ok)
+	assert.Len(t, got, 1)
+	assert.Equal(t, resource.MustParse("3"), got[0].Value.Value)
+	values := make([]float64, 0, len(got[0].Samples))
+	for _, sample := range got[0].Samples {
+		values = append(values, sample.Value)
+	}
+	assert.Equal(t, []float64{1, 5, 3}, values)
+
+	_, ok = st.History("not-my-metric", labels.Everything(), time.Now())
+	assert.False(t, ok)
+}
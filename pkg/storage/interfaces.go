@@ -0,0 +1,37 @@
+/*
+Copyright 2022 Elotl Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// MetricsStore is what collectors write scraped metrics to and what the
+// metrics provider serves them from.
+type MetricsStore interface {
+	OverrideOrStore(key string, value external_metrics.ExternalMetricValue)
+	Commit(b *Batch) (uint64, time.Time)
+	Get(key string, selector labels.Selector) ([]Series, bool)
+	History(key string, selector labels.Selector, since time.Time) ([]SeriesHistory, bool)
+	ListExternalMetricInfo() []provider.ExternalMetricInfo
+	Delete(key string, selector labels.Selector) int
+	DeleteSource(source string) int
+	IsStale(s Series, now time.Time) bool
+	EvictStale(now time.Time) int
+	LastCommit() (uint64, time.Time)
+}
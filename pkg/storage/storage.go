@@ -14,42 +14,345 @@ limitations under the License.
 package storage
 
 import (
+	"sort"
 	"sync"
+	"time"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/klog/v2"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 )
 
+// Series is a single stored value together with the time it was last
+// written by a collector, the scrape generation that wrote it and the source
+// of the batch it was committed in, if any.
+type Series struct {
+	Value       external_metrics.ExternalMetricValue
+	LastUpdated time.Time
+	Generation  uint64
+	Source      string
+
+	history *History
+}
+
+// ExternalMetricsMap holds every series reported for a metric name. Data is
+// keyed by metric name first and by SeriesKey of the metric labels second, so
+// e.g. each Buildkite queue gets its own buildkite_waiting_jobs_count series.
 type ExternalMetricsMap struct {
 	RWMutex *sync.RWMutex
-	Data    map[string]external_metrics.ExternalMetricValue
+	Data    map[string]map[string]Series
+	// StaleAfter marks a series as stale when it was not updated for this
+	// long. Zero means series never become stale.
+	StaleAfter time.Duration
+	// EvictAfter is how long a series may go without an update before
+	// EvictStale deletes it. Zero disables eviction.
+	EvictAfter time.Duration
+	// HistorySize is the number of samples kept for each series to compute
+	// windowed aggregations. Zero disables history.
+	HistorySize int
+
+	generation uint64
+	lastCommit time.Time
 }
 
+var _ MetricsStore = &ExternalMetricsMap{}
+
 func NewExternalMetricsMap() *ExternalMetricsMap {
 	return &ExternalMetricsMap{
 		RWMutex: &sync.RWMutex{},
-		Data:    make(map[string]external_metrics.ExternalMetricValue),
+		Data:    make(map[string]map[string]Series),
 	}
 }
 
+// SeriesKey returns a stable identifier for a label set. Labels are sorted by
+// key, so two maps with the same content always produce the same key.
+func SeriesKey(metricLabels map[string]string) string {
+	return labels.Set(metricLabels).String()
+}
+
 func (e *ExternalMetricsMap) OverrideOrStore(key string, value external_metrics.ExternalMetricValue) {
 	e.RWMutex.Lock()
 	defer e.RWMutex.Unlock()
-	_, ok := e.Data[key]
-	if ok {
-		klog.V(5).Infof("metric %s already has value, overwriting...", key)
+	series, ok := e.Data[key]
+	if !ok {
+		series = make(map[string]Series)
+		e.Data[key] = series
+	}
+	seriesKey := SeriesKey(value.MetricLabels)
+	if _, ok := series[seriesKey]; ok {
+		klog.V(5).Infof("metric %s{%s} already has value, overwriting...", key, seriesKey)
+	}
+	series[seriesKey] = e.newSeries(series[seriesKey], value, time.Now())
+	klog.V(5).Infof("metric %s{%s} successfully scraped and stored.", key, seriesKey)
+}
+
+// newSeries returns the series replacing previous after value was scraped at
+// now, carrying over the sample history. Callers must hold the write lock.
+func (e *ExternalMetricsMap) newSeries(previous Series, value external_metrics.ExternalMetricValue, now time.Time) Series {
+	s := Series{Value: value, LastUpdated: now, Generation: e.generation, history: previous.history}
+	if e.HistorySize > 0 {
+		if s.history == nil {
+			s.history = NewHistory(e.HistorySize)
+		}
+		s.history.Add(Sample{Timestamp: now, Value: value.Value.AsApproximateFloat64()})
+	}
+	return s
+}
+
+// Batch stages the values of a single scrape, so a collector can hand them to
+// Commit all at once instead of calling OverrideOrStore for each value.
+type Batch struct {
+	// Source names whoever produced the batch, e.g. the collector. A batch
+	// with a Source replaces everything committed from the same Source
+	// before, so series it no longer reports are deleted.
+	Source string
+
+	keys     []string
+	values   []external_metrics.ExternalMetricValue
+	retained []Selection
+}
+
+// Selection selects the series of the metric MetricName, or of every metric
+// if it is empty, whose labels match Selector.
+type Selection struct {
+	MetricName string
+	Selector   labels.Selector
+}
+
+func (s Selection) matches(key string, metricLabels map[string]string) bool {
+	return (s.MetricName == "" || s.MetricName == key) && s.Selector.Matches(labels.Set(metricLabels))
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+func (b *Batch) Add(key string, value external_metrics.ExternalMetricValue) {
+	b.keys = append(b.keys, key)
+	b.values = append(b.values, value)
+}
+
+func (b *Batch) Len() int {
+	return len(b.values)
+}
+
+// At returns the i-th key and value added to b.
+func (b *Batch) At(i int) (string, external_metrics.ExternalMetricValue) {
+	return b.keys[i], b.values[i]
+}
+
+// Retain keeps the series of the batch Source selected by selection, although
+// they are missing from b, e.g. because the part of the CI platform reporting
+// them failed to scrape. They keep their last value and update time.
+func (b *Batch) Retain(selection Selection) {
+	b.retained = append(b.retained, selection)
+}
+
+// Retained returns the selections passed to Retain.
+func (b *Batch) Retained() []Selection {
+	return b.retained
+}
+
+// Commit stores every value of b under a single write lock, so readers never
+// see one half of a scrape next to the other half of the previous one. All
+// values get the same timestamp and a new scrape generation, which is
+// returned together with the timestamp.
+//
+// If b has a Source, the series committed from that Source before and missing
+// from b are deleted, e.g. the queue of a CI platform that was removed.
+// Without a Source, b is merged into the stored series.
+func (e *ExternalMetricsMap) Commit(b *Batch) (uint64, time.Time) {
+	e.RWMutex.Lock()
+	defer e.RWMutex.Unlock()
+	now := time.Now()
+	e.generation++
+	e.lastCommit = now
+	for i, key := range b.keys {
+		value := b.values[i]
+		value.Timestamp = metav1.NewTime(now)
+		series, ok := e.Data[key]
+		if !ok {
+			series = make(map[string]Series)
+			e.Data[key] = series
+		}
+		seriesKey := SeriesKey(value.MetricLabels)
+		s := e.newSeries(series[seriesKey], value, now)
+		s.Source = b.Source
+		series[seriesKey] = s
+	}
+	if b.Source != "" {
+		e.deleteReplaced(b)
+	}
+	klog.V(5).Infof("scrape generation %d: %d metrics committed", e.generation, b.Len())
+	return e.generation, now
+}
+
+// deleteReplaced deletes the series of the Source of b that were not written
+// by the current generation, unless b retains them. Callers must hold the
+// write lock.
+func (e *ExternalMetricsMap) deleteReplaced(b *Batch) {
+	for key, series := range e.Data {
+		for seriesKey, s := range series {
+			if s.Source != b.Source || s.Generation == e.generation || b.retains(key, s) {
+				continue
+			}
+			klog.V(2).Infof("metric %s{%s} no longer reported by %s, deleting", key, seriesKey, b.Source)
+			delete(series, seriesKey)
+		}
+		if len(series) == 0 {
+			delete(e.Data, key)
+		}
+	}
+}
+
+func (b *Batch) retains(key string, s Series) bool {
+	for _, selection := range b.retained {
+		if selection.matches(key, s.Value.MetricLabels) {
+			return true
+		}
+	}
+	return false
+}
+
+// LastCommit returns the generation and time of the latest Commit. The
+// generation is zero if nothing was committed yet.
+func (e *ExternalMetricsMap) LastCommit() (uint64, time.Time) {
+	e.RWMutex.RLock()
+	defer e.RWMutex.RUnlock()
+	return e.generation, e.lastCommit
+}
+
+// Get returns all series of the metric key whose labels match selector,
+// ordered by SeriesKey. The boolean result is false if no series was ever
+// stored under key.
+func (e *ExternalMetricsMap) Get(key string, selector labels.Selector) ([]Series, bool) {
+	e.RWMutex.RLock()
+	defer e.RWMutex.RUnlock()
+	series, ok := e.Data[key]
+	if !ok {
+		return nil, false
+	}
+	matched := make([]Series, 0, len(series))
+	for _, seriesKey := range sortedSeriesKeys(series) {
+		s := series[seriesKey]
+		if selector.Empty() || selector.Matches(labels.Set(s.Value.MetricLabels)) {
+			matched = append(matched, s)
+		}
+	}
+	return matched, true
+}
+
+// History returns the samples taken since the given time for every series of
+// the metric key whose labels match selector, ordered by SeriesKey.
+func (e *ExternalMetricsMap) History(key string, selector labels.Selector, since time.Time) ([]SeriesHistory, bool) {
+	e.RWMutex.RLock()
+	defer e.RWMutex.RUnlock()
+	series, ok := e.Data[key]
+	if !ok {
+		return nil, false
+	}
+	result := make([]SeriesHistory, 0, len(series))
+	for _, seriesKey := range sortedSeriesKeys(series) {
+		s := series[seriesKey]
+		if !selector.Empty() && !selector.Matches(labels.Set(s.Value.MetricLabels)) {
+			continue
+		}
+		h := SeriesHistory{Value: s.Value, LastUpdated: s.LastUpdated}
+		if s.history != nil {
+			h.Samples = s.history.Since(since)
+		}
+		result = append(result, h)
+	}
+	return result, true
+}
+
+// Delete removes all series of the metric key whose labels match selector and
+// returns how many were removed.
+func (e *ExternalMetricsMap) Delete(key string, selector labels.Selector) int {
+	e.RWMutex.Lock()
+	defer e.RWMutex.Unlock()
+	series, ok := e.Data[key]
+	if !ok {
+		return 0
+	}
+	deleted := 0
+	for seriesKey, s := range series {
+		if selector.Empty() || selector.Matches(labels.Set(s.Value.MetricLabels)) {
+			delete(series, seriesKey)
+			deleted++
+		}
+	}
+	if len(series) == 0 {
 		delete(e.Data, key)
+	}
+	return deleted
+}
+
+// DeleteSource removes every series committed from source, e.g. a collector
+// that was removed from the config, and returns how many were removed.
+func (e *ExternalMetricsMap) DeleteSource(source string) int {
+	e.RWMutex.Lock()
+	defer e.RWMutex.Unlock()
+	deleted := 0
+	for key, series := range e.Data {
+		for seriesKey, s := range series {
+			if s.Source == source {
+				delete(series, seriesKey)
+				deleted++
+			}
+		}
+		if len(series) == 0 {
+			delete(e.Data, key)
+		}
+	}
+	return deleted
+}
 
+func sortedSeriesKeys(series map[string]Series) []string {
+	seriesKeys := make([]string, 0, len(series))
+	for seriesKey := range series {
+		seriesKeys = append(seriesKeys, seriesKey)
 	}
-	e.Data[key] = value
-	klog.V(5).Infof("metric %s successfully scraped and stored.", key)
+	sort.Strings(seriesKeys)
+	return seriesKeys
+}
+
+// IsStale reports whether s was last updated more than StaleAfter before now.
+func (e *ExternalMetricsMap) IsStale(s Series, now time.Time) bool {
+	return e.StaleAfter > 0 && now.Sub(s.LastUpdated) > e.StaleAfter
+}
+
+// EvictStale deletes every series that was not updated during the last
+// EvictAfter, e.g. because its Buildkite queue was removed. It returns the
+// number of deleted series.
+func (e *ExternalMetricsMap) EvictStale(now time.Time) int {
+	if e.EvictAfter <= 0 {
+		return 0
+	}
+	e.RWMutex.Lock()
+	defer e.RWMutex.Unlock()
+	evicted := 0
+	for key, series := range e.Data {
+		for seriesKey, s := range series {
+			if now.Sub(s.LastUpdated) > e.EvictAfter {
+				klog.V(2).Infof("metric %s{%s} not updated since %s, evicting", key, seriesKey, s.LastUpdated)
+				delete(series, seriesKey)
+				evicted++
+			}
+		}
+		if len(series) == 0 {
+			delete(e.Data, key)
+		}
+	}
+	return evicted
 }
 
 func (e *ExternalMetricsMap) ListExternalMetricInfo() []provider.ExternalMetricInfo {
-	metrics := make([]provider.ExternalMetricInfo, 0, len(e.Data))
 	e.RWMutex.RLock()
 	defer e.RWMutex.RUnlock()
+	metrics := make([]provider.ExternalMetricInfo, 0, len(e.Data))
 	for key := range e.Data {
 		metrics = append(metrics, provider.ExternalMetricInfo{Metric: key})
 	}
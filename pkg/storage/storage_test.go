@@ -16,9 +16,11 @@ package storage
 import (
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 )
@@ -26,32 +28,36 @@ import (
 func TestExternalMetricsMap_OverrideOrStore(t *testing.T) {
 	cases := []struct {
 		name         string
-		initialData  map[string]external_metrics.ExternalMetricValue
+		initialData  map[string]map[string]external_metrics.ExternalMetricValue
 		key          string
 		val          external_metrics.ExternalMetricValue
-		expectedData map[string]external_metrics.ExternalMetricValue
+		expectedData map[string]map[string]external_metrics.ExternalMetricValue
 	}{
 		{
 			name:        "store",
-			initialData: make(map[string]external_metrics.ExternalMetricValue),
+			initialData: make(map[string]map[string]external_metrics.ExternalMetricValue),
 			key:         "metric",
 			val: external_metrics.ExternalMetricValue{
 				MetricName: "metric",
 				Value:      resource.MustParse("1"),
 			},
-			expectedData: map[string]external_metrics.ExternalMetricValue{
+			expectedData: map[string]map[string]external_metrics.ExternalMetricValue{
 				"metric": {
-					MetricName: "metric",
-					Value:      resource.MustParse("1"),
+					"": {
+						MetricName: "metric",
+						Value:      resource.MustParse("1"),
+					},
 				},
 			},
 		},
 		{
 			name: "override",
-			initialData: map[string]external_metrics.ExternalMetricValue{
+			initialData: map[string]map[string]external_metrics.ExternalMetricValue{
 				"metric": {
-					MetricName: "metric",
-					Value:      resource.MustParse("1"),
+					"": {
+						MetricName: "metric",
+						Value:      resource.MustParse("1"),
+					},
 				},
 			},
 			key: "metric",
@@ -59,10 +65,44 @@ func TestExternalMetricsMap_OverrideOrStore(t *testing.T) {
 				MetricName: "metric",
 				Value:      resource.MustParse("2"),
 			},
-			expectedData: map[string]external_metrics.ExternalMetricValue{
+			expectedData: map[string]map[string]external_metrics.ExternalMetricValue{
 				"metric": {
-					MetricName: "metric",
-					Value:      resource.MustParse("2"),
+					"": {
+						MetricName: "metric",
+						Value:      resource.MustParse("2"),
+					},
+				},
+			},
+		},
+		{
+			name: "store_another_series",
+			initialData: map[string]map[string]external_metrics.ExternalMetricValue{
+				"metric": {
+					"queue=default": {
+						MetricName:   "metric",
+						MetricLabels: map[string]string{"queue": "default"},
+						Value:        resource.MustParse("1"),
+					},
+				},
+			},
+			key: "metric",
+			val: external_metrics.ExternalMetricValue{
+				MetricName:   "metric",
+				MetricLabels: map[string]string{"queue": "deploy"},
+				Value:        resource.MustParse("2"),
+			},
+			expectedData: map[string]map[string]external_metrics.ExternalMetricValue{
+				"metric": {
+					"queue=default": {
+						MetricName:   "metric",
+						MetricLabels: map[string]string{"queue": "default"},
+						Value:        resource.MustParse("1"),
+					},
+					"queue=deploy": {
+						MetricName:   "metric",
+						MetricLabels: map[string]string{"queue": "deploy"},
+						Value:        resource.MustParse("2"),
+					},
 				},
 			},
 		},
@@ -72,10 +112,10 @@ func TestExternalMetricsMap_OverrideOrStore(t *testing.T) {
 			rwm := &sync.RWMutex{}
 			st := &ExternalMetricsMap{
 				RWMutex: rwm,
-				Data:    tc.initialData,
+				Data:    toSeries(tc.initialData, time.Now()),
 			}
 			st.OverrideOrStore(tc.key, tc.val)
-			assert.Equal(t, tc.expectedData, st.Data)
+			assert.Equal(t, tc.expectedData, values(st.Data))
 		})
 	}
 }
@@ -83,14 +123,14 @@ func TestExternalMetricsMap_OverrideOrStore(t *testing.T) {
 func TestExternalMetricsMap_ListExternalMetricInfo(t *testing.T) {
 	cases := []struct {
 		name        string
-		initialData map[string]external_metrics.ExternalMetricValue
+		initialData map[string]map[string]Series
 		expected    []provider.ExternalMetricInfo
 	}{
 		{
 			name: "happy path",
-			initialData: map[string]external_metrics.ExternalMetricValue{
-				"metric1": {},
-				"metric2": {},
+			initialData: map[string]map[string]Series{
+				"metric1": {"": {}},
+				"metric2": {"queue=default": {}, "queue=deploy": {}},
 			},
 			expected: []provider.ExternalMetricInfo{
 				{
@@ -116,3 +156,224 @@ func TestExternalMetricsMap_ListExternalMetricInfo(t *testing.T) {
 		})
 	}
 }
+
+func TestExternalMetricsMap_Get(t *testing.T) {
+	st := NewExternalMetricsMap()
+	for _, queue := range []string{"deploy", "default"} {
+		st.OverrideOrStore("metric", external_metrics.ExternalMetricValue{
+			MetricName:   "metric",
+			MetricLabels: map[string]string{"queue": queue},
+			Value:        resource.MustParse("1"),
+		})
+	}
+
+	got, ok := st.Get("metric", labels.Everything())
+	assert.True(t, ok)
+	assert.Len(t, got, 2)
+	assert.Equal(t, "default", got[0].Value.MetricLabels["queue"])
+	assert.Equal(t, "deploy", got[1].Value.MetricLabels["queue"])
+
+	got, ok = st.Get("metric", labels.SelectorFromSet(map[string]string{"queue": "deploy"}))
+	assert.True(t, ok)
+	assert.Len(t, got, 1)
+	assert.Equal(t, "deploy", got[0].Value.MetricLabels["queue"])
+
+	got, ok = st.Get("metric", labels.SelectorFromSet(map[string]string{"queue": "other"}))
+	assert.True(t, ok)
+	assert.Empty(t, got)
+
+	_, ok = st.Get("not-my-metric", labels.Everything())
+	assert.False(t, ok)
+}
+
+func TestExternalMetricsMap_Delete(t *testing.T) {
+	st := NewExternalMetricsMap()
+	for _, queue := range []string{"deploy", "default"} {
+		st.OverrideOrStore("metric", external_metrics.ExternalMetricValue{
+			MetricName:   "metric",
+			MetricLabels: map[string]string{"queue": queue},
+		})
+	}
+	assert.Equal(t, 0, st.Delete("not-my-metric", labels.Everything()))
+	assert.Equal(t, 1, st.Delete("metric", labels.SelectorFromSet(map[string]string{"queue": "deploy"})))
+	got, ok := st.Get("metric", labels.Everything())
+	assert.True(t, ok)
+	assert.Len(t, got, 1)
+
+	assert.Equal(t, 1, st.Delete("metric", labels.Everything()))
+	_, ok = st.Get("metric", labels.Everything())
+	assert.False(t, ok)
+}
+
+func TestExternalMetricsMap_EvictStale(t *testing.T) {
+	now := time.Now()
+	st := NewExternalMetricsMap()
+	st.EvictAfter = time.Minute
+	st.Data = map[string]map[string]Series{
+		"metric1": {
+			"queue=default": {LastUpdated: now.Add(-time.Second)},
+			"queue=removed": {LastUpdated: now.Add(-time.Hour)},
+		},
+		"metric2": {
+			"": {LastUpdated: now.Add(-time.Hour)},
+		},
+	}
+	assert.Equal(t, 2, st.EvictStale(now))
+	assert.Equal(t, map[string]map[string]Series{
+		"metric1": {
+			"queue=default": {LastUpdated: now.Add(-time.Second)},
+		},
+	}, st.Data)
+
+	st.EvictAfter = 0
+	st.Data["metric1"]["queue=default"] = Series{LastUpdated: now.Add(-time.Hour)}
+	assert.Equal(t, 0, st.EvictStale(now))
+}
+
+func TestExternalMetricsMap_IsStale(t *testing.T) {
+	now := time.Now()
+	st := NewExternalMetricsMap()
+	old := Series{LastUpdated: now.Add(-time.Hour)}
+	fresh := Series{LastUpdated: now.Add(-time.Second)}
+	assert.False(t, st.IsStale(old, now))
+
+	st.StaleAfter = time.Minute
+	assert.True(t, st.IsStale(old, now))
+	assert.False(t, st.IsStale(fresh, now))
+}
+
+func TestExternalMetricsMap_Commit(t *testing.T) {
+	st := NewExternalMetricsMap()
+	generation, _ := st.LastCommit()
+	assert.Equal(t, uint64(0), generation)
+
+	batch := NewBatch()
+	batch.Add("waiting", external_metrics.ExternalMetricValue{
+		MetricName:   "waiting",
+		MetricLabels: map[string]string{"queue": "default"},
+		Value:        resource.MustParse("3"),
+	})
+	batch.Add("idle", external_metrics.ExternalMetricValue{
+		MetricName:   "idle",
+		MetricLabels: map[string]string{"queue": "default"},
+		Value:        resource.MustParse("1"),
+	})
+	assert.Equal(t, 2, batch.Len())
+	generation, committedAt := st.Commit(batch)
+	assert.Equal(t, uint64(1), generation)
+
+	for _, key := range []string{"waiting", "idle"} {
+		s := st.Data[key]["queue=default"]
+		assert.Equal(t, uint64(1), s.Generation)
+		assert.Equal(t, committedAt, s.LastUpdated)
+		assert.True(t, s.Value.Timestamp.Time.Equal(committedAt))
+	}
+
+	batch = NewBatch()
+	batch.Add("waiting", external_metrics.ExternalMetricValue{
+		MetricName:   "waiting",
+		MetricLabels: map[string]string{"queue": "default"},
+		Value:        resource.MustParse("0"),
+	})
+	generation, committedAt = st.Commit(batch)
+	assert.Equal(t, uint64(2), generation)
+	assert.Equal(t, resource.MustParse("0"), st.Data["waiting"]["queue=default"].Value.Value)
+	assert.Equal(t, uint64(1), st.Data["idle"]["queue=default"].Generation)
+	lastGeneration, lastCommit := st.LastCommit()
+	assert.Equal(t, generation, lastGeneration)
+	assert.Equal(t, committedAt, lastCommit)
+}
+
+func TestExternalMetricsMap_CommitSource(t *testing.T) {
+	st := NewExternalMetricsMap()
+	value := func(queue, v string) external_metrics.ExternalMetricValue {
+		return external_metrics.ExternalMetricValue{
+			MetricName:   "waiting",
+			MetricLabels: map[string]string{"queue": queue},
+			Value:        resource.MustParse(v),
+		}
+	}
+	batch := NewBatch()
+	batch.Source = "buildkite"
+	batch.Add("waiting", value("default", "3"))
+	batch.Add("waiting", value("deploy", "1"))
+	batch.Add("idle", value("deploy", "2"))
+	st.Commit(batch)
+	other := NewBatch()
+	other.Source = "gitlab"
+	other.Add("waiting", value("runners", "5"))
+	st.Commit(other)
+	st.OverrideOrStore("waiting", value("manual", "7"))
+
+	// The deploy queue is gone from the second scrape of the same source.
+	batch = NewBatch()
+	batch.Source = "buildkite"
+	batch.Add("waiting", value("default", "4"))
+	st.Commit(batch)
+
+	assert.Equal(t, []string{"queue=default", "queue=manual", "queue=runners"}, sortedSeriesKeys(st.Data["waiting"]))
+	assert.Equal(t, resource.MustParse("4"), st.Data["waiting"]["queue=default"].Value.Value)
+	assert.Equal(t, "buildkite", st.Data["waiting"]["queue=default"].Source)
+	_, ok := st.Get("idle", labels.Everything())
+	assert.False(t, ok)
+
+	// Retained series survive although they are missing.
+	batch = NewBatch()
+	batch.Source = "gitlab"
+	batch.Retain(Selection{Selector: labels.SelectorFromSet(map[string]string{"queue": "runners"})})
+	st.Commit(batch)
+	assert.Equal(t, resource.MustParse("5"), st.Data["waiting"]["queue=runners"].Value.Value)
+	batch = NewBatch()
+	batch.Source = "gitlab"
+	batch.Retain(Selection{MetricName: "idle", Selector: labels.Everything()})
+	st.Commit(batch)
+	assert.NotContains(t, st.Data["waiting"], "queue=runners")
+
+	// A batch without a source is merged.
+	batch = NewBatch()
+	batch.Add("waiting", value("other", "1"))
+	st.Commit(batch)
+	assert.Len(t, st.Data["waiting"], 3)
+}
+
+func TestExternalMetricsMap_DeleteSource(t *testing.T) {
+	st := NewExternalMetricsMap()
+	for _, source := range []string{"buildkite", "gitlab"} {
+		batch := NewBatch()
+		batch.Source = source
+		batch.Add("waiting", external_metrics.ExternalMetricValue{
+			MetricName:   "waiting",
+			MetricLabels: map[string]string{"queue": source},
+			Value:        resource.MustParse("1"),
+		})
+		st.Commit(batch)
+	}
+	assert.Equal(t, 1, st.DeleteSource("gitlab"))
+	assert.Equal(t, 0, st.DeleteSource("gitlab"))
+	assert.Equal(t, []string{"queue=buildkite"}, sortedSeriesKeys(st.Data["waiting"]))
+	assert.Equal(t, 1, st.DeleteSource("buildkite"))
+	_, ok := st.Get("waiting", labels.Everything())
+	assert.False(t, ok)
+}
+
+func toSeries(data map[string]map[string]external_metrics.ExternalMetricValue, lastUpdated time.Time) map[string]map[string]Series {
+	result := make(map[string]map[string]Series, len(data))
+	for key, series := range data {
+		result[key] = make(map[string]Series, len(series))
+		for seriesKey, value := range series {
+			result[key][seriesKey] = Series{Value: value, LastUpdated: lastUpdated}
+		}
+	}
+	return result
+}
+
+func values(data map[string]map[string]Series) map[string]map[string]external_metrics.ExternalMetricValue {
+	result := make(map[string]map[string]external_metrics.ExternalMetricValue, len(data))
+	for key, series := range data {
+		result[key] = make(map[string]external_metrics.ExternalMetricValue, len(series))
+		for seriesKey, s := range series {
+			result[key][seriesKey] = s.Value
+		}
+	}
+	return result
+}